@@ -0,0 +1,332 @@
+package conntrack
+
+import (
+	"sync"
+	"time"
+)
+
+// Record describes a connection from its creation until its destruction, built by an
+// Aggregator from the events of its Flow.
+type Record struct {
+	ID   uint32
+	NSID int32
+	Zone uint16
+
+	TupleOrig, TupleReply Tuple
+
+	// Start and Stop are the times the connection was created and destroyed. They are taken
+	// from the Flow's Timestamp when the kernel reports it in destroy events (when the
+	// net.netfilter.nf_conntrack_timestamp sysctl is enabled), and otherwise from the times
+	// the Flow's first event and its destroy event were received.
+	Start, Stop time.Time
+	Duration    time.Duration
+
+	// The total amount of packets and bytes of the connection, only reported by the kernel
+	// when the net.netfilter.nf_conntrack_acct sysctl is enabled.
+	CountersOrig, CountersReply Counter
+
+	// TCPState is the last state of a TCP connection, or 0 for other protocols.
+	TCPState uint8
+
+	Status Status
+	Mark   uint32
+	Labels Labels
+
+	// NewMissed is set when the Flow's new event was not received, because the Flow was
+	// created before the events were received, or the event was lost.
+	NewMissed bool
+
+	// DestroyMissed is set when the Flow's destroy event was not received. Its Flow was
+	// evicted by another Flow with the same tuple, was missing from a resync dump, or was
+	// still active when the Aggregator was flushed.
+	DestroyMissed bool
+}
+
+// RecordSink receives the Records built by an Aggregator.
+type RecordSink interface {
+	WriteRecord(Record) error
+}
+
+// RecordSinkFunc is an adapter to use a function as a RecordSink.
+type RecordSinkFunc func(Record) error
+
+// WriteRecord calls f(r).
+func (f RecordSinkFunc) WriteRecord(r Record) error {
+	return f(r)
+}
+
+// Aggregator correlates the new, update and destroy events of Flows by their ID and tuples,
+// and writes a Record to its RecordSink when a connection ends. Flows are tracked per network
+// namespace ID, so the events of Conns with the netlink.ListenAllNSID option can be aggregated.
+//
+// The resync events of a Listener are used to find the Flows that were destroyed while
+// events were lost, see ListenerConfig. Resyncs are tracked per namespace ID, but Listeners
+// always send the events of their own namespace with NSIDLocal. The events of Listeners in
+// different namespaces, like those of a MultiListener, cannot share an Aggregator, use one
+// Aggregator per namespace instead. Expect events are ignored.
+type Aggregator struct {
+	sink RecordSink
+	now  func() time.Time
+
+	mu     sync.Mutex
+	flows  map[aggregatorKey]*aggregatorFlow
+	tuples map[aggregatorTupleKey]aggregatorKey
+
+	// Flows seen in the resync dumps in progress, by namespace ID.
+	resync map[int32]map[aggregatorKey]bool
+}
+
+// aggregatorKey identifies a Flow in an Aggregator.
+type aggregatorKey struct {
+	nsid int32
+	id   uint32
+}
+
+// aggregatorTupleKey identifies the tuple of a Flow in an Aggregator.
+type aggregatorTupleKey struct {
+	nsid  int32
+	tuple tupleKey
+}
+
+// aggregatorFlow is the state of a connection tracked by an Aggregator.
+type aggregatorFlow struct {
+	flow      Flow
+	start     time.Time
+	newMissed bool
+}
+
+// NewAggregator returns an Aggregator that writes its Records to sink.
+func NewAggregator(sink RecordSink) *Aggregator {
+	return &Aggregator{
+		sink:   sink,
+		now:    time.Now,
+		flows:  make(map[aggregatorKey]*aggregatorFlow),
+		tuples: make(map[aggregatorTupleKey]aggregatorKey),
+		resync: make(map[int32]map[aggregatorKey]bool),
+	}
+}
+
+// Add applies an Event to the Aggregator, writing the Records of the connections it ended
+// to the sink. Returns the first error returned by the sink. The Event is applied regardless.
+func (a *Aggregator) Add(e Event) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+
+	switch e.Type {
+	case EventResync:
+		a.resync[e.NSID] = make(map[aggregatorKey]bool)
+		return nil
+	case EventResyncFlow:
+		seen, ok := a.resync[e.NSID]
+		if !ok || e.Flow == nil {
+			return nil
+		}
+		seen[aggregatorKey{e.NSID, e.Flow.ID}] = true
+		return a.update(e.NSID, *e.Flow, now, false)
+	case EventResyncDone:
+		return a.resyncDone(e.NSID, now)
+	}
+
+	if e.Flow == nil {
+		return nil
+	}
+
+	switch e.Type {
+	case EventNew:
+		return a.update(e.NSID, *e.Flow, now, true)
+	case EventUpdate:
+		return a.update(e.NSID, *e.Flow, now, false)
+	case EventDestroy:
+		return a.destroy(e.NSID, *e.Flow, now)
+	}
+
+	return nil
+}
+
+// Run adds the Events received from ev until it is closed. Returns the first error
+// returned by the sink, leaving the remaining Events unread.
+func (a *Aggregator) Run(ev <-chan Event) error {
+
+	for e := range ev {
+		if err := a.Add(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush writes the Records of all connections that are still active, as if they ended now,
+// and stops tracking them. Use it to account for the active connections on shutdown.
+func (a *Aggregator) Flush() error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+
+	var err error
+	for k := range a.flows {
+		if rerr := a.end(k, Flow{}, now, true); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+// Len returns the amount of active connections tracked by the Aggregator.
+func (a *Aggregator) Len() int {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.flows)
+}
+
+// update tracks the Flow of a new, update or resync event. Flows that are not tracked yet
+// are started. A Flow that has the tuple of another Flow ends the other Flow.
+func (a *Aggregator) update(nsid int32, f Flow, now time.Time, isNew bool) error {
+
+	k := aggregatorKey{nsid, f.ID}
+
+	var err error
+	for _, tk := range a.tupleKeys(nsid, f) {
+		if other, ok := a.tuples[tk]; ok && other != k {
+			if rerr := a.end(other, Flow{}, now, true); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}
+
+	af, ok := a.flows[k]
+	if ok {
+		mergeFlow(&f, af.flow)
+		af.flow = f
+	} else {
+		af = &aggregatorFlow{flow: f, start: now, newMissed: !isNew}
+		a.flows[k] = af
+	}
+
+	for _, tk := range a.tupleKeys(nsid, f) {
+		a.tuples[tk] = k
+	}
+
+	return err
+}
+
+// destroy ends the Flow of a destroy event. Flows without an ID are identified by their
+// original tuple. Destroy events of Flows that are not tracked still produce a Record.
+func (a *Aggregator) destroy(nsid int32, f Flow, now time.Time) error {
+
+	k := aggregatorKey{nsid, f.ID}
+	if f.ID == 0 {
+		if tk, ok := a.tuples[aggregatorTupleKey{nsid, newTupleKey(f.TupleOrig)}]; ok {
+			k = tk
+		}
+	}
+
+	if _, ok := a.flows[k]; !ok {
+		a.flows[k] = &aggregatorFlow{flow: f, start: now, newMissed: true}
+	}
+
+	return a.end(k, f, now, false)
+}
+
+// resyncDone ends the Flows of the resynced namespace that were not in its resync dump.
+func (a *Aggregator) resyncDone(nsid int32, now time.Time) error {
+
+	seen, ok := a.resync[nsid]
+	if !ok {
+		return nil
+	}
+
+	var err error
+	for k := range a.flows {
+		if k.nsid != nsid || seen[k] {
+			continue
+		}
+		if rerr := a.end(k, Flow{}, now, true); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	delete(a.resync, nsid)
+
+	return err
+}
+
+// end stops tracking a Flow and writes its Record to the sink. The Flow of a destroy
+// event is merged into the tracked state, and is empty when the destroy event was missed.
+func (a *Aggregator) end(k aggregatorKey, f Flow, now time.Time, missed bool) error {
+
+	af := a.flows[k]
+
+	delete(a.flows, k)
+	for _, tk := range a.tupleKeys(k.nsid, af.flow) {
+		if a.tuples[tk] == k {
+			delete(a.tuples, tk)
+		}
+	}
+
+	if missed {
+		f = af.flow
+	} else {
+		mergeFlow(&f, af.flow)
+	}
+
+	r := newRecord(f, k.nsid)
+	r.NewMissed = af.newMissed
+	r.DestroyMissed = missed
+
+	if r.Start.IsZero() {
+		r.Start = af.start
+	}
+	if r.Stop.IsZero() {
+		r.Stop = now
+	}
+	r.Duration = r.Stop.Sub(r.Start)
+
+	return a.sink.WriteRecord(r)
+}
+
+// newRecord returns the Record of a destroyed Flow. Its start and stop times are taken
+// from the Flow's Timestamp, and are zero when the kernel did not report them.
+func newRecord(f Flow, nsid int32) Record {
+
+	r := Record{
+		ID:            f.ID,
+		NSID:          nsid,
+		Zone:          f.Zone,
+		TupleOrig:     f.TupleOrig,
+		TupleReply:    f.TupleReply,
+		Start:         f.Timestamp.Start,
+		Stop:          f.Timestamp.Stop,
+		CountersOrig:  f.CountersOrig,
+		CountersReply: f.CountersReply,
+		Status:        f.Status,
+		Mark:          f.Mark,
+		Labels:        f.Labels,
+	}
+
+	if !r.Start.IsZero() && !r.Stop.IsZero() {
+		r.Duration = r.Stop.Sub(r.Start)
+	}
+
+	if f.ProtoInfo.TCP != nil {
+		r.TCPState = f.ProtoInfo.TCP.State
+	}
+
+	return r
+}
+
+// tupleKeys returns the keys of the original and reply tuples of a Flow.
+func (a *Aggregator) tupleKeys(nsid int32, f Flow) []aggregatorTupleKey {
+	return []aggregatorTupleKey{
+		{nsid, newTupleKey(f.TupleOrig)},
+		{nsid, newTupleKey(f.TupleReply)},
+	}
+}
@@ -0,0 +1,68 @@
+//+build integration
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestAggregatorListen(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	ev := make(chan Event)
+	l, err := lc.StartListener(ev, 1, groupsFlow, nil)
+	require.NoError(t, err)
+
+	recs := make(chan Record, 1)
+	a := NewAggregator(RecordSinkFunc(func(r Record) error {
+		recs <- r
+		return nil
+	}))
+
+	runErr := make(chan error)
+	go func() {
+		runErr <- a.Run(ev)
+	}()
+
+	f := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+	require.NoError(t, c.Create(f))
+
+	f.Mark = 42
+	require.NoError(t, c.Update(f))
+	require.NoError(t, c.Delete(f))
+
+	select {
+	case r := <-recs:
+		assert.NotZero(t, r.ID)
+		assert.Equal(t, f.TupleOrig.IP.SourceAddress.To4(), r.TupleOrig.IP.SourceAddress.To4())
+		assert.Equal(t, uint32(42), r.Mark)
+		assert.Equal(t, uint8(3), r.TCPState)
+		assert.Equal(t, NSIDLocal, r.NSID)
+		assert.False(t, r.NewMissed)
+		assert.False(t, r.DestroyMissed)
+		assert.False(t, r.Stop.Before(r.Start))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Record")
+	}
+
+	assert.Zero(t, a.Len())
+
+	require.NoError(t, l.Stop())
+	require.NoError(t, <-runErr)
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, c.Close())
+}
@@ -0,0 +1,174 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregator(t *testing.T) {
+
+	var recs []Record
+	a := NewAggregator(RecordSinkFunc(func(r Record) error {
+		recs = append(recs, r)
+		return nil
+	}))
+
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+
+	f := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 10)
+	f.ID = 1
+	f.Labels = Labels{0x01}
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 1}
+
+	require.NoError(t, a.Add(Event{Type: EventNew, Flow: &f, NSID: NSIDLocal}))
+	assert.Equal(t, 1, a.Len())
+
+	// Update events without labels keep the current ones.
+	now = now.Add(time.Second)
+	u := f
+	u.Labels = nil
+	u.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+	require.NoError(t, a.Add(Event{Type: EventUpdate, Flow: &u, NSID: NSIDLocal}))
+
+	// Destroy events carry the counters, but no protoinfo.
+	now = now.Add(time.Second)
+	d := f
+	d.Labels = nil
+	d.ProtoInfo = ProtoInfo{}
+	d.CountersOrig = Counter{Packets: 2, Bytes: 100}
+	d.CountersReply = Counter{Direction: true, Packets: 3, Bytes: 200}
+	require.NoError(t, a.Add(Event{Type: EventDestroy, Flow: &d, NSID: NSIDLocal}))
+
+	require.Len(t, recs, 1)
+	r := recs[0]
+	assert.Equal(t, uint32(1), r.ID)
+	assert.Equal(t, time.Unix(1000, 0), r.Start)
+	assert.Equal(t, time.Unix(1002, 0), r.Stop)
+	assert.Equal(t, 2*time.Second, r.Duration)
+	assert.Equal(t, uint8(3), r.TCPState)
+	assert.Equal(t, uint32(10), r.Mark)
+	assert.Equal(t, Labels{0x01}, r.Labels)
+	assert.Equal(t, uint64(200), r.CountersReply.Bytes)
+	assert.False(t, r.NewMissed)
+	assert.False(t, r.DestroyMissed)
+	assert.Zero(t, a.Len())
+
+	// A Flow whose new event was missed uses its kernel timestamps.
+	d.ID = 2
+	d.Timestamp = Timestamp{Start: time.Unix(500, 0), Stop: time.Unix(800, 0)}
+	require.NoError(t, a.Add(Event{Type: EventDestroy, Flow: &d, NSID: 4}))
+
+	require.Len(t, recs, 2)
+	r = recs[1]
+	assert.True(t, r.NewMissed)
+	assert.Equal(t, int32(4), r.NSID)
+	assert.Equal(t, 300*time.Second, r.Duration)
+
+	// A Flow with the tuple of a tracked Flow ends it.
+	f.ID = 3
+	require.NoError(t, a.Add(Event{Type: EventUpdate, Flow: &f, NSID: NSIDLocal}))
+	f.ID = 4
+	require.NoError(t, a.Add(Event{Type: EventNew, Flow: &f, NSID: NSIDLocal}))
+
+	require.Len(t, recs, 3)
+	assert.Equal(t, uint32(3), recs[2].ID)
+	assert.True(t, recs[2].NewMissed)
+	assert.True(t, recs[2].DestroyMissed)
+	assert.Equal(t, 1, a.Len())
+
+	// Flows missing from a resync dump are ended, those in other namespaces are kept.
+	g := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(9, 9, 9, 9), 1234, 53, 120, 0)
+	g.ID = 5
+	require.NoError(t, a.Add(Event{Type: EventNew, Flow: &g, NSID: 1}))
+
+	h := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(9, 9, 9, 9), 1234, 54, 120, 0)
+	h.ID = 6
+
+	require.NoError(t, a.Add(Event{Type: EventResync, NSID: NSIDLocal}))
+	require.NoError(t, a.Add(Event{Type: EventResyncFlow, Flow: &h, NSID: NSIDLocal}))
+	require.NoError(t, a.Add(Event{Type: EventResyncDone, NSID: NSIDLocal}))
+
+	require.Len(t, recs, 4)
+	assert.Equal(t, uint32(4), recs[3].ID)
+	assert.True(t, recs[3].DestroyMissed)
+	assert.Equal(t, 2, a.Len())
+
+	// Flushing ends all active Flows.
+	require.NoError(t, a.Flush())
+	assert.Len(t, recs, 6)
+	assert.Zero(t, a.Len())
+	assert.Empty(t, a.tuples)
+}
+
+func TestAggregatorResyncNSIDs(t *testing.T) {
+
+	var ended []aggregatorKey
+	a := NewAggregator(RecordSinkFunc(func(r Record) error {
+		ended = append(ended, aggregatorKey{r.NSID, r.ID})
+		return nil
+	}))
+
+	// Two Flows in each namespace, with the same IDs.
+	flows := make(map[aggregatorKey]Flow)
+	for _, nsid := range []int32{1, 2} {
+		for id := uint32(1); id <= 2; id++ {
+			f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, uint16(id), 120, 0)
+			f.ID = id
+			flows[aggregatorKey{nsid, id}] = f
+			require.NoError(t, a.Add(Event{Type: EventNew, Flow: &f, NSID: nsid}))
+		}
+	}
+
+	resyncFlow := func(nsid int32, id uint32) Event {
+		f := flows[aggregatorKey{nsid, id}]
+		return Event{Type: EventResyncFlow, Flow: &f, NSID: nsid}
+	}
+
+	// The resyncs of both namespaces overlap, each only ends the Flows of its own
+	// namespace that are missing from its dump.
+	for _, e := range []Event{
+		{Type: EventResync, NSID: 1},
+		{Type: EventResync, NSID: 2},
+		resyncFlow(1, 1),
+		resyncFlow(2, 2),
+		{Type: EventResyncDone, NSID: 1},
+	} {
+		require.NoError(t, a.Add(e))
+	}
+	assert.Equal(t, []aggregatorKey{{1, 2}}, ended)
+
+	require.NoError(t, a.Add(Event{Type: EventResyncDone, NSID: 2}))
+	assert.Equal(t, []aggregatorKey{{1, 2}, {2, 1}}, ended)
+	assert.Equal(t, 2, a.Len())
+	assert.Empty(t, a.resync)
+
+	// A second EventResyncDone without a resync in progress ends nothing.
+	require.NoError(t, a.Add(Event{Type: EventResyncDone, NSID: 2}))
+	assert.Equal(t, 2, a.Len())
+}
+
+func TestAggregatorRun(t *testing.T) {
+
+	errSink := errors.New("sink error")
+	a := NewAggregator(RecordSinkFunc(func(r Record) error {
+		return errSink
+	}))
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	f.ID = 1
+
+	ev := make(chan Event, 2)
+	ev <- Event{Type: EventNew, Flow: &f}
+	ev <- Event{Type: EventDestroy, Flow: &f}
+	close(ev)
+
+	assert.Equal(t, errSink, a.Run(ev))
+	assert.Zero(t, a.Len())
+}
@@ -2,6 +2,8 @@ package conntrack
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -143,7 +145,7 @@ func (hlp *Helper) unmarshal(attr netfilter.Attribute) error {
 	for _, iattr := range attr.Children {
 		switch helperType(iattr.Type) {
 		case ctaHelpName:
-			hlp.Name = string(iattr.Data)
+			hlp.Name = strings.TrimSuffix(string(iattr.Data), "\x00")
 		case ctaHelpInfo:
 			hlp.Info = iattr.Data
 		default:
@@ -159,7 +161,8 @@ func (hlp Helper) marshal() netfilter.Attribute {
 
 	nfa := netfilter.Attribute{Type: uint16(ctaHelp), Nested: true, Children: make([]netfilter.Attribute, 1, 2)}
 
-	nfa.Children[0] = netfilter.Attribute{Type: uint16(ctaHelpName), Data: []byte(hlp.Name)}
+	// The kernel expects a NUL-terminated helper name.
+	nfa.Children[0] = netfilter.Attribute{Type: uint16(ctaHelpName), Data: append([]byte(hlp.Name), 0)}
 
 	if len(hlp.Info) > 0 {
 		nfa.Children = append(nfa.Children, netfilter.Attribute{Type: uint16(ctaHelpInfo), Data: hlp.Info})
@@ -268,9 +271,10 @@ func (tpi *ProtoInfoTCP) unmarshal(attr netfilter.Attribute) error {
 		return errors.Wrap(errNotNested, opUnProtoInfoTCP)
 	}
 
-	// A ProtoInfoTCP has at least 3 members, TCP_STATE and TCP_FLAGS_ORIG/REPLY.
-	if len(attr.Children) < 3 {
-		return errors.Wrap(errNeedChildren, opUnProtoInfoTCP)
+	// A ProtoInfoTCP has at least 1 member, TCP_STATE. Dumps and most events also
+	// carry TCP_FLAGS_ORIG/REPLY, but destroy events only carry TCP_STATE.
+	if len(attr.Children) == 0 {
+		return errors.Wrap(errNeedSingleChild, opUnProtoInfoTCP)
 	}
 
 	for _, iattr := range attr.Children {
@@ -680,6 +684,87 @@ func (sp SynProxy) marshal() netfilter.Attribute {
 	return nfa
 }
 
+// NAT describes the range of addresses and ports the source or destination of a Flow
+// is translated to. When MaxIP or MaxPort are zero, the range consists of only MinIP or
+// MinPort respectively. Leave the ports zero to only translate addresses.
+//
+// NAT bindings can only be set up when creating a Flow. The kernel picks the translated
+// address and port from the range, and rewrites the Flow's reply tuple accordingly.
+type NAT struct {
+	MinIP, MaxIP     net.IP
+	MinPort, MaxPort uint16
+}
+
+// filled returns true if the NAT's address or port range is set.
+func (n NAT) filled() bool {
+	return n.MinIP != nil || n.MaxIP != nil || n.MinPort != 0 || n.MaxPort != 0
+}
+
+// marshal marshals a NAT into a netfilter.Attribute of the given type. ipv6 selects
+// the address family of the Flow the NAT belongs to, which its addresses need to match.
+func (n NAT) marshal(at attributeType, ipv6 bool) (netfilter.Attribute, error) {
+
+	nfa := netfilter.Attribute{Type: uint16(at), Nested: true}
+
+	if n.MinIP != nil || n.MaxIP != nil {
+		maxIP := n.MaxIP
+		if maxIP == nil {
+			maxIP = n.MinIP
+		}
+
+		minType, maxType := ctaNatV4MinIP, ctaNatV4MaxIP
+		if ipv6 {
+			minType, maxType = ctaNatV6MinIP, ctaNatV6MaxIP
+		}
+
+		minIP, maxIP := natIP(n.MinIP, ipv6), natIP(maxIP, ipv6)
+		if minIP == nil || maxIP == nil {
+			return netfilter.Attribute{}, errBadNAT
+		}
+
+		nfa.Children = append(nfa.Children,
+			netfilter.Attribute{Type: uint16(minType), Data: minIP},
+			netfilter.Attribute{Type: uint16(maxType), Data: maxIP},
+		)
+	}
+
+	if n.MinPort != 0 || n.MaxPort != 0 {
+		maxPort := n.MaxPort
+		if maxPort == 0 {
+			maxPort = n.MinPort
+		}
+
+		nfa.Children = append(nfa.Children, netfilter.Attribute{
+			Type:   uint16(ctaNatProto),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{Type: uint16(ctaProtoNatPortMin), Data: netfilter.Uint16Bytes(n.MinPort)},
+				{Type: uint16(ctaProtoNatPortMax), Data: netfilter.Uint16Bytes(maxPort)},
+			},
+		})
+	}
+
+	return nfa, nil
+}
+
+// natIP returns the 4-byte representation of an IPv4 address, or the 16-byte representation
+// of an IPv6 address if ipv6 is true. Returns nil if ip is not an address of the given family.
+func natIP(ip net.IP, ipv6 bool) net.IP {
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if ipv6 {
+			return nil
+		}
+		return ip4
+	}
+
+	if !ipv6 {
+		return nil
+	}
+
+	return ip.To16()
+}
+
 // TODO: ctaStats
 // TODO: ctaStatsGlobal
 // TODO: ctaStatsExp
@@ -2,10 +2,12 @@ package conntrack
 
 import (
 	"fmt"
+	"net"
 	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/ti-mo/netfilter"
 )
 
@@ -82,7 +84,7 @@ func TestAttributeHelper(t *testing.T) {
 		Children: []netfilter.Attribute{
 			{
 				Type: uint16(ctaHelpName),
-				Data: []byte("foo"),
+				Data: []byte("foo\x00"),
 			},
 			{
 				Type: uint16(ctaHelpInfo),
@@ -165,6 +167,28 @@ func TestAttributeProtoInfo(t *testing.T) {
 	// Re-marshal into netfilter Attribute
 	assert.EqualValues(t, nfaInfoTCP, tpi.marshal())
 
+	// ProtoInfoTCP of a destroy event, only holding the state
+	nfaInfoTCPState := netfilter.Attribute{
+		Type:   uint16(ctaProtoInfo),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{
+				Type:   uint16(ctaProtoInfoTCP),
+				Nested: true,
+				Children: []netfilter.Attribute{
+					{
+						Type: uint16(ctaProtoInfoTCPState),
+						Data: []byte{7},
+					},
+				},
+			},
+		},
+	}
+
+	var tpis ProtoInfo
+	assert.Nil(t, tpis.unmarshal(nfaInfoTCPState))
+	assert.Equal(t, uint8(7), tpis.TCP.State)
+
 	// Error during ProtoInfoTCP unmarshal
 	nfaInfoTCPError := netfilter.Attribute{
 		Type:   uint16(ctaProtoInfo),
@@ -309,7 +333,7 @@ func TestAttributeProtoInfoTCP(t *testing.T) {
 
 	assert.EqualError(t, pit.unmarshal(nfaBadType), fmt.Sprintf(errAttributeWrongType, ctaUnspec, ctaProtoInfoTCP))
 	assert.EqualError(t, pit.unmarshal(nfaNotNested), errors.Wrap(errNotNested, opUnProtoInfoTCP).Error())
-	assert.EqualError(t, pit.unmarshal(nfaNestedNoChildren), errors.Wrap(errNeedChildren, opUnProtoInfoTCP).Error())
+	assert.EqualError(t, pit.unmarshal(nfaNestedNoChildren), errors.Wrap(errNeedSingleChild, opUnProtoInfoTCP).Error())
 
 	nfaProtoInfoTCP := netfilter.Attribute{
 		Type:   uint16(ctaProtoInfoTCP),
@@ -680,3 +704,51 @@ func TestAttributeSynProxy(t *testing.T) {
 
 	assert.EqualValues(t, nfaSynProxy, sp.marshal())
 }
+
+func TestAttributeNAT(t *testing.T) {
+
+	assert.Equal(t, false, NAT{}.filled())
+	assert.Equal(t, true, NAT{MinIP: net.ParseIP("1.2.3.4")}.filled())
+	assert.Equal(t, true, NAT{MaxPort: 1}.filled())
+
+	nat := NAT{MinIP: net.ParseIP("1.2.3.4"), MinPort: 80, MaxPort: 90}
+	nfaNAT := netfilter.Attribute{
+		Type:   uint16(ctaNatSrc),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(ctaNatV4MinIP), Data: []byte{1, 2, 3, 4}},
+			{Type: uint16(ctaNatV4MaxIP), Data: []byte{1, 2, 3, 4}},
+			{
+				Type:   uint16(ctaNatProto),
+				Nested: true,
+				Children: []netfilter.Attribute{
+					{Type: uint16(ctaProtoNatPortMin), Data: []byte{0, 80}},
+					{Type: uint16(ctaProtoNatPortMax), Data: []byte{0, 90}},
+				},
+			},
+		},
+	}
+
+	nfa, err := nat.marshal(ctaNatSrc, false)
+	require.NoError(t, err)
+	assert.EqualValues(t, nfaNAT, nfa)
+
+	nat6 := NAT{MinIP: net.ParseIP("2a00::1"), MaxIP: net.ParseIP("2a00::2")}
+	nfa, err = nat6.marshal(ctaNatDst, true)
+	require.NoError(t, err)
+	assert.EqualValues(t, netfilter.Attribute{
+		Type:   uint16(ctaNatDst),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(ctaNatV6MinIP), Data: []byte(net.ParseIP("2a00::1"))},
+			{Type: uint16(ctaNatV6MaxIP), Data: []byte(net.ParseIP("2a00::2"))},
+		},
+	}, nfa)
+
+	_, err = nat6.marshal(ctaNatDst, false)
+	assert.EqualError(t, err, errBadNAT.Error())
+	_, err = nat.marshal(ctaNatSrc, true)
+	assert.EqualError(t, err, errBadNAT.Error())
+	_, err = NAT{MaxIP: net.ParseIP("1.2.3.4")}.marshal(ctaNatSrc, false)
+	assert.EqualError(t, err, errBadNAT.Error())
+}
@@ -1,28 +1,51 @@
 package conntrack
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"sync"
 
 	"github.com/mdlayher/netlink"
 	"github.com/pkg/errors"
 	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
 )
 
 // Conn represents a Netlink connection to the Netfilter
 // subsystem and implements all Conntrack actions.
+//
+// Methods with a Context suffix apply the deadline and cancellation of the given
+// context.Context to the Conn's underlying socket. Queries on a Conn are serialized.
 type Conn struct {
-	conn *netfilter.Conn
+	conn *netlink.Conn
+
+	// Marks the Conn as being attached to one or more multicast groups,
+	// it can no longer be used for any queries for its remaining lifetime.
+	isMulticast bool
+
+	// Sequence number of a request that was interrupted before all of its
+	// replies were read, to be drained from the socket before the next query.
+	pending uint32
+
+	// Mutex to protect isMulticast and pending, serializes queries.
+	mu sync.RWMutex
+
+	// Filter criteria applied by the kernel to dump and flush requests,
+	// probed when a Filter first needs them. Protected by fmu.
+	dumpSupport, flushSupport *filterSupport
+	fmu                       sync.Mutex
 }
 
 // Dial opens a new Netfilter Netlink connection and returns it
 // wrapped in a Conn structure that implements the Conntrack API.
 func Dial(config *netlink.Config) (*Conn, error) {
-	c, err := netfilter.Dial(config)
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{c}, nil
+	return &Conn{conn: c}, nil
 }
 
 // Close closes a Conn.
@@ -39,166 +62,1326 @@ func (c *Conn) SetOption(option netlink.ConnOption, enable bool) error {
 // amount of Flow decoders from the Conn to the Flow channel. Returns an error channel
 // the workers will return any errors on. Any error during Flow decoding is fatal and
 // will halt the worker it occurs on. When numWorkers amount of errors have been received on
-// the error channel, no more events will be produced on evChan.
+// the error channel, no more events will be produced on evChan. The error channel is buffered
+// to hold an error of each worker, and is closed after all workers have exited.
 //
 // The Conn will be marked as having listeners active, which will prevent Listen from being
-// called again. For listening on other groups, open another socket.
+// called again until all workers have exited. For listening on other groups at the same time,
+// open another socket. To stop the workers, use ListenContext or StartListener.
 //
 // evChan consumers need to be able to keep up with the Event producers. When the channel is full,
-// messages will pile up in the Netlink socket's buffer, putting the socket at risk of being closed
-// by the kernel when it eventually fills up.
+// messages will pile up in the Netlink socket's buffer. When it eventually fills up, the kernel
+// drops events and the worker reading the socket halts with an ENOBUFS error. Listeners started
+// with StartListener survive this.
 func (c *Conn) Listen(evChan chan<- Event, numWorkers uint8, groups []netfilter.NetlinkGroup) (chan error, error) {
+	return c.ListenContext(context.Background(), evChan, numWorkers, groups)
+}
 
-	if numWorkers == 0 {
-		return nil, errors.Errorf(errWorkerCount, numWorkers)
-	}
-
-	// Prevent Listen() from being called twice on the same Conn.
-	// This is checked again in JoinGroups(), but an early failure is preferred.
-	if c.conn.IsMulticast() {
-		return nil, errConnHasListeners
-	}
+// ListenContext is like Listen, but stops all workers when ctx is cancelled. Workers stopped
+// this way exit without sending an error on the error channel, and the channel is closed once
+// all of them have returned. evChan is left open, since it may be shared with other producers.
+func (c *Conn) ListenContext(ctx context.Context, evChan chan<- Event, numWorkers uint8, groups []netfilter.NetlinkGroup) (chan error, error) {
 
-	err := c.conn.JoinGroups(groups)
+	l, err := c.listen(ctx, evChan, numWorkers, groups, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	errChan := make(chan error)
-
-	// Start numWorkers amount of worker goroutines
-	for id := uint8(0); id < numWorkers; id++ {
-		go c.eventWorker(id, evChan, errChan)
-	}
-
-	return errChan, nil
+	return l.errChan, nil
 }
 
 // eventWorker is a worker function that decodes Netlink messages into Events.
-func (c *Conn) eventWorker(workerID uint8, evChan chan<- Event, errChan chan<- error) {
+// It returns without producing an error when ctx is cancelled.
+func (c *Conn) eventWorker(ctx context.Context, l *Listener, workerID uint8, evChan chan<- Event) {
 
 	var err error
-	var recv []netlink.Message
+	var recv netlink.Message
+	var nsid int32
 	var ev Event
 
+	// sendErr sends err on errChan, unless the context was cancelled.
+	sendErr := func(err error) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// errChan is large enough to hold an error of each worker.
+		l.errChan <- err
+	}
+
 	for {
 		// Receive data from the Netlink socket
-		recv, err = c.conn.Receive()
+		recv, nsid, err = c.receiveEvent()
+		if en, ok := errno(err); ok && en == unix.ENOBUFS && l.handleOverruns {
+			// The kernel dropped events, the socket remains usable.
+			if err := l.overrun(ctx, evChan); err != nil {
+				sendErr(err)
+				return
+			}
+			continue
+		}
 		if err != nil {
-			errChan <- errors.Wrap(err, fmt.Sprintf(errWorkerReceive, workerID))
+			sendErr(errors.Wrap(err, fmt.Sprintf(errWorkerReceive, workerID)))
 			return
 		}
 
-		// Receive() always returns a list of Netlink Messages, but multicast messages should never be multi-part
-		if len(recv) > 1 {
-			errChan <- errMultipartEvent
+		if err := l.receiveDone(); err != nil {
+			sendErr(errors.Wrap(err, opGrowReadBuffer))
 			return
 		}
 
 		// Decode event and send on channel
-		ev = *new(Event)
-		err := ev.unmarshal(recv[0])
+		ev = Event{NSID: nsid}
+		err := ev.unmarshal(recv)
 		if err != nil {
-			errChan <- err
+			sendErr(err)
 			return
 		}
 
-		evChan <- ev
+		select {
+		case evChan <- ev:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 // Dump gets all Conntrack connections from the kernel in the form of a list
-// of Flow objects.
+// of Flow objects. To dump Flows of a single address family, use DumpFilter
+// with the Filter's Family field set.
 func (c *Conn) Dump() ([]Flow, error) {
+	return c.DumpContext(context.Background())
+}
+
+// DumpContext is like Dump, but takes a context.Context to bound the operation.
+func (c *Conn) DumpContext(ctx context.Context) ([]Flow, error) {
+	return c.dumpType(ctx, ctGet)
+}
+
+// dumpType sends a dump request of the given message type for both IPv4 and IPv6,
+// and returns the Flows decoded from the response.
+func (c *Conn) dumpType(ctx context.Context, mt messageType) ([]Flow, error) {
+
+	req, err := dumpRequest(mt)
+	if err != nil {
+		return nil, err
+	}
+
+	nlm, err := c.query(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalFlows(nlm)
+}
+
+// dumpRequest returns an unfiltered dump request of the given message type.
+func dumpRequest(mt messageType) (netlink.Message, error) {
+
+	return netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(mt),
+			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
+			Flags:       netlink.Request | netlink.Dump,
+		},
+		nil)
+}
+
+// DumpFilter gets all Conntrack connections from the kernel in the form of a list
+// of Flow objects, but only returns Flows matching the connmark specified in the Filter parameter.
+// Criteria of the Filter the kernel does not support are applied in userspace, see Filter.
+func (c *Conn) DumpFilter(f Filter) ([]Flow, error) {
+	return c.DumpFilterContext(context.Background(), f)
+}
+
+// DumpFilterContext is like DumpFilter, but takes a context.Context to bound the operation.
+func (c *Conn) DumpFilterContext(ctx context.Context, f Filter) ([]Flow, error) {
+
+	var flows []Flow
+
+	err := c.queryFilterFunc(ctx, ctGet, f, func(f Flow) bool {
+		flows = append(flows, f)
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return flows, nil
+}
+
+// DumpFunc gets all Conntrack connections from the kernel and calls fn for each Flow
+// as soon as it is decoded. Unlike Dump, only a single batch of Netlink messages read
+// from the socket is held in memory at any time, making it suitable for large tables.
+//
+// Return false from fn to stop receiving Flows. The remainder of the dump is then read
+// from the socket and discarded without being decoded. fn is not called concurrently.
+func (c *Conn) DumpFunc(fn func(Flow) bool) error {
+	return c.DumpFuncContext(context.Background(), fn)
+}
+
+// DumpFuncContext is like DumpFunc, but takes a context.Context to bound the operation.
+func (c *Conn) DumpFuncContext(ctx context.Context, fn func(Flow) bool) error {
+
+	req, err := dumpRequest(ctGet)
+	if err != nil {
+		return err
+	}
+
+	return c.queryFlowsFunc(ctx, req, fn)
+}
+
+// DumpFilterFunc is like DumpFunc, but only calls fn for Flows matching the connmark
+// specified in the Filter parameter.
+func (c *Conn) DumpFilterFunc(f Filter, fn func(Flow) bool) error {
+	return c.DumpFilterFuncContext(context.Background(), f, fn)
+}
+
+// DumpFilterFuncContext is like DumpFilterFunc, but takes a context.Context to bound the operation.
+func (c *Conn) DumpFilterFuncContext(ctx context.Context, f Filter, fn func(Flow) bool) error {
+
+	return c.queryFilterFunc(ctx, ctGet, f, fn)
+}
+
+// queryFilterFunc sends a filtered dump request of the given message type and calls fn for each
+// Flow decoded from the response. The request is sent once for every address family returned by
+// Filter.families, until fn returns false. Criteria of the Filter not applied by the kernel are
+// matched in userspace, fn is only called for Flows matching the Filter.
+func (c *Conn) queryFilterFunc(ctx context.Context, mt messageType, f Filter, fn func(Flow) bool) error {
+
+	kf, partial, err := c.kernelFilter(ctx, f, false)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := kf.marshal()
+	if err != nil {
+		return err
+	}
+
+	stop := false
+	for _, pf := range f.families() {
+		req, err := netfilter.MarshalNetlink(
+			netfilter.Header{
+				SubsystemID: netfilter.NFSubsysCTNetlink,
+				MessageType: netfilter.MessageType(mt),
+				Family:      pf,
+				Flags:       netlink.Request | netlink.Dump,
+			},
+			attrs)
+
+		if err != nil {
+			return err
+		}
+
+		err = c.queryFlowsFunc(ctx, req, func(fl Flow) bool {
+			if partial && !f.match(fl) {
+				return true
+			}
+
+			stop = !fn(fl)
+			return !stop
+		})
+
+		if err != nil || stop {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// kernelFilter returns the part of the Filter the kernel applies to dump requests, or to
+// flush requests when flush is true. Returns true if the Flows returned by the kernel need
+// to be matched against the Filter in userspace.
+func (c *Conn) kernelFilter(ctx context.Context, f Filter, flush bool) (Filter, bool, error) {
+
+	// Reject invalid Filters before any of their criteria are dropped.
+	if _, err := f.marshal(); err != nil {
+		return f, false, err
+	}
+
+	s := filterSupport{tuples: true, status: true}
+	if f.extended() {
+		var err error
+		s, err = c.filterSupport(ctx, flush)
+		if err != nil {
+			return f, false, err
+		}
+	}
+
+	kf, partial := f.kernelFilter(s)
+
+	return kf, partial, nil
+}
+
+// filterSupport returns the Filter criteria the kernel applies to dump requests, or to flush
+// requests when flush is true. The kernel is probed for support the first time it is needed.
+// ctnetlink does not set NLM_F_DUMP_FILTERED on the replies to a filtered dump, so its replies
+// alone don't tell whether a Filter was applied.
+func (c *Conn) filterSupport(ctx context.Context, flush bool) (filterSupport, error) {
+
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+
+	fs, probe := &c.dumpSupport, c.probeDumpFilter
+	if flush {
+		fs, probe = &c.flushSupport, c.probeFlushFilter
+	}
+
+	if *fs != nil {
+		return **fs, nil
+	}
+
+	s, err := probe(ctx)
+	if err != nil {
+		return s, err
+	}
+
+	*fs = &s
+
+	return s, nil
+}
+
+// probeDumpFilter probes the kernel for the Filter criteria it applies to dump requests.
+// Kernels that support a criterion reject the invalid values sent for it.
+func (c *Conn) probeDumpFilter(ctx context.Context) (filterSupport, error) {
+
+	// Dumps have always been limited to the address family in the request header.
+	s := filterSupport{family: true}
+	var err error
+
+	// Unknown tuple filter flags.
+	s.tuples, err = c.probeFilter(ctx, ctGet, netfilter.ProtoIPv4, netlink.Dump,
+		marshalFilterFlags(1<<31, 0))
+	if err != nil {
+		return s, err
+	}
+
+	// A status filter with a zero mask.
+	s.status, err = c.probeFilter(ctx, ctGet, netfilter.ProtoUnspec, netlink.Dump,
+		netfilter.Attribute{Type: uint16(ctaStatus), Data: netfilter.Uint32Bytes(0)},
+		netfilter.Attribute{Type: uint16(ctaStatusMask), Data: netfilter.Uint32Bytes(0)})
+
+	return s, err
+}
+
+// probeFlushFilter probes the kernel for the Filter criteria it applies to flush requests.
+func (c *Conn) probeFlushFilter(ctx context.Context) (filterSupport, error) {
+
+	var s filterSupport
+
+	// A valid tuple filter is accepted by kernels applying it to flushes. Older kernels
+	// treat the request as the deletion of a single Flow and reject its partial tuple.
+	tp, err := Tuple{IP: IPTuple{SourceAddress: net.IPv4zero}}.marshalFilter(uint16(ctaTupleOrig), FilterSourceAddress)
+	if err != nil {
+		return s, err
+	}
+
+	rejected, err := c.probeFilter(ctx, ctDelete, netfilter.ProtoIPv4, netlink.Acknowledge,
+		tp, marshalFilterFlags(FilterSourceAddress, 0))
+	if err != nil {
+		return s, err
+	}
+	s.tuples = !rejected
+
+	// Flushes are limited to the address family in the request header when the header's
+	// version is set. There is no way to tell kernels doing so apart from kernels flushing
+	// all families, only rely on it for kernels that support tuple filters in flushes.
+	s.family = s.tuples
+
+	// A status filter with a zero mask is rejected by kernels supporting it.
+	s.status, err = c.probeFilter(ctx, ctDelete, netfilter.ProtoUnspec, netlink.Acknowledge,
+		netfilter.Attribute{Type: uint16(ctaStatus), Data: netfilter.Uint32Bytes(0)},
+		netfilter.Attribute{Type: uint16(ctaStatusMask), Data: netfilter.Uint32Bytes(0)})
+
+	return s, err
+}
+
+// probeFilter sends a request of the given message type with a connmark filter that never
+// matches, followed by the attributes being probed for. This way, kernels ignoring the attributes
+// don't return or delete any Flows. Returns true if the kernel rejected the request.
+func (c *Conn) probeFilter(ctx context.Context, mt messageType, pf netfilter.ProtoFamily,
+	flags netlink.HeaderFlags, probe ...netfilter.Attribute) (bool, error) {
+
+	attrs := append([]netfilter.Attribute{
+		{Type: uint16(ctaMark), Data: netfilter.Uint32Bytes(1)},
+		{Type: uint16(ctaMarkMask), Data: netfilter.Uint32Bytes(0)},
+	}, probe...)
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(mt),
+			Family:      pf,
+			Flags:       netlink.Request | flags,
+		},
+		attrs)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.query(ctx, req)
+	if _, ok := errno(err); ok {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// queryFlowsFunc sends a dump request and calls fn for each Flow decoded from the response.
+// Decoding stops at the first error, which is returned after the dump was drained.
+func (c *Conn) queryFlowsFunc(ctx context.Context, req netlink.Message, fn func(Flow) bool) error {
+
+	var uerr error
+
+	err := c.queryFunc(ctx, req, func(nlm netlink.Message) bool {
+		f, err := unmarshalFlow(nlm)
+		if err != nil {
+			uerr = err
+			return false
+		}
+
+		return fn(f)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return uerr
+}
+
+// DumpZeroCounters gets all Conntrack connections matching the given Filter from the kernel
+// in the form of a list of Flow objects, and atomically resets the CountersOrig and CountersReply
+// of each returned Flow to zero. Each Flow's counters describe the traffic seen since the previous
+// call, making this suitable for periodic accounting. Counters are only present on Flows when
+// accounting is enabled through the net.netfilter.nf_conntrack_acct sysctl.
+//
+// When the kernel does not apply all criteria of the Filter, the counters of the matching
+// Flows are reset one by one using GetZeroCounters, since the kernel would otherwise reset
+// the counters of Flows not matching the Filter.
+func (c *Conn) DumpZeroCounters(f Filter) ([]Flow, error) {
+	return c.DumpZeroCountersContext(context.Background(), f)
+}
+
+// DumpZeroCountersContext is like DumpZeroCounters, but takes a context.Context to bound the operation.
+func (c *Conn) DumpZeroCountersContext(ctx context.Context, f Filter) ([]Flow, error) {
+
+	_, partial, err := c.kernelFilter(ctx, f, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// The kernel would zero the counters of all Flows it returns, including those not
+	// matching the Filter. Look up the matching Flows and zero their counters one by one.
+	if partial {
+		return c.zeroCountersMatching(ctx, f)
+	}
+
+	var flows []Flow
+
+	err = c.queryFilterFunc(ctx, ctGetCtrZero, f, func(f Flow) bool {
+		flows = append(flows, f)
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return flows, nil
+}
+
+// zeroCountersMatching dumps the Flows matching the Filter and resets their counters
+// using individual GetZeroCounters requests.
+func (c *Conn) zeroCountersMatching(ctx context.Context, f Filter) ([]Flow, error) {
+
+	matches, err := c.DumpFilterContext(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	flows := make([]Flow, 0, len(matches))
+	for _, m := range matches {
+		qf, err := c.GetZeroCountersContext(ctx, m.lookup())
+		// The Flow may have been deleted since it was dumped.
+		if en, ok := errno(err); ok && en == unix.ENOENT {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		flows = append(flows, qf)
+	}
+
+	return flows, nil
+}
+
+// DumpDying gets all Conntrack connections from the kernel's dying list in the form
+// of a list of Flow objects. Connections end up on the dying list when they were
+// destroyed while still being referenced, eg. when their destroy event could not
+// be delivered to a listener. These entries no longer show up in regular dumps.
+func (c *Conn) DumpDying() ([]Flow, error) {
+	return c.DumpDyingContext(context.Background())
+}
+
+// DumpDyingContext is like DumpDying, but takes a context.Context to bound the operation.
+func (c *Conn) DumpDyingContext(ctx context.Context) ([]Flow, error) {
+	return c.dumpType(ctx, ctGetDying)
+}
+
+// DumpUnconfirmed gets all Conntrack connections from the kernel's unconfirmed list
+// in the form of a list of Flow objects. Unconfirmed connections have been seen
+// by Conntrack, but their first packet has not yet left the box. Newer kernels
+// no longer keep an unconfirmed list and always return an empty dump.
+func (c *Conn) DumpUnconfirmed() ([]Flow, error) {
+	return c.DumpUnconfirmedContext(context.Background())
+}
+
+// DumpUnconfirmedContext is like DumpUnconfirmed, but takes a context.Context to bound the operation.
+func (c *Conn) DumpUnconfirmedContext(ctx context.Context) ([]Flow, error) {
+	return c.dumpType(ctx, ctGetUnconfirmed)
+}
+
+// DumpExpect gets all expected Conntrack expectations from the kernel in the form
+// of a list of Expect objects.
+func (c *Conn) DumpExpect() ([]Expect, error) {
+	return c.DumpExpectContext(context.Background())
+}
+
+// DumpExpectContext is like DumpExpect, but takes a context.Context to bound the operation.
+func (c *Conn) DumpExpectContext(ctx context.Context) ([]Expect, error) {
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctGet),
+			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
+			Flags:       netlink.Request | netlink.Dump | netlink.Acknowledge,
+		},
+		nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nlm, err := c.query(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalExpects(nlm)
+}
+
+// DumpExpectFunc gets all expected Conntrack expectations from the kernel and calls fn
+// for each Expect as soon as it is decoded. Return false from fn to stop receiving Expects.
+// See DumpFunc for more details.
+func (c *Conn) DumpExpectFunc(fn func(Expect) bool) error {
+	return c.DumpExpectFuncContext(context.Background(), fn)
+}
+
+// DumpExpectFuncContext is like DumpExpectFunc, but takes a context.Context to bound the operation.
+func (c *Conn) DumpExpectFuncContext(ctx context.Context, fn func(Expect) bool) error {
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctGet),
+			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
+			Flags:       netlink.Request | netlink.Dump | netlink.Acknowledge,
+		},
+		nil)
+
+	if err != nil {
+		return err
+	}
+
+	var uerr error
+
+	err = c.queryFunc(ctx, req, func(nlm netlink.Message) bool {
+		ex, err := unmarshalExpect(nlm)
+		if err != nil {
+			uerr = err
+			return false
+		}
+
+		return fn(ex)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return uerr
+}
+
+// Flush empties the Conntrack table. Deletes all IPv4 and IPv6 entries.
+// To flush Flows of a single address family, use FlushFilter with the
+// Filter's Family field set.
+func (c *Conn) Flush() error {
+	return c.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but takes a context.Context to bound the operation.
+func (c *Conn) FlushContext(ctx context.Context) error {
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctDelete),
+			Family:      netfilter.ProtoUnspec, // Family is ignored for flush
+			Flags:       netlink.Request | netlink.Acknowledge,
+		},
+		nil)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FlushFilter deletes all entries from the Conntrack table matching a given Filter.
+// Both IPv4 and IPv6 entries are considered for deletion, unless the Filter's Family
+// field is set.
+//
+// When the kernel does not apply all criteria of the Filter to flushes, the matching
+// Flows are dumped and deleted one by one instead. This is not atomic, Flows created
+// while the flush is in progress are not considered.
+func (c *Conn) FlushFilter(f Filter) error {
+	return c.FlushFilterContext(context.Background(), f)
+}
+
+// FlushFilterContext is like FlushFilter, but takes a context.Context to bound the operation.
+func (c *Conn) FlushFilterContext(ctx context.Context, f Filter) error {
+
+	_, partial, err := c.kernelFilter(ctx, f, true)
+	if err != nil {
+		return err
+	}
+
+	if partial {
+		return c.deleteMatching(ctx, f)
+	}
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return err
+	}
+
+	for _, pf := range f.families() {
+		req, err := netfilter.MarshalNetlink(
+			netfilter.Header{
+				SubsystemID: netfilter.NFSubsysCTNetlink,
+				MessageType: netfilter.MessageType(ctDelete),
+				Family:      pf,
+				// The kernel ignores the family of a flush request with version 0.
+				Version: 1,
+				Flags:   netlink.Request | netlink.Acknowledge,
+			},
+			attrs)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = c.query(ctx, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteMatching dumps the Flows matching the Filter and deletes them one by one.
+func (c *Conn) deleteMatching(ctx context.Context, f Filter) error {
+
+	// The Conn can't be used for other queries during a dump, collect all matches first.
+	flows, err := c.DumpFilterContext(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	for _, fl := range flows {
+		err := c.DeleteContext(ctx, fl.lookup())
+		// The Flow may have expired or been deleted since it was dumped.
+		if en, ok := errno(err); ok && en == unix.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create creates a new Conntrack entry.
+//
+// When the Flow's NATSrc or NATDst are set, the kernel sets up the corresponding NAT
+// binding for the new entry. The StatusSrcNAT and StatusDstNAT flags of the Flow's
+// Status are set to match the NAT bindings before it is sent to the kernel, along
+// with StatusConfirmed when any of them is set.
+func (c *Conn) Create(f Flow) error {
+	return c.CreateContext(context.Background(), f)
+}
+
+// CreateContext is like Create, but takes a context.Context to bound the operation.
+func (c *Conn) CreateContext(ctx context.Context, f Flow) error {
+
+	req, err := createRequest(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createRequest marshals a Flow into a request creating it.
+func createRequest(f Flow) (netlink.Message, error) {
+
+	// Conntrack create requires timeout to be set.
+	if f.Timeout == 0 {
+		return netlink.Message{}, errNeedTimeout
+	}
+
+	// The NAT status bits reflect the Flow's NAT bindings.
+	f.Status.Value &^= StatusNATMask
+	if f.NATSrc.filled() {
+		f.Status.Value |= StatusSrcNAT
+	}
+	if f.NATDst.filled() {
+		f.Status.Value |= StatusDstNAT
+	}
+
+	// The kernel confirms all entries it creates, and rejects a status
+	// that would clear the confirmed bit.
+	if f.Status.Value&StatusNATMask != 0 {
+		f.Status.Value |= StatusConfirmed
+	}
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctNew),
+			Family:      f.family(),
+			Flags: netlink.Request | netlink.Acknowledge |
+				netlink.Excl | netlink.Create,
+		}, attrs)
+}
+
+// CreateExpect creates a new Conntrack Expect entry. The Expect's TupleMaster must refer to an
+// existing Flow that has a Conntrack helper attached, and HelpName must match that helper's name.
+// The helper's expectation policy applies, eg. 'ftp' only allows a single Expect per master Flow.
+func (c *Conn) CreateExpect(ex Expect) error {
+	return c.CreateExpectContext(context.Background(), ex)
+}
+
+// CreateExpectContext is like CreateExpect, but takes a context.Context to bound the operation.
+func (c *Conn) CreateExpectContext(ctx context.Context, ex Expect) error {
+
+	attrs, err := ex.marshal()
+	if err != nil {
+		return err
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpNew),
+			Family:      ex.family(),
+			Flags: netlink.Request | netlink.Acknowledge |
+				netlink.Excl | netlink.Create,
+		}, attrs)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetExpect queries the expectation table for an Expect matching the Tuple and Zone of the given Expect.
+// When the Expect's ID field is filled, it must match the ID of the Expect returned from the lookup,
+// or the query will fail.
+func (c *Conn) GetExpect(ex Expect) (Expect, error) {
+	return c.GetExpectContext(context.Background(), ex)
+}
+
+// GetExpectContext is like GetExpect, but takes a context.Context to bound the operation.
+func (c *Conn) GetExpectContext(ctx context.Context, ex Expect) (Expect, error) {
+
+	var qe Expect
+
+	attrs, err := ex.marshalLookup()
+	if err != nil {
+		return qe, err
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpGet),
+			Family:      ex.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+
+	if err != nil {
+		return qe, err
+	}
+
+	nlm, err := c.queryOne(ctx, req)
+	if err != nil {
+		return qe, err
+	}
+
+	qe, err = unmarshalExpect(nlm)
+	if err != nil {
+		return qe, err
+	}
+
+	return qe, nil
+}
+
+// DeleteExpect removes an Expect from the expectation table. Expects are looked up based on their
+// Tuple and Zone. When the Expect's ID field is filled, it must match the ID of the Expect returned
+// from the lookup, or the delete will fail.
+//
+// The kernel cannot look up an Expect by ID alone. When only the ID field is filled, the expectation
+// table is dumped to find the Expect's Tuple and Zone, after which it is deleted as described above.
+func (c *Conn) DeleteExpect(ex Expect) error {
+	return c.DeleteExpectContext(context.Background(), ex)
+}
+
+// DeleteExpectContext is like DeleteExpect, but takes a context.Context to bound the operation.
+func (c *Conn) DeleteExpectContext(ctx context.Context, ex Expect) error {
+
+	if !ex.Tuple.filled() {
+		if ex.ID == 0 {
+			return errExpectNeedID
+		}
+
+		exps, err := c.DumpExpectContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, e := range exps {
+			if e.ID == ex.ID {
+				ex.Tuple, ex.Zone = e.Tuple, e.Zone
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return errExpectNotFound
+		}
+	}
+
+	attrs, err := ex.marshalLookup()
+	if err != nil {
+		return err
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpDelete),
+			Family:      ex.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FlushExpect empties the expectation table. Deletes all IPv4 and IPv6 entries.
+func (c *Conn) FlushExpect() error {
+	return c.FlushExpectContext(context.Background())
+}
+
+// FlushExpectContext is like FlushExpect, but takes a context.Context to bound the operation.
+func (c *Conn) FlushExpectContext(ctx context.Context) error {
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpDelete),
+			Family:      netfilter.ProtoUnspec, // Family is ignored for flush
+			Flags:       netlink.Request | netlink.Acknowledge,
+		},
+		nil)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FlushExpectHelper deletes all entries from the expectation table that were created
+// by the Conntrack helper with the given name, eg. 'ftp' or 'sip'.
+func (c *Conn) FlushExpectHelper(name string) error {
+	return c.FlushExpectHelperContext(context.Background(), name)
+}
+
+// FlushExpectHelperContext is like FlushExpectHelper, but takes a context.Context to bound the operation.
+func (c *Conn) FlushExpectHelperContext(ctx context.Context, name string) error {
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpDelete),
+			Family:      netfilter.ProtoUnspec, // Family is ignored for flush
+			Flags:       netlink.Request | netlink.Acknowledge,
+		},
+		[]netfilter.Attribute{
+			{Type: uint16(ctaExpectHelpName), Data: append([]byte(name), 0)},
+		})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get queries the conntrack table for a connection matching some attributes of a given Flow.
+// The following attributes are considered in the query: TupleOrig or TupleReply, in that order,
+// and Zone. One of TupleOrig or TupleReply is required for a successful query.
+func (c *Conn) Get(f Flow) (Flow, error) {
+	return c.GetContext(context.Background(), f)
+}
+
+// GetContext is like Get, but takes a context.Context to bound the operation.
+func (c *Conn) GetContext(ctx context.Context, f Flow) (Flow, error) {
+
+	var qf Flow
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return qf, err
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctGet),
+			Family:      f.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+
+	if err != nil {
+		return qf, err
+	}
+
+	nlm, err := c.queryOne(ctx, req)
+	if err != nil {
+		return qf, err
+	}
+
+	qf, err = unmarshalFlow(nlm)
+	if err != nil {
+		return qf, err
+	}
+
+	return qf, nil
+}
+
+// GetZeroCounters queries the conntrack table for a connection matching some attributes of a given
+// Flow, like Get. The connection's CountersOrig and CountersReply are atomically reset to zero by the
+// kernel, the returned Flow holds the counter values from right before the reset.
+func (c *Conn) GetZeroCounters(f Flow) (Flow, error) {
+	return c.GetZeroCountersContext(context.Background(), f)
+}
+
+// GetZeroCountersContext is like GetZeroCounters, but takes a context.Context to bound the operation.
+func (c *Conn) GetZeroCountersContext(ctx context.Context, f Flow) (Flow, error) {
+
+	var qf Flow
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return qf, err
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctGetCtrZero),
+			Family:      f.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+
+	if err != nil {
+		return qf, err
+	}
+
+	nlm, err := c.queryOne(ctx, req)
+	if err != nil {
+		return qf, err
+	}
+
+	qf, err = unmarshalFlow(nlm)
+	if err != nil {
+		return qf, err
+	}
+
+	return qf, nil
+}
+
+// Update updates a Conntrack entry. Only the following attributes are considered
+// when sending a Flow update: Helper, Timeout, Status, ProtoInfo, Mark, SeqAdj (orig/reply),
+// SynProxy, Labels. All other attributes are immutable past the point of creation.
+// See the ctnetlink_change_conntrack() kernel function for exact behaviour.
+//
+// When LabelsMask is set, only the labels selected by the mask are set or cleared
+// according to Labels, the entry's other labels are left untouched. Otherwise, all
+// of the entry's labels are replaced by Labels. The kernel only keeps labels on
+// entries when labels are in use by the ruleset, eg. by an nftables 'ct label' rule.
+func (c *Conn) Update(f Flow) error {
+	return c.UpdateContext(context.Background(), f)
+}
+
+// UpdateContext is like Update, but takes a context.Context to bound the operation.
+func (c *Conn) UpdateContext(ctx context.Context, f Flow) error {
+
+	req, err := updateRequest(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// updateRequest marshals a Flow into a request updating it.
+func updateRequest(f Flow) (netlink.Message, error) {
+
+	// Kernel rejects updates with a master tuple set
+	if f.TupleMaster.filled() {
+		return netlink.Message{}, errUpdateMaster
+	}
+
+	// NAT bindings can only be set up on create
+	if f.NATSrc.filled() || f.NATDst.filled() {
+		return netlink.Message{}, errUpdateNAT
+	}
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctNew),
+			Family:      f.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+}
+
+// Delete removes a Conntrack entry given a Flow. Flows are looked up in the conntrack table
+// based on the original and reply tuple. When the Flow's ID field is filled, it must match the
+// ID on the connection returned from the tuple lookup, or the delete will fail.
+func (c *Conn) Delete(f Flow) error {
+	return c.DeleteContext(context.Background(), f)
+}
+
+// DeleteContext is like Delete, but takes a context.Context to bound the operation.
+func (c *Conn) DeleteContext(ctx context.Context, f Flow) error {
+
+	req, err := deleteRequest(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deleteRequest marshals a Flow into a request deleting it.
+func deleteRequest(f Flow) (netlink.Message, error) {
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctDelete),
+			Family:      f.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+}
+
+// CreateBatch creates multiple Conntrack entries, like calling Create for each Flow in flows.
+// Many requests are sent to the kernel at once, avoiding a round trip per Flow.
+//
+// Returns a slice holding the outcome of each Flow, in the same order as flows. An entry is nil
+// if the Flow was created successfully. A failure on one Flow does not prevent the others from
+// being created. The error return value is only set when communicating with the kernel failed.
+// Entries of Flows that may or may not have been processed by the kernel are then set to it.
+func (c *Conn) CreateBatch(flows []Flow) ([]error, error) {
+	return c.CreateBatchContext(context.Background(), flows)
+}
+
+// CreateBatchContext is like CreateBatch, but takes a context.Context to bound the operation.
+func (c *Conn) CreateBatchContext(ctx context.Context, flows []Flow) ([]error, error) {
+	return c.flowBatch(ctx, flows, createRequest)
+}
+
+// UpdateBatch updates multiple Conntrack entries, like calling Update for each Flow in flows.
+// See CreateBatch for details on batching and the values returned.
+func (c *Conn) UpdateBatch(flows []Flow) ([]error, error) {
+	return c.UpdateBatchContext(context.Background(), flows)
+}
+
+// UpdateBatchContext is like UpdateBatch, but takes a context.Context to bound the operation.
+func (c *Conn) UpdateBatchContext(ctx context.Context, flows []Flow) ([]error, error) {
+	return c.flowBatch(ctx, flows, updateRequest)
+}
+
+// DeleteBatch removes multiple Conntrack entries, like calling Delete for each Flow in flows.
+// See CreateBatch for details on batching and the values returned.
+func (c *Conn) DeleteBatch(flows []Flow) ([]error, error) {
+	return c.DeleteBatchContext(context.Background(), flows)
+}
+
+// DeleteBatchContext is like DeleteBatch, but takes a context.Context to bound the operation.
+func (c *Conn) DeleteBatchContext(ctx context.Context, flows []Flow) ([]error, error) {
+	return c.flowBatch(ctx, flows, deleteRequest)
+}
+
+// flowBatch marshals each Flow into a request using fn and sends them using queryBatch.
+// Flows that fail to marshal are not sent, their marshaling error is returned in their place.
+func (c *Conn) flowBatch(ctx context.Context, flows []Flow, fn func(Flow) (netlink.Message, error)) ([]error, error) {
+
+	errs := make([]error, len(flows))
+
+	reqs := make([]netlink.Message, 0, len(flows))
+	idx := make([]int, 0, len(flows))
+
+	for i, f := range flows {
+		req, err := fn(f)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		reqs = append(reqs, req)
+		idx = append(idx, i)
+	}
+
+	rerrs, err := c.queryBatch(ctx, reqs)
+	for i, rerr := range rerrs {
+		errs[idx[i]] = rerr
+	}
+
+	return errs, err
+}
+
+// Stats returns a list of Stats structures, one per CPU present in the machine.
+// Each Stats structure contains performance counters of all Conntrack actions
+// performed on that specific CPU.
+func (c *Conn) Stats() ([]Stats, error) {
+	return c.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, but takes a context.Context to bound the operation.
+func (c *Conn) StatsContext(ctx context.Context) ([]Stats, error) {
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctGet),
-			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
+			MessageType: netfilter.MessageType(ctGetStatsCPU),
+			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Dump,
-		},
-		nil)
+		}, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	nlm, err := c.conn.Query(req)
+	msgs, err := c.query(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	return unmarshalFlows(nlm)
+	return unmarshalStats(msgs)
 }
 
-// DumpFilter gets all Conntrack connections from the kernel in the form of a list
-// of Flow objects, but only returns Flows matching the connmark specified in the Filter parameter.
-func (c *Conn) DumpFilter(f Filter) ([]Flow, error) {
+// StatsExpect returns a list of StatsExpect structures, one per CPU present in the machine.
+// Each StatsExpect structure indicates how many Expect entries were initialized,
+// created or deleted on each CPU.
+func (c *Conn) StatsExpect() ([]StatsExpect, error) {
+	return c.StatsExpectContext(context.Background())
+}
+
+// StatsExpectContext is like StatsExpect, but takes a context.Context to bound the operation.
+func (c *Conn) StatsExpectContext(ctx context.Context) ([]StatsExpect, error) {
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctGet),
-			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpGetStatsCPU),
+			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Dump,
-		},
-		f.marshal())
+		}, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	nlm, err := c.conn.Query(req)
+	msgs, err := c.query(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	return unmarshalFlows(nlm)
+	return unmarshalStatsExpect(msgs)
 }
 
-// DumpExpect gets all expected Conntrack expectations from the kernel in the form
-// of a list of Expect objects.
-func (c *Conn) DumpExpect() ([]Expect, error) {
+// StatsGlobal queries Conntrack for an internal global counter that describes the total amount
+// of Flow entries currently in the Conntrack table. Only the main Conntrack table has this
+// fast query available. To get the amount of Expect entries, execute DumpExpect() and count
+// the amount of entries returned.
+//
+// Starting from kernels 4.18 and higher, MaxEntries is returned, describing the maximum size
+// of the Conntrack table.
+func (c *Conn) StatsGlobal() (StatsGlobal, error) {
+	return c.StatsGlobalContext(context.Background())
+}
+
+// StatsGlobalContext is like StatsGlobal, but takes a context.Context to bound the operation.
+func (c *Conn) StatsGlobalContext(ctx context.Context) (StatsGlobal, error) {
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
-			MessageType: netfilter.MessageType(ctGet),
-			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctGetStats),
+			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Dump | netlink.Acknowledge,
-		},
-		nil)
+		}, nil)
+
+	var sg StatsGlobal
 
 	if err != nil {
-		return nil, err
+		return sg, err
 	}
 
-	nlm, err := c.conn.Query(req)
+	nlm, err := c.queryOne(ctx, req)
 	if err != nil {
-		return nil, err
+		return sg, err
 	}
 
-	return unmarshalExpects(nlm)
+	return unmarshalStatsGlobal(nlm)
 }
 
-// Flush empties the Conntrack table. Deletes all IPv4 and IPv6 entries.
-func (c *Conn) Flush() error {
+// CreateTimeoutPolicy creates a new named TimeoutPolicy in the kernel. Fails if a policy
+// with the same name already exists.
+func (c *Conn) CreateTimeoutPolicy(tp TimeoutPolicy) error {
+	return c.CreateTimeoutPolicyContext(context.Background(), tp)
+}
+
+// CreateTimeoutPolicyContext is like CreateTimeoutPolicy, but takes a context.Context to bound the operation.
+func (c *Conn) CreateTimeoutPolicyContext(ctx context.Context, tp TimeoutPolicy) error {
+	return c.newTimeoutPolicy(ctx, tp, netlink.Create|netlink.Excl)
+}
+
+// UpdateTimeoutPolicy replaces the timeouts of the existing TimeoutPolicy with the same name.
+// The policy's Family and Protocol cannot be changed. Like in the kernel, the policy is
+// created if it does not exist yet.
+func (c *Conn) UpdateTimeoutPolicy(tp TimeoutPolicy) error {
+	return c.UpdateTimeoutPolicyContext(context.Background(), tp)
+}
+
+// UpdateTimeoutPolicyContext is like UpdateTimeoutPolicy, but takes a context.Context to bound the operation.
+func (c *Conn) UpdateTimeoutPolicyContext(ctx context.Context, tp TimeoutPolicy) error {
+	return c.newTimeoutPolicy(ctx, tp, netlink.Replace)
+}
+
+// newTimeoutPolicy sends a TimeoutPolicy to the kernel in a request with the given flags.
+func (c *Conn) newTimeoutPolicy(ctx context.Context, tp TimeoutPolicy, flags netlink.HeaderFlags) error {
+
+	if tp.Name == "" {
+		return errTimeoutNeedName
+	}
+
+	attrs, err := tp.marshal()
+	if err != nil {
+		return err
+	}
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctDelete),
-			Family:      netfilter.ProtoUnspec, // Family is ignored for flush
-			Flags:       netlink.Request | netlink.Acknowledge,
-		},
-		nil)
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(ctTimeoutNew),
+			Family:      netfilter.ProtoUnspec,
+			Flags:       netlink.Request | netlink.Acknowledge | flags,
+		}, attrs)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -206,98 +1389,112 @@ func (c *Conn) Flush() error {
 	return nil
 }
 
-// FlushFilter deletes all entries from the Conntrack table matching a given Filter.
-// Both IPv4 and IPv6 entries are considered for deletion.
-func (c *Conn) FlushFilter(f Filter) error {
+// GetTimeoutPolicy gets the TimeoutPolicy with the given name from the kernel.
+func (c *Conn) GetTimeoutPolicy(name string) (TimeoutPolicy, error) {
+	return c.GetTimeoutPolicyContext(context.Background(), name)
+}
+
+// GetTimeoutPolicyContext is like GetTimeoutPolicy, but takes a context.Context to bound the operation.
+func (c *Conn) GetTimeoutPolicyContext(ctx context.Context, name string) (TimeoutPolicy, error) {
+
+	var tp TimeoutPolicy
+
+	if name == "" {
+		return tp, errTimeoutNeedName
+	}
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctDelete),
-			Family:      netfilter.ProtoUnspec, // Family is ignored for flush
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(ctTimeoutGet),
+			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Acknowledge,
 		},
-		f.marshal())
+		[]netfilter.Attribute{marshalTimeoutName(name)})
 
 	if err != nil {
-		return err
+		return tp, err
 	}
 
-	_, err = c.conn.Query(req)
+	nlm, err := c.queryOne(ctx, req)
 	if err != nil {
-		return err
+		return tp, err
 	}
 
-	return nil
+	return unmarshalTimeoutPolicy(nlm)
 }
 
-// Create creates a new Conntrack entry.
-func (c *Conn) Create(f Flow) error {
-
-	// Conntrack create requires timeout to be set.
-	if f.Timeout == 0 {
-		return errNeedTimeout
-	}
-
-	attrs, err := f.marshal()
-	if err != nil {
-		return err
-	}
+// DumpTimeoutPolicies gets all named TimeoutPolicies from the kernel.
+func (c *Conn) DumpTimeoutPolicies() ([]TimeoutPolicy, error) {
+	return c.DumpTimeoutPoliciesContext(context.Background())
+}
 
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
-	}
+// DumpTimeoutPoliciesContext is like DumpTimeoutPolicies, but takes a context.Context to bound the operation.
+func (c *Conn) DumpTimeoutPoliciesContext(ctx context.Context) ([]TimeoutPolicy, error) {
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctNew),
-			Family:      pf,
-			Flags: netlink.Request | netlink.Acknowledge |
-				netlink.Excl | netlink.Create,
-		}, attrs)
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(ctTimeoutGet),
+			Family:      netfilter.ProtoUnspec,
+			Flags:       netlink.Request | netlink.Dump,
+		}, nil)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = c.conn.Query(req)
+	nlm, err := c.query(ctx, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return unmarshalTimeoutPolicies(nlm)
 }
 
-// CreateExpect creates a new Conntrack Expect entry. Warning: Experimental, haven't
-// got this to create an Expect correctly. Best-effort implementation based on kernel source.
-func (c *Conn) CreateExpect(ex Expect) error {
+// DeleteTimeoutPolicy deletes the TimeoutPolicy with the given name from the kernel.
+// Policies that are in use by a ruleset cannot be deleted.
+func (c *Conn) DeleteTimeoutPolicy(name string) error {
+	return c.DeleteTimeoutPolicyContext(context.Background(), name)
+}
 
-	attrs, err := ex.marshal()
-	if err != nil {
-		return err
-	}
+// DeleteTimeoutPolicyContext is like DeleteTimeoutPolicy, but takes a context.Context to bound the operation.
+func (c *Conn) DeleteTimeoutPolicyContext(ctx context.Context, name string) error {
 
-	pf := netfilter.ProtoIPv4
-	if ex.Tuple.IP.IsIPv6() && ex.Mask.IP.IsIPv6() && ex.TupleMaster.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
+	if name == "" {
+		return errTimeoutNeedName
 	}
 
+	return c.deleteTimeoutPolicies(ctx, []netfilter.Attribute{marshalTimeoutName(name)})
+}
+
+// FlushTimeoutPolicies deletes all named TimeoutPolicies that are not in use by a ruleset.
+func (c *Conn) FlushTimeoutPolicies() error {
+	return c.FlushTimeoutPoliciesContext(context.Background())
+}
+
+// FlushTimeoutPoliciesContext is like FlushTimeoutPolicies, but takes a context.Context to bound the operation.
+func (c *Conn) FlushTimeoutPoliciesContext(ctx context.Context) error {
+	return c.deleteTimeoutPolicies(ctx, nil)
+}
+
+// deleteTimeoutPolicies sends a timeout policy delete request with the given attributes.
+// Without a name, the kernel deletes all policies that are not in use.
+func (c *Conn) deleteTimeoutPolicies(ctx context.Context, attrs []netfilter.Attribute) error {
+
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
-			MessageType: netfilter.MessageType(ctExpNew),
-			Family:      pf,
-			Flags: netlink.Request | netlink.Acknowledge |
-				netlink.Excl | netlink.Create,
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(ctTimeoutDelete),
+			Family:      netfilter.ProtoUnspec,
+			Flags:       netlink.Request | netlink.Acknowledge,
 		}, attrs)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -305,77 +1502,63 @@ func (c *Conn) CreateExpect(ex Expect) error {
 	return nil
 }
 
-// Get queries the conntrack table for a connection matching some attributes of a given Flow.
-// The following attributes are considered in the query: TupleOrig or TupleReply, in that order,
-// and Zone. One of TupleOrig or TupleReply is required for a successful query.
-func (c *Conn) Get(f Flow) (Flow, error) {
-
-	var qf Flow
+// DefaultTimeouts gets the default timeouts the kernel applies to connections of the given
+// Layer 3 and Layer 4 protocol, in the form of an unnamed TimeoutPolicy.
+func (c *Conn) DefaultTimeouts(family netfilter.ProtoFamily, protocol uint8) (TimeoutPolicy, error) {
+	return c.DefaultTimeoutsContext(context.Background(), family, protocol)
+}
 
-	attrs, err := f.marshal()
-	if err != nil {
-		return qf, err
-	}
+// DefaultTimeoutsContext is like DefaultTimeouts, but takes a context.Context to bound the operation.
+func (c *Conn) DefaultTimeoutsContext(ctx context.Context, family netfilter.ProtoFamily, protocol uint8) (TimeoutPolicy, error) {
 
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
-	}
+	var tp TimeoutPolicy
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctGet),
-			Family:      pf,
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(ctTimeoutDefaultGet),
+			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Acknowledge,
-		}, attrs)
+		},
+		[]netfilter.Attribute{
+			{Type: uint16(ctaTimeoutL3Proto), Data: netfilter.Uint16Bytes(uint16(family))},
+			{Type: uint16(ctaTimeoutL4Proto), Data: []byte{protocol}},
+		})
 
 	if err != nil {
-		return qf, err
+		return tp, err
 	}
 
-	nlm, err := c.conn.Query(req)
+	nlm, err := c.queryOne(ctx, req)
 	if err != nil {
-		return qf, err
+		return tp, err
 	}
 
-	// Since this is not a dump (and ACK flag is set), the kernel sends a message containing
-	// the flow, followed by a Netlink (non-)error message. The error is already parsed by
-	// the netlink library, so we only read the first message containing the Flow.
-	qf, err = unmarshalFlow(nlm[0])
-	if err != nil {
-		return qf, err
-	}
+	return unmarshalTimeoutPolicy(nlm)
+}
 
-	return qf, nil
+// SetDefaultTimeouts sets the default timeouts the kernel applies to connections of the
+// TimeoutPolicy's Protocol in the Conn's network namespace. The policy's Name is ignored,
+// and timeouts that are zero are left unchanged.
+func (c *Conn) SetDefaultTimeouts(tp TimeoutPolicy) error {
+	return c.SetDefaultTimeoutsContext(context.Background(), tp)
 }
 
-// Update updates a Conntrack entry. Only the following attributes are considered
-// when sending a Flow update: Helper, Timeout, Status, ProtoInfo, Mark, SeqAdj (orig/reply),
-// SynProxy, Labels. All other attributes are immutable past the point of creation.
-// See the ctnetlink_change_conntrack() kernel function for exact behaviour.
-func (c *Conn) Update(f Flow) error {
+// SetDefaultTimeoutsContext is like SetDefaultTimeouts, but takes a context.Context to bound the operation.
+func (c *Conn) SetDefaultTimeoutsContext(ctx context.Context, tp TimeoutPolicy) error {
 
-	// Kernel rejects updates with a master tuple set
-	if f.TupleMaster.filled() {
-		return errUpdateMaster
-	}
+	tp.Name = ""
 
-	attrs, err := f.marshal()
+	attrs, err := tp.marshal()
 	if err != nil {
 		return err
 	}
 
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
-	}
-
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctNew),
-			Family:      pf,
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(ctTimeoutDefaultSet),
+			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Acknowledge,
 		}, attrs)
 
@@ -383,7 +1566,7 @@ func (c *Conn) Update(f Flow) error {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -391,35 +1574,59 @@ func (c *Conn) Update(f Flow) error {
 	return nil
 }
 
-// Delete removes a Conntrack entry given a Flow. Flows are looked up in the conntrack table
-// based on the original and reply tuple. When the Flow's ID field is filled, it must match the
-// ID on the connection returned from the tuple lookup, or the delete will fail.
-func (c *Conn) Delete(f Flow) error {
+// CreateUserspaceHelper registers a new UserspaceHelper with the kernel. Fails with EBUSY
+// if a helper with the same Name, Family and Protocol already exists.
+// Userspace helpers are not bound to a network namespace.
+func (c *Conn) CreateUserspaceHelper(h UserspaceHelper) error {
+	return c.CreateUserspaceHelperContext(context.Background(), h)
+}
 
-	attrs, err := f.marshal()
+// CreateUserspaceHelperContext is like CreateUserspaceHelper, but takes a context.Context to bound the operation.
+func (c *Conn) CreateUserspaceHelperContext(ctx context.Context, h UserspaceHelper) error {
+	return c.newUserspaceHelper(ctx, h, true)
+}
+
+// UpdateUserspaceHelper updates the QueueNum, Policies and status of the existing UserspaceHelper
+// with the same Name, Family and Protocol. The amount of Policies cannot be changed, and the
+// PrivDataLen is ignored. Like in the kernel, the helper is created if it does not exist yet.
+func (c *Conn) UpdateUserspaceHelper(h UserspaceHelper) error {
+	return c.UpdateUserspaceHelperContext(context.Background(), h)
+}
+
+// UpdateUserspaceHelperContext is like UpdateUserspaceHelper, but takes a context.Context to bound the operation.
+func (c *Conn) UpdateUserspaceHelperContext(ctx context.Context, h UserspaceHelper) error {
+	return c.newUserspaceHelper(ctx, h, false)
+}
+
+// newUserspaceHelper sends a UserspaceHelper to the kernel. When create is true,
+// the request fails if the helper already exists.
+func (c *Conn) newUserspaceHelper(ctx context.Context, h UserspaceHelper, create bool) error {
+
+	attrs, err := h.marshal(create)
 	if err != nil {
 		return err
 	}
 
-	// Default to IPv4, set netlink protocol family to IPv6 if orig/reply is IPv6.
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
+	flags := netlink.Request | netlink.Acknowledge
+	if create {
+		flags |= netlink.Create | netlink.Excl
+	} else {
+		flags |= netlink.Replace
 	}
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctDelete),
-			Family:      pf,
-			Flags:       netlink.Request | netlink.Acknowledge,
+			SubsystemID: netfilter.NFSubsysCTHelper,
+			MessageType: netfilter.MessageType(ctHelperNew),
+			Family:      netfilter.ProtoUnspec,
+			Flags:       flags,
 		}, attrs)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -427,40 +1634,54 @@ func (c *Conn) Delete(f Flow) error {
 	return nil
 }
 
-// Stats returns a list of Stats structures, one per CPU present in the machine.
-// Each Stats structure contains performance counters of all Conntrack actions
-// performed on that specific CPU.
-func (c *Conn) Stats() ([]Stats, error) {
+// GetUserspaceHelper gets the UserspaceHelper with the Name of the given helper from the kernel.
+// When the Family or Protocol of the given helper are set, they must match as well.
+func (c *Conn) GetUserspaceHelper(h UserspaceHelper) (UserspaceHelper, error) {
+	return c.GetUserspaceHelperContext(context.Background(), h)
+}
+
+// GetUserspaceHelperContext is like GetUserspaceHelper, but takes a context.Context to bound the operation.
+func (c *Conn) GetUserspaceHelperContext(ctx context.Context, h UserspaceHelper) (UserspaceHelper, error) {
+
+	var qh UserspaceHelper
+
+	attrs, err := h.marshalLookup()
+	if err != nil {
+		return qh, err
+	}
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctGetStatsCPU),
+			SubsystemID: netfilter.NFSubsysCTHelper,
+			MessageType: netfilter.MessageType(ctHelperGet),
 			Family:      netfilter.ProtoUnspec,
-			Flags:       netlink.Request | netlink.Dump,
-		}, nil)
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
 
 	if err != nil {
-		return nil, err
+		return qh, err
 	}
 
-	msgs, err := c.conn.Query(req)
+	nlm, err := c.queryOne(ctx, req)
 	if err != nil {
-		return nil, err
+		return qh, err
 	}
 
-	return unmarshalStats(msgs)
+	return unmarshalUserspaceHelper(nlm)
 }
 
-// StatsExpect returns a list of StatsExpect structures, one per CPU present in the machine.
-// Each StatsExpect structure indicates how many Expect entries were initialized,
-// created or deleted on each CPU.
-func (c *Conn) StatsExpect() ([]StatsExpect, error) {
+// DumpUserspaceHelpers gets all UserspaceHelpers registered with the kernel.
+func (c *Conn) DumpUserspaceHelpers() ([]UserspaceHelper, error) {
+	return c.DumpUserspaceHelpersContext(context.Background())
+}
+
+// DumpUserspaceHelpersContext is like DumpUserspaceHelpers, but takes a context.Context to bound the operation.
+func (c *Conn) DumpUserspaceHelpersContext(ctx context.Context) ([]UserspaceHelper, error) {
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
-			MessageType: netfilter.MessageType(ctExpGetStatsCPU),
+			SubsystemID: netfilter.NFSubsysCTHelper,
+			MessageType: netfilter.MessageType(ctHelperGet),
 			Family:      netfilter.ProtoUnspec,
 			Flags:       netlink.Request | netlink.Dump,
 		}, nil)
@@ -469,41 +1690,45 @@ func (c *Conn) StatsExpect() ([]StatsExpect, error) {
 		return nil, err
 	}
 
-	msgs, err := c.conn.Query(req)
+	nlm, err := c.query(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	return unmarshalStatsExpect(msgs)
+	return unmarshalUserspaceHelpers(nlm)
 }
 
-// StatsGlobal queries Conntrack for an internal global counter that describes the total amount
-// of Flow entries currently in the Conntrack table. Only the main Conntrack table has this
-// fast query available. To get the amount of Expect entries, execute DumpExpect() and count
-// the amount of entries returned.
-//
-// Starting from kernels 4.18 and higher, MaxEntries is returned, describing the maximum size
-// of the Conntrack table.
-func (c *Conn) StatsGlobal() (StatsGlobal, error) {
+// DeleteUserspaceHelper unregisters the UserspaceHelpers with the Name of the given helper.
+// When the Family or Protocol of the given helper are set, they must match as well.
+// Helpers that are attached to Flows cannot be deleted.
+func (c *Conn) DeleteUserspaceHelper(h UserspaceHelper) error {
+	return c.DeleteUserspaceHelperContext(context.Background(), h)
+}
+
+// DeleteUserspaceHelperContext is like DeleteUserspaceHelper, but takes a context.Context to bound the operation.
+func (c *Conn) DeleteUserspaceHelperContext(ctx context.Context, h UserspaceHelper) error {
+
+	attrs, err := h.marshalLookup()
+	if err != nil {
+		return err
+	}
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctGetStats),
+			SubsystemID: netfilter.NFSubsysCTHelper,
+			MessageType: netfilter.MessageType(ctHelperDel),
 			Family:      netfilter.ProtoUnspec,
-			Flags:       netlink.Request | netlink.Dump | netlink.Acknowledge,
-		}, nil)
-
-	var sg StatsGlobal
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
 
 	if err != nil {
-		return sg, err
+		return err
 	}
 
-	msgs, err := c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
-		return sg, err
+		return err
 	}
 
-	return unmarshalStatsGlobal(msgs[0])
+	return nil
 }
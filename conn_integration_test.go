@@ -7,13 +7,17 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/ti-mo/netfilter"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 var ksyms []string
@@ -74,12 +78,12 @@ func checkKmod() error {
 // Returns the Conn, the netns identifier and error.
 func makeNSConn() (*Conn, int, error) {
 
-	newns, err := netns.New()
+	newns, err := newNetNS()
 	if err != nil {
 		return nil, 0, fmt.Errorf("unexpected error creating network namespace: %s", err)
 	}
 
-	newConn, err := Dial(&netlink.Config{NetNS: int(newns)})
+	newConn, err := DialNetNSFD(int(newns))
 	if err != nil {
 		return nil, 0, fmt.Errorf("unexpected error dialing namespaced connection: %s", err)
 	}
@@ -87,6 +91,28 @@ func makeNSConn() (*Conn, int, error) {
 	return newConn, int(newns), nil
 }
 
+// newNetNS creates a network namespace and returns a handle to it. The namespace is
+// entered by a thread that is never unlocked, so it is terminated when its goroutine exits
+// instead of running other goroutines in the new namespace.
+func newNetNS() (netns.NsHandle, error) {
+
+	type result struct {
+		ns  netns.NsHandle
+		err error
+	}
+
+	rc := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+
+		ns, err := netns.New()
+		rc <- result{ns, err}
+	}()
+
+	r := <-rc
+	return r.ns, r.err
+}
+
 // getKsyms gets a list of all symbols in the kernel. (/proc/kallsyms)
 func getKsyms() ([]string, error) {
 
@@ -122,3 +148,186 @@ func findKsym(sym string) bool {
 
 	return false
 }
+
+// inNetNS runs fn on a thread in the network namespace nsfd, so sockets opened by fn are
+// created in that namespace. The thread is never unlocked, so it is terminated when
+// its goroutine exits instead of running other goroutines in the namespace.
+func inNetNS(nsfd int, fn func() error) error {
+
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+
+		if err := netns.Set(netns.NsHandle(nsfd)); err != nil {
+			errc <- err
+			return
+		}
+
+		errc <- fn()
+	}()
+
+	return <-errc
+}
+
+// trackTraffic makes Conntrack track the IPv4 traffic of the network namespace nsfd with
+// accounting enabled, and brings up its loopback interface. Conntrack only hooks into the
+// traffic of a namespace once a user needs it, which is done by adding an nftables rule
+// that loads the ct state.
+func trackTraffic(nsfd int) error {
+
+	err := inNetNS(nsfd, func() error {
+		return ioutil.WriteFile("/proc/sys/net/netfilter/nf_conntrack_acct", []byte("1"), 0644)
+	})
+	if err != nil {
+		return err
+	}
+
+	rc, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{NetNS: nsfd})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// struct ifinfomsg setting IFF_UP on the loopback interface, always index 1.
+	ifi := make([]byte, unix.SizeofIfInfomsg)
+	nlenc.PutInt32(ifi[4:8], 1)
+	nlenc.PutUint32(ifi[8:12], unix.IFF_UP)
+	nlenc.PutUint32(ifi[12:16], unix.IFF_UP)
+
+	_, err = rc.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_NEWLINK, Flags: netlink.Request | netlink.Acknowledge},
+		Data:   ifi,
+	})
+	if err != nil {
+		return err
+	}
+
+	return addNFTRule(nsfd, "track", nftExpr("ct",
+		nftU32(nftaCTDreg, nftReg1),
+		nftU32(nftaCTKey, nftCTState),
+	))
+}
+
+// Values from uapi/linux/netfilter/nf_tables.h.
+const (
+	nftMsgNewTable = 0
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+
+	nftaTableName = 1
+
+	nftaChainTable = 1
+	nftaChainName  = 3
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+
+	nftaListElem = 1
+
+	nftaExprName = 1
+	nftaExprData = 2
+
+	nftaDataValue = 1
+
+	nftaImmediateDreg = 1
+	nftaImmediateData = 2
+
+	nftaCTDreg = 1
+	nftaCTKey  = 2
+	nftaCTSreg = 4
+
+	nftCTState  = 0
+	nftCTLabels = 13
+
+	nftReg1 = 1
+)
+
+// nftExpr returns an nftables expression of the given type, to be used in a rule.
+func nftExpr(name string, data ...netfilter.Attribute) netfilter.Attribute {
+	return netfilter.Attribute{Type: nftaListElem, Nested: true, Children: []netfilter.Attribute{
+		{Type: nftaExprName, Data: append([]byte(name), 0)},
+		{Type: nftaExprData, Nested: true, Children: data},
+	}}
+}
+
+// nftU32 returns an nftables attribute holding a big-endian uint32.
+func nftU32(t uint16, v uint32) netfilter.Attribute {
+	return netfilter.Attribute{Type: t, Data: netfilter.Uint32Bytes(v)}
+}
+
+// addNFTRule adds a rule with the given expressions to a chain of the IPv4 table 'conntrack'
+// in the network namespace nsfd, creating the table and the chain if needed. The chain is
+// not attached to a hook, loading the rule is enough for the kernel to enable the Conntrack
+// features the expressions use.
+func addNFTRule(nsfd int, chain string, exprs ...netfilter.Attribute) error {
+
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: nsfd})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	str := func(t uint16, s string) netfilter.Attribute {
+		return netfilter.Attribute{Type: t, Data: append([]byte(s), 0)}
+	}
+
+	var msgs []netlink.Message
+	for _, m := range []struct {
+		mt    netfilter.MessageType
+		attrs []netfilter.Attribute
+	}{
+		{nftMsgNewTable, []netfilter.Attribute{str(nftaTableName, "conntrack")}},
+		{nftMsgNewChain, []netfilter.Attribute{str(nftaChainTable, "conntrack"), str(nftaChainName, chain)}},
+		{nftMsgNewRule, []netfilter.Attribute{
+			str(nftaRuleTable, "conntrack"),
+			str(nftaRuleChain, chain),
+			{Type: nftaRuleExpressions, Nested: true, Children: exprs},
+		}},
+	} {
+		msg, err := netfilter.MarshalNetlink(netfilter.Header{
+			SubsystemID: netfilter.NFSubsysNFTables,
+			MessageType: m.mt,
+			Family:      netfilter.ProtoIPv4,
+			Flags:       netlink.Request | netlink.Create | netlink.Acknowledge,
+		}, m.attrs)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// nftables messages need to be sent in a batch, addressed to the
+	// nftables subsystem by the batch messages' resource ID.
+	batch := func(mt netfilter.MessageType) (netlink.Message, error) {
+		return netfilter.MarshalNetlink(netfilter.Header{
+			MessageType: mt,
+			ResourceID:  uint16(netfilter.NFSubsysNFTables),
+			Flags:       netlink.Request,
+		}, nil)
+	}
+
+	begin, err := batch(unix.NFNL_MSG_BATCH_BEGIN)
+	if err != nil {
+		return err
+	}
+	end, err := batch(unix.NFNL_MSG_BATCH_END)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.SendMessages(append([]netlink.Message{begin}, append(msgs, end)...)); err != nil {
+		return err
+	}
+
+	// Wait for the acknowledgements of the table, chain and rule.
+	for acks := 0; acks < len(msgs); {
+		replies, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		acks += len(replies)
+	}
+
+	return nil
+}
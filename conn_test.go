@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
@@ -90,6 +91,27 @@ func ExampleConn_dumpFilter() {
 	log.Print(df)
 }
 
+func ExampleConn_dumpFunc() {
+	// Open a Conntrack connection.
+	c, err := conntrack.Dial(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Stream all records in the Conntrack table without holding them in memory,
+	// counting the amount of Flows per layer 4 protocol.
+	protos := make(map[uint8]int)
+	err = c.DumpFunc(func(f conntrack.Flow) bool {
+		protos[f.TupleOrig.Proto.Protocol]++
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(protos)
+}
+
 func ExampleConn_flush() {
 	// Open a Conntrack connection.
 	c, err := conntrack.Dial(nil)
@@ -201,3 +223,42 @@ func ExampleConn_listen() {
 	// Stop the program as soon as an error is caught in a decoder goroutine.
 	log.Print(<-errCh)
 }
+
+func ExampleConn_startListener() {
+	// Open a Conntrack connection.
+	c, err := conntrack.Dial(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Listen for new and destroyed Flows with 4 decoder goroutines.
+	evCh := make(chan conntrack.Event, 1024)
+	l, err := c.StartListener(evCh, 4, []netfilter.NetlinkGroup{netfilter.GroupCTNew, netfilter.GroupCTDestroy}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Stop listening after a minute. This closes evCh.
+	time.AfterFunc(time.Minute, func() {
+		if err := l.Stop(); err != nil {
+			log.Print(err)
+		}
+	})
+
+	// Print all events until the Listener is stopped or fails.
+	for ev := range evCh {
+		fmt.Println(ev)
+	}
+
+	if err := l.Wait(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The Conn can be used for queries again.
+	flows, err := c.Dump()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(len(flows))
+}
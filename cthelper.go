@@ -0,0 +1,300 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+	"github.com/ti-mo/netfilter"
+)
+
+const (
+	opUnUserspaceHelper = "UserspaceHelper unmarshal"
+
+	// maxExpectClasses is the maximum amount of expectation policies of a helper (NF_CT_MAX_EXPECT_CLASSES).
+	maxExpectClasses = 4
+)
+
+// UserspaceHelper is a Conntrack helper implemented in userspace, registered with the kernel's
+// cthelper subsystem. Once a UserspaceHelper is attached to a Flow, eg. by an nftables 'ct helper'
+// object or the iptables CT target, the Flow's packets are sent to the NFQUEUE queue QueueNum.
+// The userspace program reading the queue can then create Expects for related connections using
+// NewExpect and Conn.CreateExpect.
+//
+// A helper is identified by its Name, Family and Protocol. Its Policies restrict the amount of
+// Expects that can exist for a single master Flow, per class. A helper needs at least one and
+// at most four Policies, the index of a policy is its class.
+type UserspaceHelper struct {
+	Name     string
+	Family   netfilter.ProtoFamily
+	Protocol uint8
+
+	QueueNum uint32
+	Policies []ExpectPolicy
+
+	// PrivDataLen is the amount of bytes reserved in each Flow for the helper's private data.
+	// It cannot be changed once the helper is created.
+	PrivDataLen uint32
+
+	// Enabled helpers have their Flows' packets queued to userspace.
+	// Packets of Flows with a disabled helper are accepted.
+	Enabled bool
+}
+
+// ExpectPolicy is the expectation policy of a class of Expects created by a UserspaceHelper.
+// MaxExpected is the maximum amount of Expects of the class for a single master Flow, and
+// Timeout is the timeout of new Expects in seconds.
+type ExpectPolicy struct {
+	Name        string
+	MaxExpected uint32
+	Timeout     uint32
+}
+
+// NewExpect builds an Expect for a connection related to the master Flow, using the helper's
+// expectation policy of the given class. The master Flow must have the helper attached.
+//
+// The tuple describes the expected connection in the direction of the master's original tuple.
+// Its addresses and ports that are left empty are wildcards, matching any address or port.
+// When the tuple's Protocol is not set, the master's protocol is used.
+func (h UserspaceHelper) NewExpect(master Flow, class uint32, tuple Tuple) (Expect, error) {
+
+	if int(class) >= len(h.Policies) {
+		return Expect{}, fmt.Errorf(errHelperClass, class, h.Name)
+	}
+
+	if !master.TupleOrig.filled() {
+		return Expect{}, errExpectNeedTuples
+	}
+
+	ex := Expect{
+		TupleMaster: master.TupleOrig,
+		Tuple:       tuple,
+		Timeout:     h.Policies[class].Timeout,
+		Zone:        master.Zone,
+		HelpName:    h.Name,
+		Class:       class,
+	}
+
+	if ex.Tuple.Proto.Protocol == 0 {
+		ex.Tuple.Proto.Protocol = master.TupleOrig.Proto.Protocol
+	}
+	ex.Mask.Proto.Protocol = ex.Tuple.Proto.Protocol
+
+	ipv6 := master.TupleOrig.IP.IsIPv6()
+	ex.Tuple.IP.SourceAddress, ex.Mask.IP.SourceAddress = expectAddress(tuple.IP.SourceAddress, ipv6)
+	ex.Tuple.IP.DestinationAddress, ex.Mask.IP.DestinationAddress = expectAddress(tuple.IP.DestinationAddress, ipv6)
+
+	if tuple.Proto.SourcePort != 0 {
+		ex.Mask.Proto.SourcePort = 0xffff
+	}
+	if tuple.Proto.DestinationPort != 0 {
+		ex.Mask.Proto.DestinationPort = 0xffff
+	}
+
+	return ex, nil
+}
+
+// expectAddress returns the address of an expected connection along with its mask.
+// Empty addresses are replaced by a wildcard address of the given family.
+func expectAddress(ip net.IP, ipv6 bool) (net.IP, net.IP) {
+
+	if len(ip) == 0 || ip.IsUnspecified() {
+		if ipv6 {
+			return net.IPv6unspecified, net.IPv6unspecified
+		}
+		return net.IPv4zero, net.IPv4zero
+	}
+
+	if ipv6 {
+		return ip, net.IP(net.CIDRMask(128, 128))
+	}
+
+	return ip, net.IPv4bcast
+}
+
+// marshal marshals a UserspaceHelper into a list of netfilter.Attributes.
+// The PrivDataLen is only sent when creating a helper.
+func (h UserspaceHelper) marshal(create bool) ([]netfilter.Attribute, error) {
+
+	if h.Name == "" {
+		return nil, errHelperNeedName
+	}
+
+	if len(h.Policies) == 0 || len(h.Policies) > maxExpectClasses {
+		return nil, errHelperPolicies
+	}
+
+	policy := netfilter.Attribute{Type: uint16(nfcthPolicy), Nested: true, Children: make([]netfilter.Attribute, 1, len(h.Policies)+1)}
+	policy.Children[0] = netfilter.Attribute{Type: uint16(nfcthPolicySetNum), Data: netfilter.Uint32Bytes(uint32(len(h.Policies)))}
+
+	for i, p := range h.Policies {
+		policy.Children = append(policy.Children, netfilter.Attribute{
+			Type:   uint16(nfcthPolicySet) + uint16(i),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{Type: uint16(nfcthPolicyName), Data: append([]byte(p.Name), 0)},
+				{Type: uint16(nfcthPolicyExpectMax), Data: netfilter.Uint32Bytes(p.MaxExpected)},
+				{Type: uint16(nfcthPolicyExpectTimeout), Data: netfilter.Uint32Bytes(p.Timeout)},
+			},
+		})
+	}
+
+	status := uint32(nfctHelperStatusDisabled)
+	if h.Enabled {
+		status = nfctHelperStatusEnabled
+	}
+
+	attrs := []netfilter.Attribute{
+		{Type: uint16(nfcthName), Data: append([]byte(h.Name), 0)},
+		h.marshalTuple(),
+		{Type: uint16(nfcthQueueNum), Data: netfilter.Uint32Bytes(h.QueueNum)},
+		policy,
+		{Type: uint16(nfcthStatus), Data: netfilter.Uint32Bytes(status)},
+	}
+
+	// The kernel refuses to change the size of the private data of an existing helper.
+	if create {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(nfcthPrivDataLen), Data: netfilter.Uint32Bytes(h.PrivDataLen)})
+	}
+
+	return attrs, nil
+}
+
+// marshalLookup marshals the attributes identifying a UserspaceHelper into a list of netfilter.Attributes.
+// These are the Name, and the Family and Protocol if either of them is non-zero.
+func (h UserspaceHelper) marshalLookup() ([]netfilter.Attribute, error) {
+
+	if h.Name == "" {
+		return nil, errHelperNeedName
+	}
+
+	attrs := []netfilter.Attribute{{Type: uint16(nfcthName), Data: append([]byte(h.Name), 0)}}
+
+	if h.Family != netfilter.ProtoUnspec || h.Protocol != 0 {
+		attrs = append(attrs, h.marshalTuple())
+	}
+
+	return attrs, nil
+}
+
+// marshalTuple marshals the Family and Protocol of a UserspaceHelper into an NFCTH_TUPLE attribute.
+func (h UserspaceHelper) marshalTuple() netfilter.Attribute {
+	return netfilter.Attribute{
+		Type:   uint16(nfcthTuple),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(nfcthTupleL3ProtoNum), Data: netfilter.Uint16Bytes(uint16(h.Family))},
+			{Type: uint16(nfcthTupleL4ProtoNum), Data: []byte{h.Protocol}},
+		},
+	}
+}
+
+// unmarshal unmarshals a list of netfilter.Attributes into a UserspaceHelper.
+func (h *UserspaceHelper) unmarshal(attrs []netfilter.Attribute) error {
+
+	for _, attr := range attrs {
+		switch userHelperType(attr.Type) {
+		case nfcthName:
+			h.Name = strings.TrimSuffix(string(attr.Data), "\x00")
+		case nfcthTuple:
+			if !attr.Nested {
+				return errors.Wrap(errNotNested, opUnUserspaceHelper)
+			}
+			for _, iattr := range attr.Children {
+				switch userHelperTupleType(iattr.Type) {
+				case nfcthTupleL3ProtoNum:
+					h.Family = netfilter.ProtoFamily(iattr.Uint16())
+				case nfcthTupleL4ProtoNum:
+					if len(iattr.Data) != 1 {
+						return errors.Wrap(errIncorrectSize, opUnUserspaceHelper)
+					}
+					h.Protocol = iattr.Data[0]
+				}
+			}
+		case nfcthQueueNum:
+			h.QueueNum = attr.Uint32()
+		case nfcthPolicy:
+			if err := h.unmarshalPolicies(attr); err != nil {
+				return err
+			}
+		case nfcthPrivDataLen:
+			h.PrivDataLen = attr.Uint32()
+		case nfcthStatus:
+			h.Enabled = attr.Uint32() == nfctHelperStatusEnabled
+		}
+	}
+
+	return nil
+}
+
+// unmarshalPolicies unmarshals an NFCTH_POLICY attribute into the Policies of a UserspaceHelper.
+func (h *UserspaceHelper) unmarshalPolicies(attr netfilter.Attribute) error {
+
+	if !attr.Nested {
+		return errors.Wrap(errNotNested, opUnUserspaceHelper)
+	}
+
+	for _, iattr := range attr.Children {
+
+		if userHelperPolicySetType(iattr.Type) < nfcthPolicySet {
+			continue
+		}
+
+		if !iattr.Nested {
+			return errors.Wrap(errNotNested, opUnUserspaceHelper)
+		}
+
+		var p ExpectPolicy
+		for _, pattr := range iattr.Children {
+			switch userHelperPolicyType(pattr.Type) {
+			case nfcthPolicyName:
+				p.Name = strings.TrimSuffix(string(pattr.Data), "\x00")
+			case nfcthPolicyExpectMax:
+				p.MaxExpected = pattr.Uint32()
+			case nfcthPolicyExpectTimeout:
+				p.Timeout = pattr.Uint32()
+			}
+		}
+
+		h.Policies = append(h.Policies, p)
+	}
+
+	return nil
+}
+
+// unmarshalUserspaceHelper unmarshals a UserspaceHelper from a Netlink message.
+func unmarshalUserspaceHelper(nlm netlink.Message) (UserspaceHelper, error) {
+
+	var h UserspaceHelper
+
+	_, nfa, err := netfilter.UnmarshalNetlink(nlm)
+	if err != nil {
+		return h, err
+	}
+
+	err = h.unmarshal(nfa)
+	if err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
+
+// unmarshalUserspaceHelpers unmarshals a list of UserspaceHelpers from a list of Netlink messages.
+func unmarshalUserspaceHelpers(nlm []netlink.Message) ([]UserspaceHelper, error) {
+
+	out := make([]UserspaceHelper, 0, len(nlm))
+
+	for _, m := range nlm {
+		h, err := unmarshalUserspaceHelper(m)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, h)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,87 @@
+//+build integration
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// Register a userspace helper, attach it to a Flow and create an Expect on its behalf.
+func TestConnUserspaceHelper(t *testing.T) {
+
+	if !findKsym("nfnl_cthelper_new") {
+		t.Skip("nfnetlink_cthelper not supported on this kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Userspace helpers are global, use a name that is unlikely to be taken.
+	h := UserspaceHelper{
+		Name:     "ct-go-test",
+		Family:   netfilter.ProtoIPv4,
+		Protocol: unix.IPPROTO_TCP,
+		QueueNum: 1,
+		Policies: []ExpectPolicy{{Name: "data", MaxExpected: 1, Timeout: 60}},
+		Enabled:  true,
+	}
+
+	require.NoError(t, c.CreateUserspaceHelper(h))
+	defer func() {
+		assert.NoError(t, c.DeleteUserspaceHelper(h))
+	}()
+
+	err = c.CreateUserspaceHelper(h)
+	en, ok := errno(err)
+	require.True(t, ok)
+	assert.Equal(t, unix.EBUSY, en)
+
+	qh, err := c.GetUserspaceHelper(UserspaceHelper{Name: h.Name})
+	require.NoError(t, err)
+	assert.Equal(t, h, qh)
+
+	h.QueueNum = 2
+	h.Policies[0].Timeout = 30
+	require.NoError(t, c.UpdateUserspaceHelper(h))
+
+	hs, err := c.DumpUserspaceHelpers()
+	require.NoError(t, err)
+
+	var found bool
+	for _, dh := range hs {
+		if dh.Name == h.Name {
+			found = true
+			assert.Equal(t, h, dh)
+		}
+	}
+	assert.True(t, found, "helper not found in dump")
+
+	f := NewFlow(6, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 7000, 120, 0)
+	f.Helper = Helper{Name: h.Name}
+	require.NoError(t, c.Create(f))
+
+	ex, err := h.NewExpect(f, 0, Tuple{
+		IP:    IPTuple{DestinationAddress: f.TupleOrig.IP.DestinationAddress},
+		Proto: ProtoTuple{DestinationPort: 7001},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.CreateExpect(ex))
+
+	qe, err := c.GetExpect(ex)
+	require.NoError(t, err)
+	assert.Equal(t, h.Name, qe.HelpName)
+
+	// The helper cannot be deleted while attached to a Flow.
+	err = c.DeleteUserspaceHelper(h)
+	en, ok = errno(err)
+	require.True(t, ok)
+	assert.Equal(t, unix.EBUSY, en)
+
+	require.NoError(t, c.Delete(f))
+}
@@ -0,0 +1,148 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+var userHelper = UserspaceHelper{
+	Name:     "ctl",
+	Family:   netfilter.ProtoIPv4,
+	Protocol: unix.IPPROTO_TCP,
+	QueueNum: 5,
+	Policies: []ExpectPolicy{
+		{Name: "data", MaxExpected: 2, Timeout: 30},
+		{Name: "callback", MaxExpected: 1, Timeout: 10},
+	},
+	PrivDataLen: 16,
+	Enabled:     true,
+}
+
+func TestUserspaceHelperMarshal(t *testing.T) {
+
+	attrs, err := userHelper.marshal(true)
+	require.NoError(t, err)
+
+	want := []netfilter.Attribute{
+		{Type: uint16(nfcthName), Data: []byte("ctl\x00")},
+		{Type: uint16(nfcthTuple), Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(nfcthTupleL3ProtoNum), Data: []byte{0, 2}},
+			{Type: uint16(nfcthTupleL4ProtoNum), Data: []byte{6}},
+		}},
+		{Type: uint16(nfcthQueueNum), Data: []byte{0, 0, 0, 5}},
+		{Type: uint16(nfcthPolicy), Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(nfcthPolicySetNum), Data: []byte{0, 0, 0, 2}},
+			{Type: 2, Nested: true, Children: []netfilter.Attribute{
+				{Type: uint16(nfcthPolicyName), Data: []byte("data\x00")},
+				{Type: uint16(nfcthPolicyExpectMax), Data: []byte{0, 0, 0, 2}},
+				{Type: uint16(nfcthPolicyExpectTimeout), Data: []byte{0, 0, 0, 30}},
+			}},
+			{Type: 3, Nested: true, Children: []netfilter.Attribute{
+				{Type: uint16(nfcthPolicyName), Data: []byte("callback\x00")},
+				{Type: uint16(nfcthPolicyExpectMax), Data: []byte{0, 0, 0, 1}},
+				{Type: uint16(nfcthPolicyExpectTimeout), Data: []byte{0, 0, 0, 10}},
+			}},
+		}},
+		{Type: uint16(nfcthStatus), Data: []byte{0, 0, 0, 1}},
+		{Type: uint16(nfcthPrivDataLen), Data: []byte{0, 0, 0, 16}},
+	}
+
+	if diff := cmp.Diff(want, attrs); diff != "" {
+		t.Fatalf("unexpected UserspaceHelper attributes (-want +got):\n%s", diff)
+	}
+
+	// Updates don't send the private data length.
+	attrs, err = userHelper.marshal(false)
+	require.NoError(t, err)
+	assert.Equal(t, want[:len(want)-1], attrs)
+
+	// Round trip through unmarshal.
+	var h UserspaceHelper
+	require.NoError(t, h.unmarshal(want))
+	assert.Equal(t, userHelper, h)
+
+	h = userHelper
+	h.Name = ""
+	_, err = h.marshal(true)
+	assert.EqualError(t, err, errHelperNeedName.Error())
+	_, err = h.marshalLookup()
+	assert.EqualError(t, err, errHelperNeedName.Error())
+
+	h = userHelper
+	h.Policies = nil
+	_, err = h.marshal(true)
+	assert.EqualError(t, err, errHelperPolicies.Error())
+
+	h.Policies = make([]ExpectPolicy, maxExpectClasses+1)
+	_, err = h.marshal(true)
+	assert.EqualError(t, err, errHelperPolicies.Error())
+
+	// Lookups only send the tuple when it is set.
+	attrs, err = UserspaceHelper{Name: "ctl"}.marshalLookup()
+	require.NoError(t, err)
+	assert.Equal(t, want[:1], attrs)
+
+	attrs, err = userHelper.marshalLookup()
+	require.NoError(t, err)
+	assert.Equal(t, want[:2], attrs)
+
+	// Policy attributes must be nested.
+	err = h.unmarshal([]netfilter.Attribute{{Type: uint16(nfcthPolicy)}})
+	assert.Error(t, err)
+}
+
+func TestUserspaceHelperNewExpect(t *testing.T) {
+
+	master := NewFlow(6, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 7000, 120, 0)
+	master.Zone = 3
+
+	ex, err := userHelper.NewExpect(master, 1, Tuple{
+		IP:    IPTuple{DestinationAddress: net.ParseIP("10.0.0.2")},
+		Proto: ProtoTuple{DestinationPort: 7001},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, master.TupleOrig, ex.TupleMaster)
+	assert.Equal(t, uint32(10), ex.Timeout)
+	assert.Equal(t, uint32(1), ex.Class)
+	assert.Equal(t, uint16(3), ex.Zone)
+	assert.Equal(t, "ctl", ex.HelpName)
+
+	assert.True(t, net.IPv4zero.Equal(ex.Tuple.IP.SourceAddress))
+	assert.True(t, net.IPv4zero.Equal(ex.Mask.IP.SourceAddress))
+	assert.True(t, net.ParseIP("10.0.0.2").Equal(ex.Tuple.IP.DestinationAddress))
+	assert.True(t, net.IPv4bcast.Equal(ex.Mask.IP.DestinationAddress))
+	assert.Equal(t, ProtoTuple{Protocol: 6, DestinationPort: 7001}, ex.Tuple.Proto)
+	assert.Equal(t, ProtoTuple{Protocol: 6, DestinationPort: 0xffff}, ex.Mask.Proto)
+
+	_, err = ex.marshal()
+	require.NoError(t, err)
+
+	// IPv6 master with a fully specified expected connection.
+	master = NewFlow(17, 0, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 40000, 7000, 120, 0)
+
+	ex, err = userHelper.NewExpect(master, 0, Tuple{
+		IP:    IPTuple{SourceAddress: net.ParseIP("2001:db8::1"), DestinationAddress: net.ParseIP("2001:db8::2")},
+		Proto: ProtoTuple{SourcePort: 1000, DestinationPort: 2000},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(30), ex.Timeout)
+	assert.Equal(t, net.IP(net.CIDRMask(128, 128)), ex.Mask.IP.SourceAddress)
+	assert.Equal(t, ProtoTuple{Protocol: 17, SourcePort: 0xffff, DestinationPort: 0xffff}, ex.Mask.Proto)
+
+	_, err = ex.marshal()
+	require.NoError(t, err)
+
+	_, err = userHelper.NewExpect(master, 2, Tuple{})
+	assert.EqualError(t, err, "expectation class 2 not defined by helper 'ctl'")
+
+	_, err = userHelper.NewExpect(Flow{}, 0, Tuple{})
+	assert.EqualError(t, err, errExpectNeedTuples.Error())
+}
@@ -50,14 +50,14 @@ const (
 	ctaStatus                             // CTA_STATUS
 	ctaProtoInfo                          // CTA_PROTOINFO
 	ctaHelp                               // CTA_HELP
-	ctaNatSrc                             // CTA_NAT_SRC, Deprecated
+	ctaNatSrc                             // CTA_NAT_SRC, only accepted on create
 	ctaTimeout                            // CTA_TIMEOUT
 	ctaMark                               // CTA_MARK
 	ctaCountersOrig                       // CTA_COUNTERS_ORIG
 	ctaCountersReply                      // CTA_COUNTERS_REPLY
 	ctaUse                                // CTA_USE
 	ctaID                                 // CTA_ID
-	ctaNatDst                             // CTA_NAT_DST, Deprecated
+	ctaNatDst                             // CTA_NAT_DST, only accepted on create
 	ctaTupleMaster                        // CTA_TUPLE_MASTER
 	ctaSeqAdjOrig                         // CTA_SEQ_ADJ_ORIG
 	ctaSeqAdjReply                        // CTA_SEQ_ADJ_REPLY
@@ -69,6 +69,18 @@ const (
 	ctaLabels                             // CTA_LABELS
 	ctaLabelsMask                         // CTA_LABELS_MASK
 	ctaSynProxy                           // CTA_SYNPROXY
+	ctaFilter                             // CTA_FILTER
+	ctaStatusMask                         // CTA_STATUS_MASK
+)
+
+// filterType describes the type of a nested attribute in a CTA_FILTER container.
+type filterType uint8
+
+// enum ctattr_filter
+const (
+	ctaFilterUnspec     filterType = iota // CTA_FILTER_UNSPEC
+	ctaFilterOrigFlags                    // CTA_FILTER_ORIG_FLAGS
+	ctaFilterReplyFlags                   // CTA_FILTER_REPLY_FLAGS
 )
 
 // tupleType describes the type of tuple contained in this container.
@@ -198,6 +210,29 @@ const (
 	ctaProtoInfoSCTPVtagReply                             // CTA_PROTOINFO_SCTP_VTAG_REPLY
 )
 
+// natType describes the type of NAT attribute in this container.
+type natType uint8
+
+// enum ctattr_nat
+const (
+	ctaNatUnspec  natType = iota // CTA_NAT_UNSPEC
+	ctaNatV4MinIP                // CTA_NAT_V4_MINIP
+	ctaNatV4MaxIP                // CTA_NAT_V4_MAXIP
+	ctaNatProto                  // CTA_NAT_PROTO
+	ctaNatV6MinIP                // CTA_NAT_V6_MINIP
+	ctaNatV6MaxIP                // CTA_NAT_V6_MAXIP
+)
+
+// protoNatType describes the type of protocol NAT attribute in this container.
+type protoNatType uint8
+
+// enum ctattr_protonat
+const (
+	ctaProtoNatUnspec  protoNatType = iota // CTA_PROTONAT_UNSPEC
+	ctaProtoNatPortMin                     // CTA_PROTONAT_PORT_MIN
+	ctaProtoNatPortMax                     // CTA_PROTONAT_PORT_MAX
+)
+
 // seqAdjType describes the type of sequence adjustment in this container.
 type seqAdjType uint8
 
@@ -292,3 +327,98 @@ const (
 )
 
 // enum ctattr_natseq is unused in the kernel source
+
+// The enums below are translated from include/uapi/linux/netfilter/nfnetlink_cttimeout.h.
+// The per-protocol CTA_TIMEOUT_*_* attributes are implemented by the value order of the
+// Timeout* types in timeout.go.
+
+// timeoutMessageType is a cttimeout-specific representation of a netfilter.MessageType.
+// It is used to manage the kernel's timeout policies.
+type timeoutMessageType netfilter.MessageType
+
+// enum ctnl_timeout_msg_types
+const (
+	ctTimeoutNew        timeoutMessageType = iota // IPCTNL_MSG_TIMEOUT_NEW
+	ctTimeoutGet                                  // IPCTNL_MSG_TIMEOUT_GET
+	ctTimeoutDelete                               // IPCTNL_MSG_TIMEOUT_DELETE
+	ctTimeoutDefaultSet                           // IPCTNL_MSG_TIMEOUT_DEFAULT_SET
+	ctTimeoutDefaultGet                           // IPCTNL_MSG_TIMEOUT_DEFAULT_GET
+)
+
+// timeoutType describes the type of timeout policy attribute.
+type timeoutType uint8
+
+// enum ctattr_timeout
+const (
+	ctaTimeoutUnspec  timeoutType = iota // CTA_TIMEOUT_UNSPEC
+	ctaTimeoutName                       // CTA_TIMEOUT_NAME
+	ctaTimeoutL3Proto                    // CTA_TIMEOUT_L3PROTO
+	ctaTimeoutL4Proto                    // CTA_TIMEOUT_L4PROTO
+	ctaTimeoutData                       // CTA_TIMEOUT_DATA
+	ctaTimeoutUse                        // CTA_TIMEOUT_USE
+	ctaTimeoutPad                        // CTA_TIMEOUT_PAD
+)
+
+// The enums below are translated from include/uapi/linux/netfilter/nfnetlink_cthelper.h.
+
+// helperMessageType is a cthelper-specific representation of a netfilter.MessageType.
+// It is used to manage Conntrack helpers implemented in userspace.
+type helperMessageType netfilter.MessageType
+
+// enum nfnl_cthelper_msg_types
+const (
+	ctHelperNew helperMessageType = iota // NFNL_MSG_CTHELPER_NEW
+	ctHelperGet                          // NFNL_MSG_CTHELPER_GET
+	ctHelperDel                          // NFNL_MSG_CTHELPER_DEL
+)
+
+// userHelperType describes the type of userspace helper attribute.
+type userHelperType uint8
+
+// enum nfnl_cthelper_type
+const (
+	nfcthUnspec      userHelperType = iota // NFCTH_UNSPEC
+	nfcthName                              // NFCTH_NAME
+	nfcthTuple                             // NFCTH_TUPLE
+	nfcthQueueNum                          // NFCTH_QUEUE_NUM
+	nfcthPolicy                            // NFCTH_POLICY
+	nfcthPrivDataLen                       // NFCTH_PRIV_DATA_LEN
+	nfcthStatus                            // NFCTH_STATUS
+)
+
+// userHelperPolicySetType describes the type of attribute in an NFCTH_POLICY container.
+type userHelperPolicySetType uint8
+
+// enum nfnl_cthelper_policy_type
+const (
+	nfcthPolicySetUnspec userHelperPolicySetType = iota // NFCTH_POLICY_SET_UNSPEC
+	nfcthPolicySetNum                                   // NFCTH_POLICY_SET_NUM
+	nfcthPolicySet                                      // NFCTH_POLICY_SET, NFCTH_POLICY_SET1 through 4
+)
+
+// userHelperPolicyType describes the type of attribute in an NFCTH_POLICY_SET container.
+type userHelperPolicyType uint8
+
+// enum nfnl_cthelper_pol_type
+const (
+	nfcthPolicyUnspec        userHelperPolicyType = iota // NFCTH_POLICY_UNSPEC
+	nfcthPolicyName                                      // NFCTH_POLICY_NAME
+	nfcthPolicyExpectMax                                 // NFCTH_POLICY_EXPECT_MAX
+	nfcthPolicyExpectTimeout                             // NFCTH_POLICY_EXPECT_TIMEOUT
+)
+
+// userHelperTupleType describes the type of attribute in an NFCTH_TUPLE container.
+type userHelperTupleType uint8
+
+// enum nfnl_cthelper_tuple_type
+const (
+	nfcthTupleUnspec     userHelperTupleType = iota // NFCTH_TUPLE_UNSPEC
+	nfcthTupleL3ProtoNum                            // NFCTH_TUPLE_L3PROTONUM
+	nfcthTupleL4ProtoNum                            // NFCTH_TUPLE_L4PROTONUM
+)
+
+// Userspace helpers are enabled or disabled by the NFCTH_STATUS attribute.
+const (
+	nfctHelperStatusDisabled = 0 // NFCT_HELPER_STATUS_DISABLED
+	nfctHelperStatusEnabled  = 1 // NFCT_HELPER_STATUS_ENABLED
+)
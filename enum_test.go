@@ -9,24 +9,27 @@ import (
 // These consts cannot be removed as they would break the iota sequence.
 func TestUnusedEnums(t *testing.T) {
 	_ = fmt.Sprint(
-		ctGetCtrZero,     // TODO(timo): Could be added as feature
-		ctGetDying,       // Narrow time window for query
-		ctGetUnconfirmed, // Narrow time window for query
-		ctExpGet,         // Haven't figured out how to create expects, so there's nothing to Get()
-		ctaNatSrc,        // Deprecated
-		ctaNatDst,        // Deprecated
-		ctaSecMark,       // Deprecated
+		ctaSecMark, // Deprecated
 
 		// All the below is unused
 		ctaTupleUnspec,
+		ctaFilterUnspec,
 		ctaProtoUnspec,
 		ctaIPUnspec,
 		ctaTimestampPad,
 		ctaProtoInfoDCCPPad,
 		ctaExpectUnspec,
 		ctaExpectNATUnspec,
+		ctaNatUnspec,
+		ctaProtoNatUnspec,
 		ctaStatsUnspec,
 		ctaStatsGlobalUnspec,
 		ctaStatsExpUnspec,
+		ctaTimeoutUnspec,
+		ctaTimeoutPad,
+		nfcthUnspec,
+		nfcthPolicySetUnspec,
+		nfcthPolicyUnspec,
+		nfcthTupleUnspec,
 	)
 }
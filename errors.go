@@ -6,6 +6,12 @@ var (
 	errNotConntrack     = errors.New("trying to decode a non-conntrack or conntrack-exp message")
 	errConnHasListeners = errors.New("Conn has existing listeners, open another to listen on more groups")
 	errMultipartEvent   = errors.New("received multicast event with more than one Netlink message")
+	errTruncatedEvent   = errors.New("received multicast event larger than the receive buffer")
+
+	errConnIsMulticast   = errors.New("Conn is attached to one or more multicast groups and can no longer be used for bidirectional traffic")
+	errNoMulticastGroups = errors.New("need one or more multicast groups to join")
+	errShortErrorMessage = errors.New("not enough data for netlink error code")
+	errNoReply           = errors.New("no reply message before the netlink acknowledgement")
 
 	errNested          = errors.New("unexpected Nested attribute")
 	errNotNested       = errors.New("need a Nested attribute to decode this structure")
@@ -22,15 +28,59 @@ var (
 	errNeedTuples  = errors.New("Flow needs Original and Reply Tuple set for this operation")
 
 	errUpdateMaster = errors.New("cannot send TupleMaster in Flow update")
+	errUpdateNAT    = errors.New("cannot send NATSrc or NATDst in Flow update")
+	errBadNAT       = errors.New("NAT addresses must be valid and belong to the address family of the Flow")
+
+	errLabelsTooLong = errors.New("Labels and LabelsMask can hold at most 128 bits")
+
+	errFilterNeedProtocol = errors.New("Filter needs FilterProtocol set to filter on ports or ICMP fields")
+	errFilterFamily       = errors.New("Filter Family must be IPv4, IPv6 or unspecified, and match the family of its addresses")
 
 	errExpectNeedTuples = errors.New("Expect needs Tuple, Mask and TupleMaster Tuples set for this operation")
+	errExpectNeedTuple  = errors.New("Expect needs Tuple set for this operation")
+	errExpectNeedID     = errors.New("Expect needs Tuple or ID set for this operation")
+	errExpectNotFound   = errors.New("no Expect found with the given ID")
+
+	errTimeoutNeedName = errors.New("TimeoutPolicy needs Name set for this operation")
+	errTimeoutProtocol = errors.New("TimeoutPolicy can only hold the timeouts of its Protocol")
+
+	errHelperNeedName = errors.New("UserspaceHelper needs Name set for this operation")
+	errHelperPolicies = errors.New("UserspaceHelper needs between 1 and 4 Policies")
+
+	errNSIDReply = errors.New("no NSID in reply to RTM_GETNSID")
+
+	errMultiListenerClosed = errors.New("MultiListener is closed")
+
+	errResyncWorkers = errors.New("Resync and ResyncDump need a Listener with a single worker")
+
+	errExportMessageSize = errors.New("MaxMessageSize must hold the templates and a record, and be at most 65535 bytes")
 )
 
 const (
+	opQuery          = "netfilter query"
+	opResyncDump     = "dump after event overrun"
+	opResyncDiscard  = "discard events after event overrun"
+	opGrowReadBuffer = "grow receive buffer"
+	opExportIPFIX    = "send IPFIX message"
+	opExportNetFlow  = "send NetFlow v9 packet"
+
 	errUnknownEventType   = "unknown event type %d"
 	errWorkerCount        = "invalid worker count %d"
 	errWorkerReceive      = "netlink.Receive error in listenWorker %d, exiting"
 	errAttributeWrongType = "attribute type '%d' is not a %s"
 	errAttributeChild     = "child Type '%d' unknown for attribute type %s"
 	errExactChildren      = "need exactly %d child attributes for attribute type %s"
+	errUnknownLabel       = "unknown connection label '%s'"
+	errHelperClass        = "expectation class %d not defined by helper '%s'"
+	errNSIDNotFound       = "no network namespace found with NSID %d"
+	errNetNSFD            = "invalid network namespace file descriptor %d"
+	errNetNSName          = "invalid network namespace name '%s'"
+	errNetNSExists        = "network namespace '%s' already exists"
+	errNetNSNotFound      = "no network namespace named '%s'"
+	errNetNSListener      = "network namespace '%s'"
+	errUnknownProtocol    = "unknown protocol '%s'"
+	errUnknownTCPState    = "unknown TCP state '%s'"
+	errUnknownStatusFlag  = "unknown status flag '%s'"
+	errUnknownEventName   = "unknown event type '%s'"
+	errJSONVersion        = "unsupported JSON schema version %d, need %d"
 )
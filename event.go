@@ -13,13 +13,29 @@ type Event struct {
 
 	Flow   *Flow
 	Expect *Expect
+
+	// NSID is the ID of the network namespace the event was sent in, as assigned by the
+	// namespace of the listening Conn. Events from other namespaces are only received
+	// when the Conn has the netlink.ListenAllNSID option enabled, and only from namespaces
+	// that have an ID. It is NSIDLocal for events sent in the namespace of the Conn.
+	// Use an NSIDResolver to find the network namespace of an ID.
+	NSID int32
 }
 
+// NSIDLocal is the NSID of Events sent in the network namespace of the listening Conn
+// (NETNSA_NSID_NOT_ASSIGNED).
+const NSIDLocal int32 = -1
+
 // eventType is a custom type that describes the Conntrack event type.
 type eventType uint8
 
 // List of all types of Conntrack events. This is an internal representation
 // unrelated to any message types in the kernel source.
+//
+// The EventResync types are not sent by the kernel, but by a Listener that lost events
+// because its socket's receive buffer overflowed, see ListenerConfig. EventResync holds
+// no Flow. When a dump is configured, it is followed by an EventResyncFlow for every Flow
+// in the table, and an EventResyncDone when the dump is complete.
 const (
 	EventUnknown eventType = iota
 	EventNew
@@ -27,6 +43,9 @@ const (
 	EventDestroy
 	EventExpNew
 	EventExpDestroy
+	EventResync
+	EventResyncFlow
+	EventResyncDone
 )
 
 // unmarshal unmarshals a Conntrack EventType from a Netfilter header.
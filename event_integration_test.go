@@ -3,8 +3,10 @@
 package conntrack
 
 import (
+	"context"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -25,9 +27,7 @@ func TestConnListen(t *testing.T) {
 	lc, err := Dial(&netlink.Config{NetNS: nsid})
 	require.NoError(t, err)
 
-	// This needs to be an unbuffered channel with a single producer worker. Multicast connections
-	// currently cannot be terminated gracefully when stuck in Receive(), so we have to inject an event
-	// ourselves, while making sure the worker exits before re-entering Receive().
+	// This needs to be an unbuffered channel with a single producer worker.
 	ev := make(chan Event)
 	errChan, err := lc.Listen(ev, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew, netfilter.GroupCTUpdate})
 	require.NoError(t, err)
@@ -38,7 +38,7 @@ func TestConnListen(t *testing.T) {
 		if ok {
 			opErr, ok := errors.Cause(err).(*netlink.OpError)
 			require.True(t, ok)
-			require.EqualError(t, opErr.Err, "recvmsg: bad file descriptor")
+			require.EqualError(t, opErr.Err, "recvmsg: use of closed file")
 		}
 	}()
 
@@ -89,13 +89,7 @@ func TestConnListen(t *testing.T) {
 		assert.Equal(t, f.Timeout, re.Flow.Timeout, "timeout")
 	}
 
-	// Generate an event to unblock the listen worker goroutine
-	go func() {
-		f.Timeout = 1
-		sc.Update(f)
-	}()
-
-	// Close the sockets
+	// Closing the socket unblocks the listen worker goroutine
 	assert.NoError(t, lc.Close())
 	assert.NoError(t, sc.Close())
 }
@@ -119,3 +113,281 @@ func TestConnListenError(t *testing.T) {
 	_, err = c.Listen(make(chan Event), 1, netfilter.GroupsCT)
 	require.EqualError(t, err, "Conn has existing listeners, open another to listen on more groups")
 }
+
+// Stops a blocked listen worker by cancelling its context.
+func TestConnListenContext(t *testing.T) {
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ev := make(chan Event)
+	errChan, err := lc.ListenContext(ctx, ev, 4, []netfilter.NetlinkGroup{netfilter.GroupCTNew})
+	require.NoError(t, err)
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	require.NoError(t, sc.Create(f))
+
+	re := <-ev
+	assert.Equal(t, f.TupleOrig.Proto.DestinationPort, re.Flow.TupleOrig.Proto.DestinationPort)
+
+	// Leave the workers blocked in Receive and on a full evChan.
+	f.TupleOrig.Proto.SourcePort, f.TupleReply.Proto.DestinationPort = 1235, 1235
+	require.NoError(t, sc.Create(f))
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+
+	select {
+	case err, ok := <-errChan:
+		require.False(t, ok, "unexpected error from worker: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for workers to exit")
+	}
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, sc.Close())
+}
+
+// Stops a Listener with workers blocked on a full evChan, then queries and listens again.
+func TestConnListenerStop(t *testing.T) {
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	groups := []netfilter.NetlinkGroup{netfilter.GroupCTNew}
+
+	ev := make(chan Event)
+	l, err := lc.StartListener(ev, 4, groups, nil)
+	require.NoError(t, err)
+
+	_, err = lc.Listen(make(chan Event), 1, groups)
+	require.EqualError(t, err, errConnHasListeners.Error())
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	require.NoError(t, sc.Create(f))
+
+	re := <-ev
+	assert.Equal(t, f.TupleOrig.Proto.DestinationPort, re.Flow.TupleOrig.Proto.DestinationPort)
+
+	// Leave a worker blocked on evChan and more events in the socket buffer.
+	for port := uint16(81); port < 90; port++ {
+		f.TupleOrig.Proto.DestinationPort, f.TupleReply.Proto.SourcePort = port, port
+		require.NoError(t, sc.Create(f))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, l.Stop())
+	require.NoError(t, l.Stop(), "second Stop")
+	require.NoError(t, l.Wait())
+
+	_, ok := <-ev
+	assert.False(t, ok, "evChan not closed")
+
+	// The Conn left its groups and can be used for queries.
+	flows, err := lc.Dump()
+	require.NoError(t, err)
+	assert.Len(t, flows, 10)
+
+	// Listen again, events that were buffered when stopping were discarded.
+	ev = make(chan Event, 16)
+	l, err = lc.StartListener(ev, 1, groups, nil)
+	require.NoError(t, err)
+
+	f.TupleOrig.Proto.DestinationPort, f.TupleReply.Proto.SourcePort = 100, 100
+	require.NoError(t, sc.Create(f))
+
+	re = <-ev
+	assert.Equal(t, uint16(100), re.Flow.TupleOrig.Proto.DestinationPort)
+
+	require.NoError(t, l.Stop())
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, sc.Close())
+}
+
+// Closes evChan and reports the error when all workers fail.
+func TestConnListenerWait(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	ev := make(chan Event)
+	l, err := c.StartListener(ev, 2, netfilter.GroupsCT, nil)
+	require.NoError(t, err)
+
+	// Closing the socket makes all workers fail.
+	require.NoError(t, c.Close())
+
+	_, ok := <-ev
+	assert.False(t, ok, "evChan not closed")
+
+	assert.Error(t, l.Wait())
+	assert.Error(t, l.Stop(), "leaving groups of a closed Conn")
+}
+
+// Overflows the socket buffer of a Listener, which resyncs by dumping the table.
+func TestConnListenerResync(t *testing.T) {
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	// Use the smallest receive buffer the kernel allows.
+	require.NoError(t, lc.conn.SetReadBuffer(0))
+
+	// Other workers would keep receiving events during the resync.
+	ev := make(chan Event)
+	_, err = lc.StartListener(ev, 2, []netfilter.NetlinkGroup{netfilter.GroupCTNew}, &ListenerConfig{ResyncDump: sc})
+	require.EqualError(t, err, errResyncWorkers.Error())
+	_, err = lc.StartListener(ev, 2, []netfilter.NetlinkGroup{netfilter.GroupCTNew}, &ListenerConfig{Resync: true})
+	require.EqualError(t, err, errResyncWorkers.Error())
+
+	l, err := lc.StartListener(ev, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew}, &ListenerConfig{ResyncDump: sc})
+	require.NoError(t, err)
+
+	// Don't read events while creating Flows, so the kernel drops events.
+	numFlows := 200
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, uint16(i), 120, 0)
+		require.NoError(t, sc.Create(f))
+	}
+
+	var resync, flows int
+	timeout := time.After(5 * time.Second)
+
+loop:
+	for {
+		select {
+		case re := <-ev:
+			switch re.Type {
+			case EventResync:
+				assert.Nil(t, re.Flow)
+				resync++
+			case EventResyncFlow:
+				require.Equal(t, 1, resync, "EventResyncFlow before EventResync")
+				flows++
+			case EventResyncDone:
+				break loop
+			default:
+				assert.Zero(t, resync, "live event during resync")
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for resync")
+		}
+	}
+
+	assert.Equal(t, numFlows, flows)
+	assert.Equal(t, uint64(1), l.Overruns())
+
+	require.NoError(t, l.Stop())
+	require.NoError(t, l.Wait())
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, sc.Close())
+}
+
+// Deletes Flows while a reliable Listener isn't reading, the kernel retries the destroy events.
+func TestConnListenerReliable(t *testing.T) {
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	// Start with a tiny buffer, so the kernel fails to deliver most events.
+	ev := make(chan Event)
+	l, err := lc.StartListener(ev, 1, []netfilter.NetlinkGroup{netfilter.GroupCTDestroy},
+		&ListenerConfig{Reliable: true, ReadBuffer: 4096, MaxReadBuffer: 1 << 20})
+	require.NoError(t, err)
+
+	used, size, err := l.BufferFill()
+	require.NoError(t, err)
+	assert.Zero(t, used)
+	assert.Equal(t, 8192, size)
+
+	numFlows := 500
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, uint16(i), 120, 0)
+		require.NoError(t, sc.Create(f))
+	}
+
+	require.NoError(t, sc.Flush())
+
+	used, _, err = l.BufferFill()
+	require.NoError(t, err)
+	assert.NotZero(t, used)
+
+	dd, err := sc.DumpDying()
+	require.NoError(t, err)
+	require.NotEmpty(t, dd, "expecting undelivered destroy events on the dying list")
+
+	ports := make(map[uint16]bool)
+	timeout := time.After(30 * time.Second)
+
+	for len(ports) < numFlows {
+		select {
+		case re := <-ev:
+			require.Equal(t, EventDestroy, re.Type)
+			ports[re.Flow.TupleOrig.Proto.DestinationPort] = true
+		case <-timeout:
+			t.Fatalf("timeout waiting for destroy events, received %d", len(ports))
+		}
+	}
+
+	assert.Zero(t, l.Overruns())
+
+	require.NoError(t, l.Stop())
+	require.NoError(t, l.Wait())
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, sc.Close())
+}
+
+// Overflows the socket buffer of a Listener, which grows its buffer.
+func TestConnListenerGrowReadBuffer(t *testing.T) {
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	ev := make(chan Event)
+	l, err := lc.StartListener(ev, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew},
+		&ListenerConfig{Resync: true, ReadBuffer: 4096, MaxReadBuffer: 8192})
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, uint16(i), 120, 0)
+		require.NoError(t, sc.Create(f))
+	}
+
+	// Read events until the worker handled the overrun.
+	for re := range ev {
+		if re.Type == EventResync {
+			break
+		}
+	}
+
+	// The buffer doubled, up to MaxReadBuffer.
+	_, size, err := l.BufferFill()
+	require.NoError(t, err)
+	assert.Equal(t, 2*8192, size)
+
+	require.NoError(t, l.Stop())
+	require.NoError(t, l.Wait())
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, sc.Close())
+}
@@ -4,10 +4,12 @@ import (
 	"testing"
 
 	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
 )
 
 var eventTypeTests = []struct {
@@ -99,6 +101,7 @@ func TestEventTypeUnmarshal(t *testing.T) {
 
 func TestEventTypeString(t *testing.T) {
 	assert.Equal(t, "eventType(255)", eventType(255).String())
+	assert.Equal(t, "EventResyncDone", EventResyncDone.String())
 }
 
 var eventTests = []struct {
@@ -178,3 +181,25 @@ func TestEventUnmarshalError(t *testing.T) {
 		}}), "Tuple unmarshal: need a Nested attribute to decode this structure")
 
 }
+
+func TestParseNSID(t *testing.T) {
+
+	nsid, err := parseNSID(nil)
+	require.NoError(t, err)
+	assert.Equal(t, NSIDLocal, nsid)
+
+	// A control message of another type, carrying a single int32.
+	oob := unix.UnixRights(42)
+	nsid, err = parseNSID(oob)
+	require.NoError(t, err)
+	assert.Equal(t, NSIDLocal, nsid)
+
+	// Overwrite the level and type following the cmsghdr's length.
+	off := unix.SizeofCmsghdr - 8
+	copy(oob[off:], nlenc.Int32Bytes(unix.SOL_NETLINK))
+	copy(oob[off+4:], nlenc.Int32Bytes(unix.NETLINK_LISTEN_ALL_NSID))
+
+	nsid, err = parseNSID(oob)
+	require.NoError(t, err)
+	assert.Equal(t, int32(42), nsid)
+}
@@ -14,11 +14,14 @@ func _() {
 	_ = x[EventDestroy-3]
 	_ = x[EventExpNew-4]
 	_ = x[EventExpDestroy-5]
+	_ = x[EventResync-6]
+	_ = x[EventResyncFlow-7]
+	_ = x[EventResyncDone-8]
 }
 
-const _eventType_name = "EventUnknownEventNewEventUpdateEventDestroyEventExpNewEventExpDestroy"
+const _eventType_name = "EventUnknownEventNewEventUpdateEventDestroyEventExpNewEventExpDestroyEventResyncEventResyncFlowEventResyncDone"
 
-var _eventType_index = [...]uint8{0, 12, 20, 31, 43, 54, 69}
+var _eventType_index = [...]uint8{0, 12, 20, 31, 43, 54, 69, 80, 95, 110}
 
 func (i eventType) String() string {
 	if i >= eventType(len(_eventType_index)-1) {
@@ -2,6 +2,7 @@ package conntrack
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/mdlayher/netlink"
 	"github.com/pkg/errors"
@@ -109,7 +110,7 @@ func (ex *Expect) unmarshal(attrs []netfilter.Attribute) error {
 		case ctaExpectID:
 			ex.ID = attr.Uint32()
 		case ctaExpectHelpName:
-			ex.HelpName = string(attr.Data)
+			ex.HelpName = strings.TrimSuffix(string(attr.Data), "\x00")
 		case ctaExpectZone:
 			ex.Zone = attr.Uint16()
 		case ctaExpectFlags:
@@ -128,6 +129,16 @@ func (ex *Expect) unmarshal(attrs []netfilter.Attribute) error {
 	return nil
 }
 
+// family returns the address family of the Expect's tuple.
+func (ex Expect) family() netfilter.ProtoFamily {
+
+	if ex.Tuple.IP.IsIPv6() {
+		return netfilter.ProtoIPv6
+	}
+
+	return netfilter.ProtoIPv4
+}
+
 func (ex Expect) marshal() ([]netfilter.Attribute, error) {
 
 	// Expectations need Tuple, Mask and TupleMaster filled to be valid.
@@ -158,7 +169,7 @@ func (ex Expect) marshal() ([]netfilter.Attribute, error) {
 	attrs[3] = netfilter.Attribute{Type: uint16(ctaExpectTimeout), Data: netfilter.Uint32Bytes(ex.Timeout)}
 
 	if ex.HelpName != "" {
-		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectHelpName), Data: []byte(ex.HelpName)})
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectHelpName), Data: append([]byte(ex.HelpName), 0)})
 	}
 
 	if ex.Zone != 0 {
@@ -188,6 +199,33 @@ func (ex Expect) marshal() ([]netfilter.Attribute, error) {
 	return attrs, nil
 }
 
+// marshalLookup marshals the attributes of an Expect that identify it in the kernel's expectation
+// table into a list of netfilter.Attributes. These are the Tuple, Zone and ID, if non-zero.
+func (ex Expect) marshalLookup() ([]netfilter.Attribute, error) {
+
+	if !ex.Tuple.filled() {
+		return nil, errExpectNeedTuple
+	}
+
+	attrs := make([]netfilter.Attribute, 1, 3)
+
+	tp, err := ex.Tuple.marshal(uint16(ctaExpectTuple))
+	if err != nil {
+		return nil, err
+	}
+	attrs[0] = tp
+
+	if ex.Zone != 0 {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectZone), Data: netfilter.Uint16Bytes(ex.Zone)})
+	}
+
+	if ex.ID != 0 {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectID), Data: netfilter.Uint32Bytes(ex.ID)})
+	}
+
+	return attrs, nil
+}
+
 // unmarshalExpect unmarshals an Expect from a netlink.Message.
 // The Message must contain valid attributes.
 func unmarshalExpect(nlm netlink.Message) (Expect, error) {
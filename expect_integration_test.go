@@ -14,8 +14,7 @@ import (
 	"github.com/mdlayher/netlink"
 )
 
-// No meaningful integration test possible until we can figure out how
-// to create expects from userspace.
+// Dump the empty expectation table of a new namespace.
 func TestConnDumpExpect(t *testing.T) {
 
 	c, _, err := makeNSConn()
@@ -25,7 +24,7 @@ func TestConnDumpExpect(t *testing.T) {
 	require.NoError(t, err, "unexpected error dumping expect table")
 }
 
-// Attempt at creating conntrack expectation from userspace.
+// Create an expectation on a master Flow tracked by the 'ftp' helper.
 func TestConnCreateExpect(t *testing.T) {
 
 	c, _, err := makeNSConn()
@@ -36,18 +35,60 @@ func TestConnCreateExpect(t *testing.T) {
 	err = c.Create(f)
 	require.NoError(t, err, "unexpected error creating flow", f)
 
-	ex := Expect{
+	ex := makeExpect(f, 30000)
+
+	// Master Flow does not have a helper attached.
+	err = c.CreateExpect(ex)
+	opErr, ok := errors.Cause(err).(*netlink.OpError)
+	require.True(t, ok)
+	require.EqualError(t, opErr.Err, unix.EOPNOTSUPP.Error())
+
+	f = NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 42001, 21, 120, 0)
+	f.Helper = Helper{Name: "ftp"}
+
+	err = c.Create(f)
+	require.NoError(t, err, "unexpected error creating flow", f)
+
+	// Expectation class exceeds the helper's policy.
+	ex = makeExpect(f, 30000)
+	ex.Class = 0x30
+	err = c.CreateExpect(ex)
+	opErr, ok = errors.Cause(err).(*netlink.OpError)
+	require.True(t, ok)
+	require.EqualError(t, opErr.Err, unix.EINVAL.Error())
+
+	// The kernel parses all tuples with the address family of the Tuple,
+	// an Expect mixing address families is rejected.
+	ex.Class = 0
+	ex.Mask.IP = IPTuple{SourceAddress: net.ParseIP("ffff::"), DestinationAddress: net.ParseIP("ffff::")}
+	err = c.CreateExpect(ex)
+	opErr, ok = errors.Cause(err).(*netlink.OpError)
+	require.True(t, ok)
+	require.EqualError(t, opErr.Err, unix.EINVAL.Error())
+
+	ex = makeExpect(f, 30000)
+	require.NoError(t, c.CreateExpect(ex), "unexpected error creating expect", ex)
+
+	exps, err := c.DumpExpect()
+	require.NoError(t, err)
+	require.Len(t, exps, 1)
+	require.Equal(t, "ftp", exps[0].HelpName)
+}
+
+// makeExpect returns an Expect for a data connection on the given port,
+// to be attached to a master Flow tracked by the 'ftp' helper.
+func makeExpect(master Flow, port uint16) Expect {
+	return Expect{
 		Timeout:     300,
-		TupleMaster: f.TupleOrig,
+		TupleMaster: master.TupleOrig,
 		Tuple: Tuple{
 			IP: IPTuple{
-				SourceAddress:      net.IPv4(1, 2, 3, 4),
-				DestinationAddress: net.IPv4(5, 6, 7, 8),
+				SourceAddress:      master.TupleOrig.IP.SourceAddress,
+				DestinationAddress: master.TupleOrig.IP.DestinationAddress,
 			},
 			Proto: ProtoTuple{
 				Protocol:        6,
-				SourcePort:      0,
-				DestinationPort: 30000,
+				DestinationPort: port,
 			},
 		},
 		Mask: Tuple{
@@ -57,17 +98,112 @@ func TestConnCreateExpect(t *testing.T) {
 			},
 			Proto: ProtoTuple{
 				Protocol:        6,
-				SourcePort:      0,
 				DestinationPort: 65535,
 			},
 		},
 		HelpName: "ftp",
-		Class:    0x30,
 	}
+}
 
-	err = c.CreateExpect(ex)
+func TestConnGetDeleteExpect(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	f := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 42000, 21, 120, 0)
+	f.Helper = Helper{Name: "ftp"}
+
+	err = c.Create(f)
+	require.NoError(t, err, "unexpected error creating flow", f)
 
+	ex := makeExpect(f, 30000)
+	require.NoError(t, c.CreateExpect(ex), "unexpected error creating expect", ex)
+
+	ge, err := c.GetExpect(ex)
+	require.NoError(t, err, "unexpected error getting expect", ex)
+	require.NotZero(t, ge.ID)
+	require.Equal(t, "ftp", ge.HelpName)
+	require.Equal(t, ex.Tuple.Proto.DestinationPort, ge.Tuple.Proto.DestinationPort)
+	require.Equal(t, f.TupleOrig.Proto.SourcePort, ge.TupleMaster.Proto.SourcePort)
+
+	// Lookup with a mismatching ID.
+	ex.ID = ge.ID + 1
+	_, err = c.GetExpect(ex)
 	opErr, ok := errors.Cause(err).(*netlink.OpError)
 	require.True(t, ok)
-	require.EqualError(t, opErr.Err, unix.EINVAL.Error())
+	require.EqualError(t, opErr.Err, unix.ENOENT.Error())
+
+	// Delete by ID only.
+	require.NoError(t, c.DeleteExpect(Expect{ID: ge.ID}))
+
+	_, err = c.GetExpect(ge)
+	opErr, ok = errors.Cause(err).(*netlink.OpError)
+	require.True(t, ok)
+	require.EqualError(t, opErr.Err, unix.ENOENT.Error())
+
+	require.EqualError(t, c.DeleteExpect(Expect{ID: ge.ID}), errExpectNotFound.Error())
+	require.EqualError(t, c.DeleteExpect(Expect{}), errExpectNeedID.Error())
+
+	// Delete by Tuple.
+	ex = makeExpect(f, 30001)
+	require.NoError(t, c.CreateExpect(ex), "unexpected error creating expect", ex)
+	require.NoError(t, c.DeleteExpect(ex))
+
+	exps, err := c.DumpExpect()
+	require.NoError(t, err)
+	require.Empty(t, exps)
+}
+
+func TestConnFlushExpect(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	// The 'ftp' helper only allows a single expectation per master Flow.
+	var masters []Flow
+	for _, port := range []uint16{42000, 42001, 42002} {
+		f := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), port, 21, 120, 0)
+		f.Helper = Helper{Name: "ftp"}
+
+		err = c.Create(f)
+		require.NoError(t, err, "unexpected error creating flow", f)
+
+		masters = append(masters, f)
+	}
+
+	createExpects := func() {
+		for i, f := range masters {
+			ex := makeExpect(f, 30000+uint16(i))
+			require.NoError(t, c.CreateExpect(ex), "unexpected error creating expect", ex)
+		}
+	}
+
+	createExpects()
+
+	// Flushing another helper's expectations leaves the table untouched.
+	require.NoError(t, c.FlushExpectHelper("sip"))
+	exps, err := c.DumpExpect()
+	require.NoError(t, err)
+	require.Len(t, exps, 3)
+
+	var n int
+	err = c.DumpExpectFunc(func(ex Expect) bool {
+		require.Equal(t, "ftp", ex.HelpName)
+		n++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	require.NoError(t, c.FlushExpectHelper("ftp"))
+	exps, err = c.DumpExpect()
+	require.NoError(t, err)
+	require.Empty(t, exps)
+
+	createExpects()
+
+	require.NoError(t, c.FlushExpect())
+	exps, err = c.DumpExpect()
+	require.NoError(t, err)
+	require.Empty(t, exps)
 }
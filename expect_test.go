@@ -337,7 +337,7 @@ func TestExpectMarshal(t *testing.T) {
 		},
 		{
 			Type: uint16(ctaExpectHelpName),
-			Data: []byte("ftp"),
+			Data: []byte("ftp\x00"),
 		},
 		{
 			Type: uint16(ctaExpectZone),
@@ -468,6 +468,61 @@ var corpusExpectNAT = []struct {
 	},
 }
 
+func TestExpectMarshalLookup(t *testing.T) {
+
+	ex := Expect{
+		TupleMaster: flowIPPT, Tuple: flowIPPT, Mask: flowIPPT,
+		ID:       0x0102,
+		Timeout:  240,
+		Zone:     5,
+		HelpName: "ftp",
+	}
+
+	exm, err := ex.marshalLookup()
+	require.NoError(t, err, "Expect lookup marshal")
+
+	want := []netfilter.Attribute{
+		{
+			Type:     uint16(ctaExpectTuple),
+			Nested:   true,
+			Children: nfaIPPT,
+		},
+		{
+			Type: uint16(ctaExpectZone),
+			Data: []byte{0x00, 0x05},
+		},
+		{
+			Type: uint16(ctaExpectID),
+			Data: []byte{0x00, 0x00, 0x01, 0x02},
+		},
+	}
+
+	if diff := cmp.Diff(want, exm); diff != "" {
+		t.Fatalf("unexpected Expect lookup marshal (-want +got):\n%s", diff)
+	}
+
+	// Cannot marshal without Tuple
+	_, err = Expect{ID: 0x0102}.marshalLookup()
+	assert.EqualError(t, err, errExpectNeedTuple.Error())
+
+	// Return error from Tuple marshal
+	_, err = Expect{Tuple: flowBadIPPT}.marshalLookup()
+	assert.EqualError(t, err, errBadIPTuple.Error())
+}
+
+// The address family of requests for an Expect is taken from its Tuple,
+// even if the Mask or TupleMaster hold addresses of another family.
+func TestExpectFamily(t *testing.T) {
+
+	v4 := Tuple{IP: IPTuple{SourceAddress: net.IPv4(1, 2, 3, 4), DestinationAddress: net.IPv4(5, 6, 7, 8)}}
+	v6 := Tuple{IP: IPTuple{SourceAddress: net.ParseIP("2001:db8::1"), DestinationAddress: net.ParseIP("2001:db8::2")}}
+
+	assert.Equal(t, netfilter.ProtoIPv4, Expect{Tuple: v4, Mask: v4, TupleMaster: v4}.family())
+	assert.Equal(t, netfilter.ProtoIPv6, Expect{Tuple: v6, Mask: v6, TupleMaster: v6}.family())
+	assert.Equal(t, netfilter.ProtoIPv6, Expect{Tuple: v6, Mask: v4, TupleMaster: v6}.family())
+	assert.Equal(t, netfilter.ProtoIPv4, Expect{Tuple: v4, Mask: v6, TupleMaster: v6}.family())
+}
+
 func TestExpectNATUnmarshal(t *testing.T) {
 
 	for _, tt := range corpusExpectNAT {
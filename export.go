@@ -0,0 +1,266 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	// Both IPFIX and NetFlow v9 sets start with a header holding their ID and length.
+	exportSetHeaderLen = 4
+
+	exportDefaultMessageSize     = 1400
+	exportDefaultTemplateRefresh = 10 * time.Minute
+)
+
+// IANA IPFIX information element identifiers. The identifiers up to 127 are equal to
+// the field types of NetFlow v9, see RFC 3954.
+const (
+	ieOctetDeltaCount                  = 1
+	iePacketDeltaCount                 = 2
+	ieProtocolIdentifier               = 4
+	ieSourceTransportPort              = 7
+	ieSourceIPv4Address                = 8
+	ieDestinationTransportPort         = 11
+	ieDestinationIPv4Address           = 12
+	ieSourceIPv6Address                = 27
+	ieDestinationIPv6Address           = 28
+	ieICMPTypeCodeIPv4                 = 32
+	ieICMPTypeCodeIPv6                 = 139
+	ieFlowID                           = 148
+	ieFlowStartMilliseconds            = 152
+	ieFlowEndMilliseconds              = 153
+	iePostNATSourceIPv4Address         = 225
+	iePostNATDestinationIPv4Address    = 226
+	iePostNAPTSourceTransportPort      = 227
+	iePostNAPTDestinationTransportPort = 228
+	iePostNATSourceIPv6Address         = 281
+	iePostNATDestinationIPv6Address    = 282
+)
+
+// exportField is an information element of an export template, and the function
+// writing its value for a Record.
+type exportField struct {
+	id         uint16
+	enterprise uint32
+	length     uint16
+	put        func(b []byte, r *Record)
+}
+
+// exportTemplate is a template of the data records of an export protocol.
+type exportTemplate struct {
+	id     uint16
+	fields []exportField
+
+	// Length of a data record.
+	length int
+}
+
+// newExportTemplate returns an exportTemplate with the given fields.
+func newExportTemplate(id uint16, fields []exportField) exportTemplate {
+
+	t := exportTemplate{id: id, fields: fields}
+	for _, f := range fields {
+		t.length += int(f.length)
+	}
+
+	return t
+}
+
+// exportMessage is a message of an export protocol being built, consisting of a header
+// followed by sets of templates or data records.
+type exportMessage struct {
+	b []byte
+
+	// Offset of the header of the current set, -1 when no set was started.
+	set   int
+	setID uint16
+
+	records   uint32
+	templates bool
+
+	// Pad sets to a multiple of 4 bytes.
+	align bool
+}
+
+// startSet ends the current set and starts a set with the given ID.
+func (m *exportMessage) startSet(id uint16) {
+
+	m.endSet()
+
+	m.set = len(m.b)
+	m.setID = id
+	m.b = append(m.b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(m.b[m.set:], id)
+}
+
+// endSet writes the length of the current set into its header.
+func (m *exportMessage) endSet() {
+
+	if m.set < 0 {
+		return
+	}
+
+	if m.align {
+		for (len(m.b)-m.set)%4 != 0 {
+			m.b = append(m.b, 0)
+		}
+	}
+
+	binary.BigEndian.PutUint16(m.b[m.set+2:], uint16(len(m.b)-m.set))
+	m.set = -1
+}
+
+// fits returns true if a data record of the template fits in a message of the given size.
+func (m *exportMessage) fits(t *exportTemplate, size int) bool {
+
+	l := len(m.b) + t.length
+	if m.set < 0 || m.setID != t.id {
+		l += exportSetHeaderLen
+	}
+	if m.align {
+		l += 3
+	}
+
+	return l <= size
+}
+
+// add appends a data record of the Record to the message.
+func (m *exportMessage) add(t *exportTemplate, r *Record) {
+
+	if m.set < 0 || m.setID != t.id {
+		m.startSet(t.id)
+	}
+
+	off := len(m.b)
+	m.b = append(m.b, make([]byte, t.length)...)
+
+	for _, f := range t.fields {
+		f.put(m.b[off:off+int(f.length)], r)
+		off += int(f.length)
+	}
+
+	m.records++
+}
+
+// isDatagram returns true if conn is a connectionless socket, like a UDP socket.
+func isDatagram(conn net.Conn) bool {
+
+	switch conn.LocalAddr().Network() {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+
+	return false
+}
+
+// isIPv4 returns true if the Tuple holds IPv4 addresses.
+func isIPv4(t Tuple) bool {
+	return t.IP.SourceAddress.To4() != nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// putIP writes an IP address to b, in the 4 or 16-byte form matching its length.
+func putIP(b []byte, ip net.IP) {
+
+	if len(b) == net.IPv4len {
+		copy(b, ip.To4())
+		return
+	}
+
+	copy(b, ip.To16())
+}
+
+func putFlowID(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, uint64(r.ID))
+}
+
+func putProtocol(b []byte, r *Record) {
+	b[0] = r.TupleOrig.Proto.Protocol
+}
+
+func putSourceAddress(b []byte, r *Record) {
+	putIP(b, r.TupleOrig.IP.SourceAddress)
+}
+
+func putDestinationAddress(b []byte, r *Record) {
+	putIP(b, r.TupleOrig.IP.DestinationAddress)
+}
+
+func putSourcePort(b []byte, r *Record) {
+	binary.BigEndian.PutUint16(b, r.TupleOrig.Proto.SourcePort)
+}
+
+func putDestinationPort(b []byte, r *Record) {
+	binary.BigEndian.PutUint16(b, r.TupleOrig.Proto.DestinationPort)
+}
+
+// The reply tuple is the reverse of the original tuple after NAT, so the translated
+// source of the original direction is the destination of the reply direction.
+
+func putPostNATSourceAddress(b []byte, r *Record) {
+	putIP(b, r.TupleReply.IP.DestinationAddress)
+}
+
+func putPostNATDestinationAddress(b []byte, r *Record) {
+	putIP(b, r.TupleReply.IP.SourceAddress)
+}
+
+func putPostNATSourcePort(b []byte, r *Record) {
+	binary.BigEndian.PutUint16(b, r.TupleReply.Proto.DestinationPort)
+}
+
+func putPostNATDestinationPort(b []byte, r *Record) {
+	binary.BigEndian.PutUint16(b, r.TupleReply.Proto.SourcePort)
+}
+
+func putICMPTypeCode(b []byte, r *Record) {
+	b[0] = r.TupleOrig.Proto.ICMPType
+	b[1] = r.TupleOrig.Proto.ICMPCode
+}
+
+func putOctetsOrig(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, r.CountersOrig.Bytes)
+}
+
+func putPacketsOrig(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, r.CountersOrig.Packets)
+}
+
+func putOctetsReply(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, r.CountersReply.Bytes)
+}
+
+func putPacketsReply(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, r.CountersReply.Packets)
+}
+
+func putStartMilliseconds(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, unixMilli(r.Start))
+}
+
+func putEndMilliseconds(b []byte, r *Record) {
+	binary.BigEndian.PutUint64(b, unixMilli(r.Stop))
+}
+
+// unixMilli returns the milliseconds since the Unix epoch of a time, or 0 for the zero time.
+func unixMilli(t time.Time) uint64 {
+
+	if t.IsZero() {
+		return 0
+	}
+
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func putMark(b []byte, r *Record) {
+	binary.BigEndian.PutUint32(b, r.Mark)
+}
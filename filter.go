@@ -1,6 +1,9 @@
 package conntrack
 
 import (
+	"net"
+
+	"github.com/mdlayher/netlink/nlenc"
 	"github.com/ti-mo/netfilter"
 )
 
@@ -8,14 +11,78 @@ import (
 // based on a given connmark and mask. The mask is applied to the Mark field of
 // all flows in the conntrack table, the result is compared to the filter's Mark.
 // Each flow that matches will be returned by the kernel.
+//
+// Flows can additionally be filtered on their status, zone and tuples. All non-zero
+// criteria need to match for a Flow to be returned. Older kernels silently ignore
+// these criteria, so the Conn probes the kernel for support when they are first
+// used. Criteria the kernel does not apply are applied to the dumped Flows in
+// userspace, giving the same results on any kernel.
 type Filter struct {
 	Mark, Mask uint32
+
+	// StatusMask is applied to the status flags of all flows in the conntrack table,
+	// the result is compared to Status. Only used when StatusMask is non-zero.
+	Status, StatusMask StatusFlag
+
+	// Zone matches Flows in the given conntrack zone, in any direction.
+	// The kernel does not support filtering on the default zone 0.
+	Zone uint16
+
+	// TupleOrig and TupleReply are compared to the Flows' tuples in the respective
+	// direction. Only the fields selected by OrigFlags and ReplyFlags are considered,
+	// the Tuples are not used when their flags are zero.
+	TupleOrig, TupleReply Tuple
+	OrigFlags, ReplyFlags FilterFlag
+
+	// Family limits the Filter to Flows of a single address family, netfilter.ProtoIPv4
+	// or netfilter.ProtoIPv6. Flows of both families are considered when it is ProtoUnspec.
+	// When the Filter compares addresses, they must belong to this family.
+	Family netfilter.ProtoFamily
 }
 
+// FilterFlag selects the fields of a Tuple to compare during a filtered dump.
+type FilterFlag uint32
+
+// Tuple fields that can be selected for filtering.
+const (
+	FilterSourceAddress      FilterFlag = 1 << iota // CTA_FILTER_F_CTA_IP_SRC
+	FilterDestinationAddress                        // CTA_FILTER_F_CTA_IP_DST
+	FilterTupleZone                                 // CTA_FILTER_F_CTA_TUPLE_ZONE
+	FilterProtocol                                  // CTA_FILTER_F_CTA_PROTO_NUM
+	FilterSourcePort                                // CTA_FILTER_F_CTA_PROTO_SRC_PORT
+	FilterDestinationPort                           // CTA_FILTER_F_CTA_PROTO_DST_PORT
+	FilterICMPType                                  // CTA_FILTER_F_CTA_PROTO_ICMP_TYPE
+	FilterICMPCode                                  // CTA_FILTER_F_CTA_PROTO_ICMP_CODE
+	FilterICMPID                                    // CTA_FILTER_F_CTA_PROTO_ICMP_ID
+	FilterICMPv6Type                                // CTA_FILTER_F_CTA_PROTO_ICMPV6_TYPE
+	FilterICMPv6Code                                // CTA_FILTER_F_CTA_PROTO_ICMPV6_CODE
+	FilterICMPv6ID                                  // CTA_FILTER_F_CTA_PROTO_ICMPV6_ID
+
+	// FilterAddresses selects the source and destination address of a Tuple.
+	FilterAddresses = FilterSourceAddress | FilterDestinationAddress
+	// FilterPorts selects the protocol, source and destination port of a Tuple.
+	FilterPorts = FilterProtocol | FilterSourcePort | FilterDestinationPort
+
+	filterAddressFlags = FilterAddresses
+	filterProtoFlags   = FilterSourcePort | FilterDestinationPort |
+		FilterICMPType | FilterICMPCode | FilterICMPID |
+		FilterICMPv6Type | FilterICMPv6Code | FilterICMPv6ID
+)
+
 // marshal marshals a Filter into a list of netfilter.Attributes.
-func (f Filter) marshal() []netfilter.Attribute {
+func (f Filter) marshal() ([]netfilter.Attribute, error) {
 
-	return []netfilter.Attribute{
+	switch f.Family {
+	case netfilter.ProtoUnspec, netfilter.ProtoIPv4, netfilter.ProtoIPv6:
+	default:
+		return nil, errFilterFamily
+	}
+
+	if pf := f.family(); pf != netfilter.ProtoUnspec && f.Family != netfilter.ProtoUnspec && pf != f.Family {
+		return nil, errFilterFamily
+	}
+
+	attrs := []netfilter.Attribute{
 		{
 			Type: uint16(ctaMark),
 			Data: netfilter.Uint32Bytes(f.Mark),
@@ -25,4 +92,287 @@ func (f Filter) marshal() []netfilter.Attribute {
 			Data: netfilter.Uint32Bytes(f.Mask),
 		},
 	}
+
+	if f.StatusMask != 0 {
+		attrs = append(attrs,
+			netfilter.Attribute{Type: uint16(ctaStatus), Data: netfilter.Uint32Bytes(uint32(f.Status))},
+			netfilter.Attribute{Type: uint16(ctaStatusMask), Data: netfilter.Uint32Bytes(uint32(f.StatusMask))},
+		)
+	}
+
+	// The tuple and zone filters are only considered by the kernel
+	// when a CTA_FILTER attribute is present.
+	if f.OrigFlags == 0 && f.ReplyFlags == 0 && f.Zone == 0 {
+		return attrs, nil
+	}
+
+	if f.OrigFlags != 0 {
+		tp, err := f.TupleOrig.marshalFilter(uint16(ctaTupleOrig), f.OrigFlags)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, tp)
+	}
+
+	if f.ReplyFlags != 0 {
+		tp, err := f.TupleReply.marshalFilter(uint16(ctaTupleReply), f.ReplyFlags)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, tp)
+	}
+
+	if f.Zone != 0 {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaZone), Data: netfilter.Uint16Bytes(f.Zone)})
+	}
+
+	attrs = append(attrs, marshalFilterFlags(f.OrigFlags, f.ReplyFlags))
+
+	return attrs, nil
+}
+
+// marshalFilterFlags marshals the FilterFlags of both directions into a CTA_FILTER attribute.
+func marshalFilterFlags(orig, reply FilterFlag) netfilter.Attribute {
+
+	// Unlike most conntrack attributes, CTA_FILTER flags are in host byte order.
+	return netfilter.Attribute{
+		Type:   uint16(ctaFilter),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(ctaFilterOrigFlags), Data: nlenc.Uint32Bytes(uint32(orig))},
+			{Type: uint16(ctaFilterReplyFlags), Data: nlenc.Uint32Bytes(uint32(reply))},
+		},
+	}
+}
+
+// families returns the address families a request with the Filter needs to be
+// sent for. The kernel only accepts tuple filters for a specific address family,
+// so filters on tuples without addresses are applied to IPv4 and IPv6 separately.
+func (f Filter) families() []netfilter.ProtoFamily {
+
+	if f.Family != netfilter.ProtoUnspec {
+		return []netfilter.ProtoFamily{f.Family}
+	}
+
+	if pf := f.family(); pf != netfilter.ProtoUnspec {
+		return []netfilter.ProtoFamily{pf}
+	}
+
+	if f.OrigFlags != 0 || f.ReplyFlags != 0 {
+		return []netfilter.ProtoFamily{netfilter.ProtoIPv4, netfilter.ProtoIPv6}
+	}
+
+	// ProtoUnspec dumps both IPv4 and IPv6
+	return []netfilter.ProtoFamily{netfilter.ProtoUnspec}
+}
+
+// family returns the address family of the Filter's tuples when it filters on
+// IP addresses. Returns ProtoUnspec otherwise.
+func (f Filter) family() netfilter.ProtoFamily {
+
+	var ip net.IP
+
+	switch {
+	case f.OrigFlags&FilterSourceAddress != 0:
+		ip = f.TupleOrig.IP.SourceAddress
+	case f.OrigFlags&FilterDestinationAddress != 0:
+		ip = f.TupleOrig.IP.DestinationAddress
+	case f.ReplyFlags&FilterSourceAddress != 0:
+		ip = f.TupleReply.IP.SourceAddress
+	case f.ReplyFlags&FilterDestinationAddress != 0:
+		ip = f.TupleReply.IP.DestinationAddress
+	default:
+		return netfilter.ProtoUnspec
+	}
+
+	if ip.To4() != nil {
+		return netfilter.ProtoIPv4
+	}
+
+	return netfilter.ProtoIPv6
+}
+
+// marshalFilter marshals the fields of a Tuple selected by flags into a netfilter.Attribute.
+// Unlike marshal, it only requires the selected fields to be set.
+func (t Tuple) marshalFilter(at uint16, flags FilterFlag) (netfilter.Attribute, error) {
+
+	nfa := netfilter.Attribute{Type: at, Nested: true}
+
+	if flags&filterAddressFlags != 0 {
+		ipt := netfilter.Attribute{Type: uint16(ctaTupleIP), Nested: true}
+
+		// Both selected addresses need to be of the same family.
+		v4, v6 := false, false
+		for _, sel := range []struct {
+			flag   FilterFlag
+			ip     net.IP
+			v4, v6 ipTupleType
+		}{
+			{FilterSourceAddress, t.IP.SourceAddress, ctaIPv4Src, ctaIPv6Src},
+			{FilterDestinationAddress, t.IP.DestinationAddress, ctaIPv4Dst, ctaIPv6Dst},
+		} {
+			if flags&sel.flag == 0 {
+				continue
+			}
+
+			if ip4 := sel.ip.To4(); ip4 != nil {
+				ipt.Children = append(ipt.Children, netfilter.Attribute{Type: uint16(sel.v4), Data: ip4})
+				v4 = true
+			} else if ip6 := sel.ip.To16(); ip6 != nil {
+				ipt.Children = append(ipt.Children, netfilter.Attribute{Type: uint16(sel.v6), Data: ip6})
+				v6 = true
+			} else {
+				return netfilter.Attribute{}, errBadIPTuple
+			}
+		}
+
+		if v4 && v6 {
+			return netfilter.Attribute{}, errBadIPTuple
+		}
+
+		nfa.Children = append(nfa.Children, ipt)
+	}
+
+	if flags&filterProtoFlags != 0 && flags&FilterProtocol == 0 {
+		return netfilter.Attribute{}, errFilterNeedProtocol
+	}
+
+	if flags&FilterProtocol != 0 {
+		pt := netfilter.Attribute{Type: uint16(ctaTupleProto), Nested: true}
+		pt.Children = append(pt.Children, netfilter.Attribute{Type: uint16(ctaProtoNum), Data: []byte{t.Proto.Protocol}})
+
+		for _, sel := range []struct {
+			flag FilterFlag
+			attr netfilter.Attribute
+		}{
+			{FilterSourcePort, netfilter.Attribute{Type: uint16(ctaProtoSrcPort), Data: netfilter.Uint16Bytes(t.Proto.SourcePort)}},
+			{FilterDestinationPort, netfilter.Attribute{Type: uint16(ctaProtoDstPort), Data: netfilter.Uint16Bytes(t.Proto.DestinationPort)}},
+			{FilterICMPID, netfilter.Attribute{Type: uint16(ctaProtoICMPID), Data: netfilter.Uint16Bytes(t.Proto.ICMPID)}},
+			{FilterICMPType, netfilter.Attribute{Type: uint16(ctaProtoICMPType), Data: []byte{t.Proto.ICMPType}}},
+			{FilterICMPCode, netfilter.Attribute{Type: uint16(ctaProtoICMPCode), Data: []byte{t.Proto.ICMPCode}}},
+			{FilterICMPv6ID, netfilter.Attribute{Type: uint16(ctaProtoICMPv6ID), Data: netfilter.Uint16Bytes(t.Proto.ICMPID)}},
+			{FilterICMPv6Type, netfilter.Attribute{Type: uint16(ctaProtoICMPv6Type), Data: []byte{t.Proto.ICMPType}}},
+			{FilterICMPv6Code, netfilter.Attribute{Type: uint16(ctaProtoICMPv6Code), Data: []byte{t.Proto.ICMPCode}}},
+		} {
+			if flags&sel.flag != 0 {
+				pt.Children = append(pt.Children, sel.attr)
+			}
+		}
+
+		nfa.Children = append(nfa.Children, pt)
+	}
+
+	if flags&FilterTupleZone != 0 {
+		nfa.Children = append(nfa.Children, netfilter.Attribute{Type: uint16(ctaTupleZone), Data: netfilter.Uint16Bytes(t.Zone)})
+	}
+
+	return nfa, nil
+}
+
+// filterSupport describes the criteria of a Filter the kernel applies to a dump or flush
+// request. Kernels silently ignore the attributes they don't know about, returning or
+// deleting Flows that don't match the Filter.
+type filterSupport struct {
+	tuples bool // CTA_FILTER, tuple and zone filters
+	status bool // CTA_STATUS and CTA_STATUS_MASK
+	family bool // Address family in the request header
+}
+
+// extended returns true if the Filter has any criteria besides the connmark,
+// which are not supported by all kernels.
+func (f Filter) extended() bool {
+	return f.StatusMask != 0 || f.Zone != 0 || f.OrigFlags != 0 || f.ReplyFlags != 0 ||
+		f.Family != netfilter.ProtoUnspec
+}
+
+// kernelFilter returns the part of the Filter that can be applied by a kernel with the given
+// filterSupport. Returns true if the kernel's results need to be matched against the full
+// Filter in userspace.
+func (f Filter) kernelFilter(s filterSupport) (Filter, bool) {
+
+	kf := f
+	partial := false
+
+	if !s.status && f.StatusMask != 0 {
+		kf.Status, kf.StatusMask = 0, 0
+		partial = true
+	}
+
+	if !s.tuples && (f.Zone != 0 || f.OrigFlags != 0 || f.ReplyFlags != 0) {
+		kf.Zone, kf.OrigFlags, kf.ReplyFlags = 0, 0, 0
+		partial = true
+	}
+
+	if !s.family && f.Family != netfilter.ProtoUnspec {
+		partial = true
+	}
+
+	// The kernel's comparison of IPv6 addresses in tuple filters is inverted, returning
+	// the Flows that don't match the given address. Always compare them in userspace.
+	if f.family() == netfilter.ProtoIPv6 && (kf.OrigFlags|kf.ReplyFlags)&filterAddressFlags != 0 {
+		kf.OrigFlags &^= filterAddressFlags
+		kf.ReplyFlags &^= filterAddressFlags
+		partial = true
+	}
+
+	return kf, partial
+}
+
+// match returns true if the Flow meets all criteria of the Filter. It follows the semantics
+// of the kernel's filtering, and is used for the criteria the kernel can't apply itself.
+func (f Filter) match(fl Flow) bool {
+
+	if fl.Mark&f.Mask != f.Mark {
+		return false
+	}
+
+	if f.Family != netfilter.ProtoUnspec && fl.family() != f.Family {
+		return false
+	}
+
+	if f.StatusMask != 0 && fl.Status.Value&f.StatusMask != f.Status {
+		return false
+	}
+
+	// The zone of a tuple filter is applied to the Flow as a whole, like the kernel does.
+	for _, z := range []struct {
+		set  bool
+		zone uint16
+	}{
+		{f.Zone != 0, f.Zone},
+		{f.OrigFlags&FilterTupleZone != 0 && f.TupleOrig.Zone != 0, f.TupleOrig.Zone},
+		{f.ReplyFlags&FilterTupleZone != 0 && f.TupleReply.Zone != 0, f.TupleReply.Zone},
+	} {
+		if z.set && fl.Zone != z.zone {
+			return false
+		}
+	}
+
+	return fl.TupleOrig.matchFilter(f.TupleOrig, f.OrigFlags) &&
+		fl.TupleReply.matchFilter(f.TupleReply, f.ReplyFlags)
+}
+
+// matchFilter returns true if the fields of the Tuple selected by flags are equal to those of ft.
+// Tuple zones are not compared, see Filter.match.
+func (t Tuple) matchFilter(ft Tuple, flags FilterFlag) bool {
+
+	for _, sel := range []struct {
+		flag  FilterFlag
+		equal bool
+	}{
+		{FilterSourceAddress, t.IP.SourceAddress.Equal(ft.IP.SourceAddress)},
+		{FilterDestinationAddress, t.IP.DestinationAddress.Equal(ft.IP.DestinationAddress)},
+		{FilterProtocol, t.Proto.Protocol == ft.Proto.Protocol},
+		{FilterSourcePort, t.Proto.SourcePort == ft.Proto.SourcePort},
+		{FilterDestinationPort, t.Proto.DestinationPort == ft.Proto.DestinationPort},
+		{FilterICMPType | FilterICMPv6Type, t.Proto.ICMPType == ft.Proto.ICMPType},
+		{FilterICMPCode | FilterICMPv6Code, t.Proto.ICMPCode == ft.Proto.ICMPCode},
+		{FilterICMPID | FilterICMPv6ID, t.Proto.ICMPID == ft.Proto.ICMPID},
+	} {
+		if flags&sel.flag != 0 && !sel.equal {
+			return false
+		}
+	}
+
+	return true
 }
@@ -1,11 +1,15 @@
 package conntrack
 
 import (
+	"net"
 	"testing"
 
+	"github.com/mdlayher/netlink/nlenc"
 	"github.com/ti-mo/netfilter"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFilterMarshal(t *testing.T) {
@@ -22,7 +26,225 @@ func TestFilterMarshal(t *testing.T) {
 		},
 	}
 
-	if diff := cmp.Diff(fm, f.marshal()); diff != "" {
+	attrs, err := f.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(fm, attrs); diff != "" {
+		t.Fatalf("unexpected Filter marshal (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilterMarshalTuples(t *testing.T) {
+
+	f := Filter{
+		Status: StatusAssured, StatusMask: StatusAssured | StatusSeenReply,
+		Zone: 5,
+		TupleOrig: Tuple{
+			IP:    IPTuple{SourceAddress: net.ParseIP("1.2.3.4")},
+			Proto: ProtoTuple{Protocol: 6, DestinationPort: 80},
+		},
+		OrigFlags: FilterSourceAddress | FilterProtocol | FilterDestinationPort,
+		TupleReply: Tuple{
+			IP:   IPTuple{DestinationAddress: net.ParseIP("5.6.7.8")},
+			Zone: 2,
+		},
+		ReplyFlags: FilterDestinationAddress | FilterTupleZone,
+	}
+
+	fm := []netfilter.Attribute{
+		{Type: uint16(ctaMark), Data: []byte{0, 0, 0, 0}},
+		{Type: uint16(ctaMarkMask), Data: []byte{0, 0, 0, 0}},
+		{Type: uint16(ctaStatus), Data: []byte{0, 0, 0, 0x04}},
+		{Type: uint16(ctaStatusMask), Data: []byte{0, 0, 0, 0x06}},
+		{
+			Type:   uint16(ctaTupleOrig),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{
+					Type:     uint16(ctaTupleIP),
+					Nested:   true,
+					Children: []netfilter.Attribute{{Type: uint16(ctaIPv4Src), Data: []byte{1, 2, 3, 4}}},
+				},
+				{
+					Type:   uint16(ctaTupleProto),
+					Nested: true,
+					Children: []netfilter.Attribute{
+						{Type: uint16(ctaProtoNum), Data: []byte{6}},
+						{Type: uint16(ctaProtoDstPort), Data: []byte{0, 80}},
+					},
+				},
+			},
+		},
+		{
+			Type:   uint16(ctaTupleReply),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{
+					Type:     uint16(ctaTupleIP),
+					Nested:   true,
+					Children: []netfilter.Attribute{{Type: uint16(ctaIPv4Dst), Data: []byte{5, 6, 7, 8}}},
+				},
+				{Type: uint16(ctaTupleZone), Data: []byte{0, 2}},
+			},
+		},
+		{Type: uint16(ctaZone), Data: []byte{0, 5}},
+		{
+			Type:   uint16(ctaFilter),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{Type: uint16(ctaFilterOrigFlags), Data: nlenc.Uint32Bytes(0x29)},
+				{Type: uint16(ctaFilterReplyFlags), Data: nlenc.Uint32Bytes(0x06)},
+			},
+		},
+	}
+
+	attrs, err := f.marshal()
+	require.NoError(t, err)
+
+	if diff := cmp.Diff(fm, attrs); diff != "" {
 		t.Fatalf("unexpected Filter marshal (-want +got):\n%s", diff)
 	}
+
+	assert.Equal(t, netfilter.ProtoIPv4, f.family())
+	assert.Equal(t, netfilter.ProtoUnspec, Filter{Mark: 1}.family())
+	assert.Equal(t, netfilter.ProtoIPv6, Filter{
+		TupleReply: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("::1")}},
+		ReplyFlags: FilterSourceAddress,
+	}.family())
+
+	assert.Equal(t, []netfilter.ProtoFamily{netfilter.ProtoIPv4}, f.families())
+	assert.Equal(t, []netfilter.ProtoFamily{netfilter.ProtoUnspec}, Filter{Zone: 1}.families())
+	assert.Equal(t, []netfilter.ProtoFamily{netfilter.ProtoIPv4, netfilter.ProtoIPv6}, Filter{
+		TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 17}},
+		OrigFlags: FilterProtocol,
+	}.families())
+
+	// Zone filter without tuples.
+	attrs, err = Filter{Zone: 1}.marshal()
+	require.NoError(t, err)
+	assert.Len(t, attrs, 4)
+	assert.Equal(t, uint16(ctaFilter), attrs[3].Type)
+}
+
+func TestFilterMarshalError(t *testing.T) {
+
+	_, err := Filter{OrigFlags: FilterSourceAddress}.marshal()
+	assert.EqualError(t, err, errBadIPTuple.Error())
+
+	_, err = Filter{
+		TupleReply: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("1.2.3.4"), DestinationAddress: net.ParseIP("::1")}},
+		ReplyFlags: FilterAddresses,
+	}.marshal()
+	assert.EqualError(t, err, errBadIPTuple.Error())
+
+	_, err = Filter{OrigFlags: FilterSourcePort}.marshal()
+	assert.EqualError(t, err, errFilterNeedProtocol.Error())
+
+	_, err = Filter{Family: netfilter.ProtoARP}.marshal()
+	assert.EqualError(t, err, errFilterFamily.Error())
+
+	_, err = Filter{
+		Family:    netfilter.ProtoIPv6,
+		TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("1.2.3.4")}},
+		OrigFlags: FilterSourceAddress,
+	}.marshal()
+	assert.EqualError(t, err, errFilterFamily.Error())
+}
+
+func TestFilterFamilies(t *testing.T) {
+
+	assert.Equal(t, []netfilter.ProtoFamily{netfilter.ProtoUnspec}, Filter{}.families())
+	assert.Equal(t, []netfilter.ProtoFamily{netfilter.ProtoIPv6}, Filter{Family: netfilter.ProtoIPv6}.families())
+	assert.Equal(t, []netfilter.ProtoFamily{netfilter.ProtoIPv4}, Filter{
+		Family:    netfilter.ProtoIPv4,
+		TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 6}},
+		OrigFlags: FilterProtocol,
+	}.families())
+}
+
+func TestFilterMatch(t *testing.T) {
+
+	f := NewFlow(6, StatusAssured, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 1000, 80, 120, 0xff01)
+	f.Zone = 2
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"mark", Filter{Mark: 0x01, Mask: 0xff}, true},
+		{"mark mismatch", Filter{Mark: 0x02, Mask: 0xff}, false},
+		{"status", Filter{Status: StatusAssured, StatusMask: StatusAssured | StatusSeenReply}, true},
+		{"status mismatch", Filter{Status: StatusSeenReply, StatusMask: StatusSeenReply}, false},
+		{"zone", Filter{Zone: 2}, true},
+		{"zone mismatch", Filter{Zone: 1}, false},
+		{"family", Filter{Family: netfilter.ProtoIPv4}, true},
+		{"family mismatch", Filter{Family: netfilter.ProtoIPv6}, false},
+		{"tuple zone mismatch", Filter{TupleOrig: Tuple{Zone: 1}, OrigFlags: FilterTupleZone}, false},
+		{"orig addresses", Filter{
+			TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("10.0.0.1"), DestinationAddress: net.ParseIP("10.0.1.1")}},
+			OrigFlags: FilterAddresses,
+		}, true},
+		{"orig address mismatch", Filter{
+			TupleOrig: Tuple{IP: IPTuple{DestinationAddress: net.ParseIP("10.0.0.1")}},
+			OrigFlags: FilterDestinationAddress,
+		}, false},
+		{"reply ports", Filter{
+			TupleReply: Tuple{Proto: ProtoTuple{Protocol: 6, SourcePort: 80, DestinationPort: 1000}},
+			ReplyFlags: FilterPorts,
+		}, true},
+		{"reply port mismatch", Filter{
+			TupleReply: Tuple{Proto: ProtoTuple{Protocol: 6, SourcePort: 1000}},
+			ReplyFlags: FilterProtocol | FilterSourcePort,
+		}, false},
+		{"unselected fields", Filter{
+			TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("10.0.0.1")}, Proto: ProtoTuple{Protocol: 17}},
+			OrigFlags: FilterSourceAddress,
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.match(f))
+		})
+	}
+}
+
+func TestFilterKernelFilter(t *testing.T) {
+
+	f := Filter{
+		Mark: 1, Mask: 1,
+		Status: StatusAssured, StatusMask: StatusAssured,
+		Zone:      1,
+		TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 6}},
+		OrigFlags: FilterProtocol,
+	}
+
+	kf, partial := f.kernelFilter(filterSupport{tuples: true, status: true})
+	assert.False(t, partial)
+	assert.Equal(t, f, kf)
+
+	kf, partial = f.kernelFilter(filterSupport{tuples: true})
+	assert.True(t, partial)
+	assert.Equal(t, StatusFlag(0), kf.StatusMask)
+	assert.Equal(t, FilterProtocol, kf.OrigFlags)
+
+	kf, partial = f.kernelFilter(filterSupport{status: true})
+	assert.True(t, partial)
+	assert.Equal(t, Filter{Mark: 1, Mask: 1, Status: StatusAssured, StatusMask: StatusAssured, TupleOrig: f.TupleOrig}, kf)
+
+	_, partial = Filter{Family: netfilter.ProtoIPv6}.kernelFilter(filterSupport{tuples: true, status: true})
+	assert.True(t, partial, "family without kernel support")
+
+	// IPv6 address filters are always applied in userspace.
+	f6 := Filter{
+		TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("::1")}, Proto: ProtoTuple{Protocol: 17}},
+		OrigFlags: FilterSourceAddress | FilterProtocol,
+	}
+	kf, partial = f6.kernelFilter(filterSupport{tuples: true, status: true})
+	assert.True(t, partial)
+	assert.Equal(t, FilterProtocol, kf.OrigFlags)
 }
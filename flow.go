@@ -28,11 +28,15 @@ type Flow struct {
 
 	SeqAdjOrig, SeqAdjReply SequenceAdjust
 
-	Labels, LabelsMask []byte
+	Labels, LabelsMask Labels
 
 	Mark, Use uint32
 
 	SynProxy SynProxy
+
+	// NAT bindings to set up for the source and destination of the Flow when it is
+	// created. The kernel does not report them in dumps, queries or events.
+	NATSrc, NATDst NAT
 }
 
 // NewFlow returns a new Flow object with the minimum necessary attributes to create a Conntrack entry.
@@ -241,9 +245,63 @@ func (f Flow) marshal() ([]netfilter.Attribute, error) {
 		attrs = append(attrs, f.SynProxy.marshal())
 	}
 
+	// When a mask is given, only the labels selected by the mask are changed.
+	if len(f.Labels) != 0 || len(f.LabelsMask) != 0 {
+		if len(f.Labels) > labelsLen || len(f.LabelsMask) > labelsLen {
+			return nil, errLabelsTooLong
+		}
+
+		if len(f.LabelsMask) == 0 {
+			attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaLabels), Data: f.Labels.marshal(nil)})
+		} else {
+			attrs = append(attrs,
+				netfilter.Attribute{Type: uint16(ctaLabels), Data: f.Labels.marshal(f.LabelsMask)},
+				netfilter.Attribute{Type: uint16(ctaLabelsMask), Data: f.LabelsMask.marshal(nil)},
+			)
+		}
+	}
+
+	for _, n := range []struct {
+		nat NAT
+		at  attributeType
+	}{
+		{f.NATSrc, ctaNatSrc},
+		{f.NATDst, ctaNatDst},
+	} {
+		if !n.nat.filled() {
+			continue
+		}
+
+		nat, err := n.nat.marshal(n.at, f.TupleOrig.IP.IsIPv6())
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, nat)
+	}
+
 	return attrs, nil
 }
 
+// family returns the address family of the Flow's original tuple.
+func (f Flow) family() netfilter.ProtoFamily {
+
+	if f.TupleOrig.IP.IsIPv6() {
+		return netfilter.ProtoIPv6
+	}
+
+	return netfilter.ProtoIPv4
+}
+
+// lookup returns a Flow containing only the fields used by the kernel
+// to look up the Flow in the conntrack table.
+func (f Flow) lookup() Flow {
+	return Flow{
+		TupleOrig:  f.TupleOrig,
+		TupleReply: f.TupleReply,
+		Zone:       f.Zone,
+	}
+}
+
 // unmarshalFlow unmarshals a Flow from a netlink.Message.
 // The Message must contain valid attributes.
 func unmarshalFlow(nlm netlink.Message) (Flow, error) {
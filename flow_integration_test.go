@@ -3,8 +3,11 @@
 package conntrack
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
@@ -13,6 +16,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
 )
 
 // Create a given number of flows with a randomized component and check the amount
@@ -195,6 +199,100 @@ func TestConnCreateDeleteFlows(t *testing.T) {
 	assert.Equal(t, 0, len(flows))
 }
 
+// Creates, updates and deletes a large amount of flows in batches, some of which are expected to fail.
+func TestConnBatch(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	numFlows := 10000
+
+	flows := make([]Flow, numFlows)
+	for i := range flows {
+		flows[i] = NewFlow(17, 0, net.IPv4(10, 0, byte(i>>8), byte(i)), net.IPv4(10, 1, 0, 1), 1234, 53, 120, 0)
+	}
+
+	// Missing timeout, rejected before being sent.
+	flows[42].Timeout = 0
+
+	errs, err := c.CreateBatch(flows)
+	require.NoError(t, err, "creating flows")
+	require.Len(t, errs, numFlows)
+
+	for i, err := range errs {
+		if i == 42 {
+			assert.EqualError(t, err, errNeedTimeout.Error())
+			continue
+		}
+		require.NoError(t, err, "creating flow", i)
+	}
+
+	// All creates fail, their acknowledgements carry a copy of the request.
+	flows[42].Timeout = 120
+	errs, err = c.CreateBatch(flows)
+	require.NoError(t, err, "creating existing flows")
+
+	for i, err := range errs {
+		if i == 42 {
+			require.NoError(t, err)
+			continue
+		}
+		opErr, ok := errors.Cause(err).(*netlink.OpError)
+		require.True(t, ok, "flow %d", i)
+		require.EqualError(t, opErr.Err, unix.EEXIST.Error())
+	}
+
+	for i := range flows {
+		flows[i].Mark = uint32(i)
+	}
+
+	errs, err = c.UpdateBatch(flows)
+	require.NoError(t, err, "updating flows")
+	for i, err := range errs {
+		require.NoError(t, err, "updating flow", i)
+	}
+
+	df, err := c.DumpFilter(Filter{Mark: 4242, Mask: 0xffffffff})
+	require.NoError(t, err)
+	require.Len(t, df, 1)
+	assert.True(t, flows[4242].TupleOrig.IP.SourceAddress.Equal(df[0].TupleOrig.IP.SourceAddress))
+
+	// Delete half of the flows, then all of them.
+	errs, err = c.DeleteBatch(flows[:numFlows/2])
+	require.NoError(t, err, "deleting flows")
+	for i, err := range errs {
+		require.NoError(t, err, "deleting flow", i)
+	}
+
+	// Batches shrink to fit their acknowledgements in a small receive buffer.
+	require.NoError(t, c.conn.SetReadBuffer(8192))
+
+	errs, err = c.DeleteBatch(flows)
+	require.NoError(t, err, "deleting flows")
+	for i, err := range errs {
+		if i < numFlows/2 {
+			opErr, ok := errors.Cause(err).(*netlink.OpError)
+			require.True(t, ok, "flow %d", i)
+			require.EqualError(t, opErr.Err, unix.ENOENT.Error())
+			continue
+		}
+		require.NoError(t, err, "deleting flow", i)
+	}
+
+	d, err := c.Dump()
+	require.NoError(t, err)
+	assert.Len(t, d, 0)
+
+	// The Conn is unusable for queries after joining a multicast group.
+	lc, _, err := makeNSConn()
+	require.NoError(t, err)
+	require.NoError(t, lc.joinGroups([]netfilter.NetlinkGroup{netfilter.GroupCTNew}))
+
+	errs, err = lc.CreateBatch(flows[:2])
+	assert.EqualError(t, err, errConnIsMulticast.Error())
+	assert.Equal(t, []error{errConnIsMulticast, errConnIsMulticast}, errs)
+}
+
 // Creates a flow, updates it and checks the result.
 func TestConnCreateUpdateFlow(t *testing.T) {
 
@@ -274,6 +372,45 @@ func TestConnCreateGetFlow(t *testing.T) {
 	}
 }
 
+// Creates flows with source and destination NAT bindings and checks the translated reply tuples.
+func TestConnCreateNAT(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	snat := NewFlow(6, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 1000, 80, 120, 0)
+	snat.NATSrc = NAT{MinIP: net.ParseIP("192.168.0.1"), MinPort: 2000}
+	require.NoError(t, c.Create(snat), "creating source NAT flow")
+
+	qf, err := c.Get(snat)
+	require.NoError(t, err)
+	assert.True(t, qf.Status.SrcNAT())
+	assert.False(t, qf.Status.DstNAT())
+	assert.True(t, net.ParseIP("192.168.0.1").Equal(qf.TupleReply.IP.DestinationAddress))
+	assert.Equal(t, uint16(2000), qf.TupleReply.Proto.DestinationPort)
+
+	dnat := NewFlow(17, 0, net.ParseIP("2a00::1"), net.ParseIP("2a00::ff"), 1000, 53, 120, 0)
+	dnat.NATDst = NAT{
+		MinIP: net.ParseIP("2a00::2"), MaxIP: net.ParseIP("2a00::3"),
+		MinPort: 5353, MaxPort: 5354,
+	}
+	require.NoError(t, c.Create(dnat), "creating destination NAT flow")
+
+	qf, err = c.Get(dnat)
+	require.NoError(t, err)
+	assert.True(t, qf.Status.DstNAT())
+	assert.False(t, qf.Status.SrcNAT())
+	assert.Contains(t, []string{"2a00::2", "2a00::3"}, qf.TupleReply.IP.SourceAddress.String())
+	assert.Contains(t, []uint16{5353, 5354}, qf.TupleReply.Proto.SourcePort)
+
+	// NAT bindings can't be changed after creation.
+	assert.EqualError(t, c.Update(dnat), errUpdateNAT.Error())
+
+	bad := NewFlow(17, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 1000, 53, 120, 0)
+	bad.NATDst = NAT{MinIP: net.ParseIP("2a00::2")}
+	assert.EqualError(t, c.Create(bad), errBadNAT.Error())
+}
+
 // Creates IPv4 and IPv6 flows with connmarks and queries them using a filtered dump.
 func TestConnDumpFilter(t *testing.T) {
 
@@ -314,6 +451,484 @@ func TestConnDumpFilter(t *testing.T) {
 	assert.Len(t, d, len(flows))
 }
 
+// Filters on tuples, zones and status are applied by the kernel when it supports them,
+// and in userspace otherwise. Both must yield the same results.
+func TestConnFilterTuples(t *testing.T) {
+
+	for _, tm := range []struct {
+		name    string
+		support *filterSupport
+	}{
+		{"probed", nil},
+		{"userspace", &filterSupport{}},
+	} {
+		t.Run(tm.name, func(t *testing.T) {
+			testConnFilterTuples(t, tm.support)
+		})
+	}
+}
+
+func testConnFilterTuples(t *testing.T, support *filterSupport) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Override the kernel's filter support to force matching in userspace.
+	if support != nil {
+		c.dumpSupport, c.flushSupport = support, support
+	}
+
+	// Four TCP flows to 10.0.1.1 port 80 or 81 in zone 0 or 1, two UDP flows over IPv6.
+	for i := 1; i <= 4; i++ {
+		f := NewFlow(6, 0, net.IPv4(10, 0, 0, byte(i)), net.IPv4(10, 0, 1, 1), 1000, uint16(80+i%2), 120, 0)
+		f.Zone = uint16(i % 2)
+		require.NoError(t, c.Create(f), "creating flow", i)
+	}
+
+	for i := 1; i <= 2; i++ {
+		f6 := NewFlow(17, 0, net.ParseIP(fmt.Sprintf("2a00::%d", i)), net.ParseIP("2a00::ff"), 1000, 53, 120, 0)
+		require.NoError(t, c.Create(f6), "creating IPv6 flow", i)
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"orig source address", Filter{
+			TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.IPv4(10, 0, 0, 1)}},
+			OrigFlags: FilterSourceAddress,
+		}, 1},
+		{"reply destination address", Filter{
+			TupleReply: Tuple{IP: IPTuple{DestinationAddress: net.IPv4(10, 0, 0, 2)}},
+			ReplyFlags: FilterDestinationAddress,
+		}, 1},
+		{"ipv4 addresses", Filter{
+			TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.IPv4(10, 0, 0, 3), DestinationAddress: net.IPv4(10, 0, 1, 1)}},
+			OrigFlags: FilterAddresses,
+		}, 1},
+		{"ipv6 source address", Filter{
+			TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("2a00::1")}},
+			OrigFlags: FilterSourceAddress,
+		}, 1},
+		{"ipv6 destination address and port", Filter{
+			TupleOrig: Tuple{IP: IPTuple{DestinationAddress: net.ParseIP("2a00::ff")}, Proto: ProtoTuple{Protocol: 17, DestinationPort: 53}},
+			OrigFlags: FilterDestinationAddress | FilterProtocol | FilterDestinationPort,
+		}, 2},
+		{"destination port", Filter{
+			TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 6, DestinationPort: 81}},
+			OrigFlags: FilterProtocol | FilterDestinationPort,
+		}, 2},
+		{"protocol", Filter{
+			TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 17}},
+			OrigFlags: FilterProtocol,
+		}, 2},
+		{"zone", Filter{Zone: 1}, 2},
+		{"zone and address", Filter{
+			Zone:      1,
+			TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.IPv4(10, 0, 0, 2)}},
+			OrigFlags: FilterSourceAddress,
+		}, 0},
+		{"status confirmed", Filter{Status: StatusConfirmed, StatusMask: StatusConfirmed}, 6},
+		{"status assured", Filter{Status: StatusAssured, StatusMask: StatusAssured}, 0},
+		{"family ipv6", Filter{Family: netfilter.ProtoIPv6}, 2},
+		{"family ipv4 and mark", Filter{Family: netfilter.ProtoIPv4, Mark: 0, Mask: 1}, 4},
+		{"family ipv4 and protocol", Filter{
+			Family:    netfilter.ProtoIPv4,
+			TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 17}},
+			OrigFlags: FilterProtocol,
+		}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			df, err := c.DumpFilter(tt.filter)
+			require.NoError(t, err)
+			assert.Len(t, df, tt.want)
+		})
+	}
+
+	// Flush the flows in zone 1, the flow from 10.0.0.2 and the UDP flow from 2a00::2.
+	require.NoError(t, c.FlushFilter(Filter{Zone: 1}))
+	require.NoError(t, c.FlushFilter(Filter{
+		TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.IPv4(10, 0, 0, 2)}},
+		OrigFlags: FilterSourceAddress,
+	}))
+	require.NoError(t, c.FlushFilter(Filter{
+		TupleOrig: Tuple{IP: IPTuple{SourceAddress: net.ParseIP("2a00::2")}, Proto: ProtoTuple{Protocol: 17}},
+		OrigFlags: FilterSourceAddress | FilterProtocol,
+	}))
+
+	d, err := c.Dump()
+	require.NoError(t, err)
+	require.Len(t, d, 2)
+
+	var srcs []string
+	for _, f := range d {
+		srcs = append(srcs, f.TupleOrig.IP.SourceAddress.String())
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.4", "2a00::1"}, srcs)
+
+	// Flush all remaining IPv6 flows.
+	require.NoError(t, c.FlushFilter(Filter{Family: netfilter.ProtoIPv6}))
+
+	d, err = c.Dump()
+	require.NoError(t, err)
+	require.Len(t, d, 1)
+	assert.True(t, net.IPv4(10, 0, 0, 4).Equal(d[0].TupleOrig.IP.SourceAddress))
+}
+
+// Dumps and flushes the Flows of a single address family using a Filter with only its Family set,
+// both on the kernel and on the userspace fallback.
+func TestConnFilterFamily(t *testing.T) {
+
+	for _, userspace := range []bool{false, true} {
+		c, _, err := makeNSConn()
+		require.NoError(t, err)
+
+		if userspace {
+			c.dumpSupport, c.flushSupport = &filterSupport{}, &filterSupport{}
+		}
+
+		for _, f := range []Flow{
+			NewFlow(17, 0, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 1234, 53, 120, 0),
+			NewFlow(6, 0, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 1234, 80, 120, 0),
+			NewFlow(17, 0, net.ParseIP("2a00::1"), net.ParseIP("2a00::2"), 1234, 53, 120, 0),
+		} {
+			require.NoError(t, c.Create(f))
+		}
+
+		v4, v6 := Filter{Family: netfilter.ProtoIPv4}, Filter{Family: netfilter.ProtoIPv6}
+
+		// The Filter is only applied in userspace when the kernel doesn't support it.
+		for _, flush := range []bool{false, true} {
+			_, partial, err := c.kernelFilter(context.Background(), v4, flush)
+			require.NoError(t, err)
+			if !flush || findKsym("ctnetlink_parse_tuple_filter") {
+				assert.Equal(t, userspace, partial, "userspace filtering, flush: %v", flush)
+			}
+		}
+
+		df, err := c.DumpFilter(v6)
+		require.NoError(t, err)
+		require.Len(t, df, 1)
+		assert.Equal(t, netfilter.ProtoIPv6, df[0].family())
+
+		df, err = c.DumpFilter(v4)
+		require.NoError(t, err)
+		assert.Len(t, df, 2)
+
+		require.NoError(t, c.FlushFilter(v4))
+
+		d, err := c.Dump()
+		require.NoError(t, err)
+		require.Len(t, d, 1, "userspace: %v", userspace)
+		assert.Equal(t, netfilter.ProtoIPv6, d[0].family())
+
+		require.NoError(t, c.Close())
+	}
+}
+
+// Creates enough flows to span multiple socket reads and dumps them using DumpFunc,
+// stopping early and making sure the Conn can be used for queries afterwards.
+func TestConnDumpFunc(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	numFlows := 2048
+
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), uint16(i), 80, 120, uint32(i%2))
+		require.NoError(t, c.Create(f), "creating flow", i)
+	}
+
+	var n int
+	err = c.DumpFunc(func(f Flow) bool {
+		n++
+		return true
+	})
+	require.NoError(t, err, "dumping flows")
+	assert.Equal(t, numFlows, n)
+
+	// Stop after the first few Flows.
+	n = 0
+	err = c.DumpFunc(func(f Flow) bool {
+		n++
+		return n < 10
+	})
+	require.NoError(t, err, "dumping flows with early stop")
+	assert.Equal(t, 10, n)
+
+	// Remainder of the previous dump must not leak into the next query.
+	d, err := c.Dump()
+	require.NoError(t, err, "dumping flows")
+	assert.Len(t, d, numFlows)
+
+	if !findKsym("ctnetlink_alloc_filter") {
+		return
+	}
+
+	n = 0
+	err = c.DumpFilterFunc(Filter{Mark: 1, Mask: 1}, func(f Flow) bool {
+		assert.Equal(t, uint32(1), f.Mark)
+		n++
+		return true
+	})
+	require.NoError(t, err, "dumping filtered flows")
+	assert.Equal(t, numFlows/2, n)
+}
+
+// Interrupts dumps using cancelled or expired contexts and makes sure the Conn can
+// be used for queries afterwards.
+func TestConnDumpContext(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	numFlows := 2048
+
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), uint16(i), 80, 120, 0)
+		require.NoError(t, c.CreateContext(context.Background(), f), "creating flow", i)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = c.DumpContext(ctx)
+	require.Equal(t, context.Canceled, err)
+
+	// Cancel the context halfway through the dump.
+	ctx, cancel = context.WithCancel(context.Background())
+	var n int
+	err = c.DumpFuncContext(ctx, func(f Flow) bool {
+		if n++; n == 10 {
+			cancel()
+			// Give the watcher a moment to interrupt the socket.
+			time.Sleep(10 * time.Millisecond)
+		}
+		return true
+	})
+	require.Equal(t, context.Canceled, err)
+	assert.True(t, n < numFlows, "dump was not interrupted")
+
+	d, err := c.Dump()
+	require.NoError(t, err, "dumping flows after interrupted dump")
+	assert.Len(t, d, numFlows)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	_, err = c.StatsGlobalContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// Queries with a deadline that isn't reached succeed.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d, err = c.DumpContext(ctx)
+	require.NoError(t, err, "dumping flows with deadline")
+	assert.Len(t, d, numFlows)
+
+	sg, err := c.StatsGlobalContext(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(numFlows), sg.Entries)
+}
+
+// Creates flows with connmarks and queries them using a counter-zeroing dump and get.
+// Counters can only be incremented by traffic, so this test only validates the queries' results.
+// TestConnZeroCountersTraffic checks they are reset.
+func TestConnZeroCounters(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Expect empty result from empty table dump
+	dz, err := c.DumpZeroCounters(Filter{})
+	require.NoError(t, err, "dumping empty table")
+	require.Len(t, dz, 0, "expecting 0-length dump from empty table")
+
+	flows := []Flow{
+		NewFlow(17, 0, net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8"), 1234, 5678, 120, 0xff00),
+		NewFlow(17, 0, net.ParseIP("2a12:1234:200f:600::200a"), net.ParseIP("2a12:1234:200f:600::200b"), 6554, 53, 120, 0x00ff),
+	}
+
+	for _, f := range flows {
+		err = c.Create(f)
+		require.NoError(t, err, "creating flow", f)
+
+		qf, err := c.GetZeroCounters(f)
+		require.NoError(t, err, "get flow with counter reset", f)
+
+		assert.Equal(t, f.TupleOrig.IP.SourceAddress, qf.TupleOrig.IP.SourceAddress)
+		assert.Equal(t, uint64(0), qf.CountersOrig.Packets)
+	}
+
+	dz, err = c.DumpZeroCounters(Filter{Mark: 0xff00, Mask: 0xff00})
+	require.NoError(t, err, "dumping filtered table with counter reset")
+	require.Len(t, dz, 1)
+	assert.Equal(t, flows[0].TupleOrig.IP.SourceAddress, dz[0].TupleOrig.IP.SourceAddress)
+
+	dz, err = c.DumpZeroCounters(Filter{})
+	require.NoError(t, err, "dumping table with counter reset")
+	assert.Len(t, dz, len(flows))
+
+	// Criteria not applied by the kernel reset the counters of matching flows one by one.
+	c.dumpSupport = &filterSupport{}
+	dz, err = c.DumpZeroCounters(Filter{TupleOrig: Tuple{Proto: ProtoTuple{Protocol: 17, DestinationPort: 53}}, OrigFlags: FilterProtocol | FilterDestinationPort})
+	require.NoError(t, err, "dumping table with counter reset in userspace")
+	require.Len(t, dz, 1)
+	assert.Equal(t, flows[1].TupleOrig.IP.SourceAddress, dz[0].TupleOrig.IP.SourceAddress)
+}
+
+// The kernel's support for filter criteria is probed on first use and cached.
+func TestConnFilterSupport(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	for _, flush := range []bool{false, true} {
+		s, err := c.filterSupport(context.Background(), flush)
+		require.NoError(t, err)
+
+		if findKsym("ctnetlink_parse_tuple_filter") && !flush {
+			assert.True(t, s.tuples, "dump tuple filter support")
+		}
+	}
+
+	assert.NotNil(t, c.dumpSupport)
+	assert.NotNil(t, c.flushSupport)
+
+	// Probes must not have deleted any flows.
+	require.NoError(t, c.Create(NewFlow(6, 0, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 1, 1), 1000, 80, 120, 0)))
+	c.flushSupport = nil
+	_, err = c.filterSupport(context.Background(), true)
+	require.NoError(t, err)
+
+	d, err := c.Dump()
+	require.NoError(t, err)
+	assert.Len(t, d, 1)
+}
+
+// Sends traffic over a tracked connection, and checks its counters are reset after being read.
+func TestConnZeroCountersTraffic(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+	require.NoError(t, trackTraffic(nsid))
+
+	var src, dst *net.UDPAddr
+	var send func(n int) error
+
+	err = inNetNS(nsid, func() error {
+		srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return err
+		}
+
+		cl, err := net.DialUDP("udp4", nil, srv.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			return err
+		}
+
+		src, dst = cl.LocalAddr().(*net.UDPAddr), srv.LocalAddr().(*net.UDPAddr)
+		send = func(n int) error {
+			for i := 0; i < n; i++ {
+				if _, err := cl.Write([]byte("ping")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	f := NewFlow(17, 0, src.IP, dst.IP, uint16(src.Port), uint16(dst.Port), 0, 0)
+
+	require.NoError(t, send(3))
+
+	qf, err := c.GetZeroCounters(f)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), qf.CountersOrig.Packets)
+	assert.NotZero(t, qf.CountersOrig.Bytes)
+
+	qf, err = c.Get(f)
+	require.NoError(t, err)
+	assert.Zero(t, qf.CountersOrig.Packets, "counters not reset by GetZeroCounters")
+	assert.Zero(t, qf.CountersOrig.Bytes)
+
+	require.NoError(t, send(2))
+
+	dz, err := c.DumpZeroCounters(Filter{})
+	require.NoError(t, err)
+	require.Len(t, dz, 1)
+	assert.Equal(t, uint64(2), dz[0].CountersOrig.Packets)
+
+	qf, err = c.Get(f)
+	require.NoError(t, err)
+	assert.Zero(t, qf.CountersOrig.Packets, "counters not reset by DumpZeroCounters")
+}
+
+// Creates and deletes flows while a listener with a full socket buffer refuses their destroy events.
+// The undelivered flows are expected to show up in a dump of the dying list.
+func TestConnDumpDying(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Expect empty result from empty dying list
+	dd, err := c.DumpDying()
+	require.NoError(t, err, "dumping empty dying list")
+	require.Len(t, dd, 0, "expecting 0-length dump from empty dying list")
+
+	// Create a listener that never reads from its socket. With BroadcastError enabled,
+	// the kernel holds on to flows of which the destroy event could not be delivered.
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	require.NoError(t, lc.SetOption(netlink.BroadcastError, true))
+	require.NoError(t, lc.joinGroups([]netfilter.NetlinkGroup{netfilter.GroupCTDestroy}))
+
+	numFlows := 4096
+
+	var f Flow
+	for i := 1; i <= numFlows; i++ {
+		f = NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, uint16(i), 120, 0)
+
+		err = c.Create(f)
+		require.NoError(t, err, "creating flow", i)
+	}
+
+	require.NoError(t, c.Flush(), "flushing table")
+
+	dd, err = c.DumpDying()
+	require.NoError(t, err, "dumping dying list")
+	require.NotEmpty(t, dd, "expecting undelivered flows on the dying list")
+
+	for _, df := range dd {
+		assert.True(t, df.TupleOrig.IP.SourceAddress.Equal(net.IPv4(1, 2, 3, 4)))
+	}
+
+	// Closing the listener allows the kernel to deliver (and drop) the remaining events.
+	require.NoError(t, lc.Close())
+}
+
+func TestConnDumpUnconfirmed(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Unconfirmed connections only exist for a brief moment while a packet traverses
+	// the stack, so there is nothing in the list when no traffic flows in the namespace.
+	du, err := c.DumpUnconfirmed()
+	require.NoError(t, err, "dumping unconfirmed list")
+	assert.Len(t, du, 0)
+}
+
 // Bench scenario that calls Conn.Create and Conn.Delete on the same Flow once per iteration.
 // This includes two marshaling operations for create/delete, two syscalls and output validation.
 func BenchmarkCreateDeleteFlow(b *testing.B) {
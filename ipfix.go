@@ -0,0 +1,324 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IPFIX message format constants, see RFC 7011.
+const (
+	ipfixVersion       = 10
+	ipfixHeaderLen     = 16
+	ipfixTemplateSetID = 2
+
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+
+	// Private Enterprise Number of the reverse direction information elements
+	// of bidirectional flows, see RFC 5103.
+	ipfixReversePEN = 29305
+)
+
+// IPFIXConfig holds the options of an IPFIXExporter. The zero value uses the defaults.
+type IPFIXConfig struct {
+	// ObservationDomainID identifies the exporter's observation domain to the collector.
+	ObservationDomainID uint32
+
+	// TemplateRefresh is the interval at which the templates are sent again over UDP, so
+	// collectors that (re)started after they were first sent can decode the records.
+	// Defaults to 10 minutes. Over TCP, the templates are only sent once.
+	TemplateRefresh time.Duration
+
+	// MaxMessageSize is the maximum size of an IPFIX message. Defaults to 1400 bytes,
+	// so a UDP datagram fits in an Ethernet frame.
+	MaxMessageSize int
+
+	// The mark of the Flows is exported as the enterprise-specific information element
+	// MarkElementID of the Private Enterprise Number MarkEnterpriseNumber. The mark is
+	// not exported when MarkEnterpriseNumber is zero. MarkElementID defaults to 1.
+	MarkEnterpriseNumber uint32
+	MarkElementID        uint16
+}
+
+// IPFIXExporter exports the Records of connections to an IPFIX (RFC 7011) collector over
+// UDP or TCP. It is a RecordSink, so it can export the Records built by an Aggregator.
+//
+// Records are exported as bidirectional flows (RFC 5103). The original tuple is exported in
+// the source and destination address and port elements, with the counters of the original
+// direction in octetDeltaCount and packetDeltaCount, and those of the reply direction in their
+// reverse elements. The addresses and ports of the original direction after NAT are derived
+// from the reply tuple, and are equal to the original ones for Flows without NAT.
+// The Flow's ID is exported as flowId.
+//
+// IPFIX has no standard information element for the connection mark, so the mark is left out
+// by default. Set IPFIXConfig.MarkEnterpriseNumber to export it as an enterprise-specific element.
+//
+// IPv4 and IPv6 Records use separate templates. The templates are sent in the first message,
+// and are refreshed periodically when exporting over UDP.
+type IPFIXExporter struct {
+	conn     net.Conn
+	datagram bool
+
+	domain  uint32
+	refresh time.Duration
+	size    int
+
+	templates [2]exportTemplate
+
+	now func() time.Time
+
+	mu            sync.Mutex
+	seq           uint32
+	templatesSent time.Time
+}
+
+// DialIPFIX connects to the IPFIX collector at address, see net.Dial, and returns an
+// IPFIXExporter that exports Records to it. network must be one of the UDP or TCP networks.
+// A nil config uses the defaults.
+func DialIPFIX(network, address string, config *IPFIXConfig) (*IPFIXExporter, error) {
+
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := NewIPFIXExporter(c, config)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// NewIPFIXExporter returns an IPFIXExporter that exports Records over conn. Each message is
+// written with a single call to conn.Write, so a UDP conn sends one message per datagram.
+// A nil config uses the defaults.
+func NewIPFIXExporter(conn net.Conn, config *IPFIXConfig) (*IPFIXExporter, error) {
+
+	var cfg IPFIXConfig
+	if config != nil {
+		cfg = *config
+	}
+
+	if cfg.TemplateRefresh == 0 {
+		cfg.TemplateRefresh = exportDefaultTemplateRefresh
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = exportDefaultMessageSize
+	}
+	if cfg.MarkElementID == 0 {
+		cfg.MarkElementID = 1
+	}
+
+	e := &IPFIXExporter{
+		conn:     conn,
+		datagram: isDatagram(conn),
+		domain:   cfg.ObservationDomainID,
+		refresh:  cfg.TemplateRefresh,
+		size:     cfg.MaxMessageSize,
+		now:      time.Now,
+	}
+
+	e.templates = ipfixTemplates(cfg)
+
+	// The first message holds the templates and a record of the largest template.
+	min := ipfixHeaderLen + exportSetHeaderLen + exportSetHeaderLen
+	for _, t := range e.templates {
+		min += t.ipfixLen()
+	}
+	min += e.templates[1].length
+
+	if e.size < min || e.size > 0xffff {
+		return nil, errExportMessageSize
+	}
+
+	return e, nil
+}
+
+// Close closes the IPFIXExporter's connection.
+func (e *IPFIXExporter) Close() error {
+	return e.conn.Close()
+}
+
+// WriteRecord exports a single Record.
+func (e *IPFIXExporter) WriteRecord(r Record) error {
+	return e.Export(r)
+}
+
+// ExportFlow exports the Flow of a destroy event. The start and end of the Flow are taken
+// from its Timestamp. When the kernel did not report it, both are set to the current time.
+func (e *IPFIXExporter) ExportFlow(f Flow) error {
+
+	r := newRecord(f, NSIDLocal)
+
+	if r.Stop.IsZero() {
+		r.Stop = e.now()
+	}
+	if r.Start.IsZero() {
+		r.Start = r.Stop
+	}
+
+	return e.Export(r)
+}
+
+// Export exports the given Records, in as few messages as possible.
+func (e *IPFIXExporter) Export(records ...Record) error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+
+	m := e.newMessage(now)
+	for i := range records {
+		t := &e.templates[0]
+		if !isIPv4(records[i].TupleOrig) {
+			t = &e.templates[1]
+		}
+
+		if !m.fits(t, e.size) {
+			if err := e.send(m, now); err != nil {
+				return err
+			}
+			m = e.newMessage(now)
+		}
+
+		m.add(t, &records[i])
+	}
+
+	if m.records == 0 {
+		return nil
+	}
+
+	return e.send(m, now)
+}
+
+// newMessage starts a message, holding the templates when they need to be sent.
+func (e *IPFIXExporter) newMessage(now time.Time) *exportMessage {
+
+	m := &exportMessage{
+		b:   make([]byte, ipfixHeaderLen, e.size),
+		set: -1,
+	}
+
+	if e.templatesSent.IsZero() || (e.datagram && now.Sub(e.templatesSent) >= e.refresh) {
+		m.templates = true
+		m.startSet(ipfixTemplateSetID)
+		for _, t := range e.templates {
+			m.b = t.appendIPFIX(m.b)
+		}
+	}
+
+	return m
+}
+
+// send completes the header of a message and writes it to the connection.
+func (e *IPFIXExporter) send(m *exportMessage, now time.Time) error {
+
+	m.endSet()
+
+	binary.BigEndian.PutUint16(m.b[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(m.b[2:4], uint16(len(m.b)))
+	binary.BigEndian.PutUint32(m.b[4:8], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(m.b[8:12], e.seq)
+	binary.BigEndian.PutUint32(m.b[12:16], e.domain)
+
+	if _, err := e.conn.Write(m.b); err != nil {
+		return errors.Wrap(err, opExportIPFIX)
+	}
+
+	// The sequence number counts the data records sent before a message.
+	e.seq += m.records
+	if m.templates {
+		e.templatesSent = now
+	}
+
+	return nil
+}
+
+// ipfixTemplates returns the IPv4 and IPv6 templates of IPFIX messages.
+func ipfixTemplates(cfg IPFIXConfig) [2]exportTemplate {
+
+	common := []exportField{
+		{id: ieFlowID, length: 8, put: putFlowID},
+		{id: ieProtocolIdentifier, length: 1, put: putProtocol},
+		{id: ieSourceTransportPort, length: 2, put: putSourcePort},
+		{id: ieDestinationTransportPort, length: 2, put: putDestinationPort},
+		{id: iePostNAPTSourceTransportPort, length: 2, put: putPostNATSourcePort},
+		{id: iePostNAPTDestinationTransportPort, length: 2, put: putPostNATDestinationPort},
+		{id: ieOctetDeltaCount, length: 8, put: putOctetsOrig},
+		{id: iePacketDeltaCount, length: 8, put: putPacketsOrig},
+		{id: ieOctetDeltaCount, enterprise: ipfixReversePEN, length: 8, put: putOctetsReply},
+		{id: iePacketDeltaCount, enterprise: ipfixReversePEN, length: 8, put: putPacketsReply},
+		{id: ieFlowStartMilliseconds, length: 8, put: putStartMilliseconds},
+		{id: ieFlowEndMilliseconds, length: 8, put: putEndMilliseconds},
+	}
+
+	if cfg.MarkEnterpriseNumber != 0 {
+		common = append(common, exportField{
+			id: cfg.MarkElementID, enterprise: cfg.MarkEnterpriseNumber, length: 4, put: putMark,
+		})
+	}
+
+	v4 := []exportField{
+		{id: ieSourceIPv4Address, length: 4, put: putSourceAddress},
+		{id: ieDestinationIPv4Address, length: 4, put: putDestinationAddress},
+		{id: iePostNATSourceIPv4Address, length: 4, put: putPostNATSourceAddress},
+		{id: iePostNATDestinationIPv4Address, length: 4, put: putPostNATDestinationAddress},
+		{id: ieICMPTypeCodeIPv4, length: 2, put: putICMPTypeCode},
+	}
+
+	v6 := []exportField{
+		{id: ieSourceIPv6Address, length: 16, put: putSourceAddress},
+		{id: ieDestinationIPv6Address, length: 16, put: putDestinationAddress},
+		{id: iePostNATSourceIPv6Address, length: 16, put: putPostNATSourceAddress},
+		{id: iePostNATDestinationIPv6Address, length: 16, put: putPostNATDestinationAddress},
+		{id: ieICMPTypeCodeIPv6, length: 2, put: putICMPTypeCode},
+	}
+
+	return [2]exportTemplate{
+		newExportTemplate(ipfixTemplateIPv4, append(v4, common...)),
+		newExportTemplate(ipfixTemplateIPv6, append(v6, common...)),
+	}
+}
+
+// ipfixLen returns the length of the template's IPFIX template record.
+func (t exportTemplate) ipfixLen() int {
+
+	l := 4
+	for _, f := range t.fields {
+		l += 4
+		if f.enterprise != 0 {
+			l += 4
+		}
+	}
+
+	return l
+}
+
+// appendIPFIX appends the template's IPFIX template record to b.
+func (t exportTemplate) appendIPFIX(b []byte) []byte {
+
+	b = appendUint16(b, t.id)
+	b = appendUint16(b, uint16(len(t.fields)))
+
+	for _, f := range t.fields {
+		if f.enterprise == 0 {
+			b = appendUint16(b, f.id)
+			b = appendUint16(b, f.length)
+			continue
+		}
+
+		// The enterprise bit is followed by the Private Enterprise Number.
+		b = appendUint16(b, f.id|0x8000)
+		b = appendUint16(b, f.length)
+		b = appendUint32(b, f.enterprise)
+	}
+
+	return b
+}
@@ -0,0 +1,292 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ipfixElement identifies an information element in a decoded IPFIX data record.
+type ipfixElement struct {
+	id         uint16
+	enterprise uint32
+}
+
+// ipfixField is an element of a decoded IPFIX template.
+type ipfixField struct {
+	ipfixElement
+	length int
+}
+
+// ipfixMessage is a decoded IPFIX message.
+type ipfixMessage struct {
+	version, length uint16
+	exportTime, seq uint32
+	domain          uint32
+
+	templates map[uint16][]ipfixField
+	records   []map[ipfixElement][]byte
+}
+
+// decodeIPFIX decodes an IPFIX message, using and adding to the given templates.
+func decodeIPFIX(t *testing.T, b []byte, templates map[uint16][]ipfixField) ipfixMessage {
+
+	t.Helper()
+
+	require.True(t, len(b) >= ipfixHeaderLen)
+
+	m := ipfixMessage{
+		version:    binary.BigEndian.Uint16(b[0:2]),
+		length:     binary.BigEndian.Uint16(b[2:4]),
+		exportTime: binary.BigEndian.Uint32(b[4:8]),
+		seq:        binary.BigEndian.Uint32(b[8:12]),
+		domain:     binary.BigEndian.Uint32(b[12:16]),
+		templates:  make(map[uint16][]ipfixField),
+	}
+	require.Equal(t, int(m.length), len(b))
+
+	for b = b[ipfixHeaderLen:]; len(b) > 0; {
+		id := binary.BigEndian.Uint16(b[0:2])
+		l := int(binary.BigEndian.Uint16(b[2:4]))
+		require.True(t, l >= exportSetHeaderLen && l <= len(b))
+
+		set := b[exportSetHeaderLen:l]
+		b = b[l:]
+
+		if id == ipfixTemplateSetID {
+			for len(set) > 0 {
+				tid := binary.BigEndian.Uint16(set[0:2])
+				n := int(binary.BigEndian.Uint16(set[2:4]))
+				set = set[4:]
+
+				var els []ipfixField
+				for i := 0; i < n; i++ {
+					el := ipfixField{
+						ipfixElement: ipfixElement{id: binary.BigEndian.Uint16(set[0:2])},
+						length:       int(binary.BigEndian.Uint16(set[2:4])),
+					}
+					set = set[4:]
+					if el.id&0x8000 != 0 {
+						el.id &^= 0x8000
+						el.enterprise = binary.BigEndian.Uint32(set[0:4])
+						set = set[4:]
+					}
+					els = append(els, el)
+				}
+
+				m.templates[tid] = els
+				templates[tid] = els
+			}
+			continue
+		}
+
+		tmpl, ok := templates[id]
+		require.True(t, ok, "data set of unknown template %d", id)
+
+		for len(set) > 0 {
+			rec := make(map[ipfixElement][]byte)
+			for _, el := range tmpl {
+				rec[el.ipfixElement] = set[:el.length]
+				set = set[el.length:]
+			}
+			m.records = append(m.records, rec)
+		}
+	}
+
+	return m
+}
+
+func testRecords() []Record {
+
+	f := NewFlow(6, 0, net.IPv4(10, 0, 0, 1), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 7)
+	f.ID = 1
+	f.CountersOrig = Counter{Packets: 10, Bytes: 1000}
+	f.CountersReply = Counter{Direction: true, Packets: 20, Bytes: 2000}
+	f.Timestamp = Timestamp{Start: time.Unix(100, 0), Stop: time.Unix(105, 500000000)}
+
+	// Source NAT to 192.0.2.1:40000.
+	f.TupleReply.IP.DestinationAddress = net.IPv4(192, 0, 2, 1)
+	f.TupleReply.Proto.DestinationPort = 40000
+
+	g := NewFlow(17, 0, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 53, 5353, 120, 0)
+	g.ID = 2
+
+	return []Record{newRecord(f, NSIDLocal), newRecord(g, NSIDLocal)}
+}
+
+func TestIPFIXExporterUDP(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	e, err := DialIPFIX("udp", pc.LocalAddr().String(), &IPFIXConfig{
+		ObservationDomainID:  42,
+		MarkEnterpriseNumber: 99999,
+		MarkElementID:        5,
+	})
+	require.NoError(t, err)
+	defer e.Close()
+
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	require.NoError(t, e.Export(testRecords()...))
+
+	buf := make([]byte, 65535)
+	templates := make(map[uint16][]ipfixField)
+
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	m := decodeIPFIX(t, buf[:n], templates)
+
+	assert.Equal(t, uint16(ipfixVersion), m.version)
+	assert.Equal(t, uint32(1000), m.exportTime)
+	assert.Equal(t, uint32(0), m.seq)
+	assert.Equal(t, uint32(42), m.domain)
+	assert.Len(t, m.templates, 2)
+	require.Len(t, m.records, 2)
+
+	mark := ipfixElement{id: 5, enterprise: 99999}
+	revOctets := ipfixElement{id: ieOctetDeltaCount, enterprise: ipfixReversePEN}
+
+	r := m.records[0]
+	assert.Equal(t, []byte{10, 0, 0, 1}, r[ipfixElement{id: ieSourceIPv4Address}])
+	assert.Equal(t, []byte{5, 6, 7, 8}, r[ipfixElement{id: ieDestinationIPv4Address}])
+	assert.Equal(t, []byte{192, 0, 2, 1}, r[ipfixElement{id: iePostNATSourceIPv4Address}])
+	assert.Equal(t, []byte{5, 6, 7, 8}, r[ipfixElement{id: iePostNATDestinationIPv4Address}])
+	assert.Equal(t, uint16(40000), binary.BigEndian.Uint16(r[ipfixElement{id: iePostNAPTSourceTransportPort}]))
+	assert.Equal(t, uint16(80), binary.BigEndian.Uint16(r[ipfixElement{id: ieDestinationTransportPort}]))
+	assert.Equal(t, []byte{6}, r[ipfixElement{id: ieProtocolIdentifier}])
+	assert.Equal(t, uint64(1000), binary.BigEndian.Uint64(r[ipfixElement{id: ieOctetDeltaCount}]))
+	assert.Equal(t, uint64(2000), binary.BigEndian.Uint64(r[revOctets]))
+	assert.Equal(t, uint64(100000), binary.BigEndian.Uint64(r[ipfixElement{id: ieFlowStartMilliseconds}]))
+	assert.Equal(t, uint64(105500), binary.BigEndian.Uint64(r[ipfixElement{id: ieFlowEndMilliseconds}]))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(r[mark]))
+	assert.Equal(t, uint64(1), binary.BigEndian.Uint64(r[ipfixElement{id: ieFlowID}]))
+
+	r = m.records[1]
+	assert.Equal(t, net.ParseIP("2001:db8::1"), net.IP(r[ipfixElement{id: ieSourceIPv6Address}]))
+	assert.Equal(t, net.ParseIP("2001:db8::2"), net.IP(r[ipfixElement{id: iePostNATDestinationIPv6Address}]))
+
+	// Templates are not sent again until they need to be refreshed.
+	require.NoError(t, e.Export(testRecords()[0]))
+	n, _, err = pc.ReadFrom(buf)
+	require.NoError(t, err)
+	m = decodeIPFIX(t, buf[:n], templates)
+
+	assert.Equal(t, uint32(2), m.seq)
+	assert.Empty(t, m.templates)
+	assert.Len(t, m.records, 1)
+
+	now = now.Add(exportDefaultTemplateRefresh)
+	require.NoError(t, e.Export(testRecords()[1]))
+	n, _, err = pc.ReadFrom(buf)
+	require.NoError(t, err)
+	m = decodeIPFIX(t, buf[:n], templates)
+
+	assert.Equal(t, uint32(3), m.seq)
+	assert.Len(t, m.templates, 2)
+	assert.Len(t, m.records, 1)
+}
+
+func TestIPFIXExporterNoMark(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	buf := make([]byte, 65535)
+
+	// The mark is only exported when its Private Enterprise Number is set.
+	for _, config := range []*IPFIXConfig{nil, {}, {MarkElementID: 5}} {
+		e, err := DialIPFIX("udp", pc.LocalAddr().String(), config)
+		require.NoError(t, err)
+
+		require.NoError(t, e.Export(testRecords()...))
+		require.NoError(t, e.Close())
+
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		m := decodeIPFIX(t, buf[:n], make(map[uint16][]ipfixField))
+
+		require.Len(t, m.templates, 2)
+		for _, tmpl := range m.templates {
+			for _, f := range tmpl {
+				assert.Contains(t, []uint32{0, ipfixReversePEN}, f.enterprise)
+			}
+		}
+		assert.Len(t, m.records, 2)
+	}
+}
+
+func TestIPFIXExporterTCP(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	e, err := DialIPFIX("tcp", ln.Addr().String(), &IPFIXConfig{MaxMessageSize: 512})
+	require.NoError(t, err)
+
+	c, err := ln.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Split many records over multiple messages.
+	var recs []Record
+	for i := 0; i < 20; i++ {
+		recs = append(recs, testRecords()...)
+	}
+	require.NoError(t, e.Export(recs...))
+	require.NoError(t, e.Close())
+
+	templates := make(map[uint16][]ipfixField)
+
+	var msgs []ipfixMessage
+	for {
+		hdr := make([]byte, ipfixHeaderLen)
+		if _, err := io.ReadFull(c, hdr); err == io.EOF {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+
+		b := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+		copy(b, hdr)
+		_, err := io.ReadFull(c, b[ipfixHeaderLen:])
+		require.NoError(t, err)
+
+		require.True(t, len(b) <= 512)
+		msgs = append(msgs, decodeIPFIX(t, b, templates))
+	}
+
+	require.True(t, len(msgs) > 1)
+
+	// Over TCP, templates are only sent in the first message.
+	var seq uint32
+	for i, m := range msgs {
+		assert.Equal(t, i == 0, len(m.templates) > 0)
+		assert.Equal(t, seq, m.seq)
+		seq += uint32(len(m.records))
+	}
+	assert.Equal(t, uint32(len(recs)), seq)
+}
+
+func TestIPFIXExporterMessageSize(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	_, err = DialIPFIX("udp", pc.LocalAddr().String(), &IPFIXConfig{MaxMessageSize: 100})
+	assert.Equal(t, errExportMessageSize, err)
+
+	_, err = DialIPFIX("udp", pc.LocalAddr().String(), &IPFIXConfig{MaxMessageSize: 1 << 16})
+	assert.Equal(t, errExportMessageSize, err)
+}
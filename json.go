@@ -0,0 +1,917 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// JSONVersion is the version of the JSON schema of Flows, Expects, Events and Stats.
+// Every encoded object carries it in its version field, except Flows and Expects nested
+// in an Event. The version is incremented when a field is removed, renamed or changes its
+// meaning. Fields can be added without incrementing it.
+//
+// Decoding fails on objects of other versions. Objects without a version field, eg. written
+// by hand, are decoded as the current version.
+const JSONVersion = 1
+
+// MarshalJSON encodes a Flow as a JSON object of schema JSONVersion. Fields that are zero
+// are omitted, which keeps the objects of Flows received in events small. For example:
+//
+//	{
+//	  "version": 1,
+//	  "id": 3735928559,
+//	  "timeout": 431999,
+//	  "start": "2026-10-17T09:41:07.12345Z",
+//	  "status": ["SEEN_REPLY", "ASSURED", "CONFIRMED"],
+//	  "orig": {"src": "10.0.0.1", "dst": "192.0.2.1", "protocol": "tcp", "sport": 40000, "dport": 443},
+//	  "reply": {"src": "192.0.2.1", "dst": "10.0.0.1", "protocol": "tcp", "sport": 443, "dport": 40000},
+//	  "tcp": {"state": "ESTABLISHED", "wscale_orig": 7, "wscale_reply": 7, "flags_orig": 8995, "flags_reply": 8995},
+//	  "counters_orig": {"packets": 12, "bytes": 1745},
+//	  "counters_reply": {"packets": 10, "bytes": 6214},
+//	  "labels": [1, 3],
+//	  "mark": 42,
+//	  "use": 1
+//	}
+//
+// Addresses are written in their text form, protocols by their name in /etc/protocols,
+// and status flags and TCP states by their names in the kernel without the IPS_ and
+// TCP_CONNTRACK_ prefixes. Protocols, status flags and TCP states without a name are
+// written as decimal numbers in a string. Timestamps are written in RFC 3339 format in UTC,
+// with nanoseconds. Labels are written as the list of the label bits that are set, and the
+// info of the Helper as base64, like other binary data in JSON. Labels without any bit set
+// are written as an empty list, so an Update clearing all labels keeps its meaning, and
+// are only left out when nil.
+//
+// The other fields are named after the Flow's fields: id, timeout, start, stop, status,
+// orig, reply, master, tcp, dccp, sctp, helper, zone, counters_orig, counters_reply,
+// secctx, seqadj_orig, seqadj_reply, labels, labels_mask, mark, use, synproxy,
+// nat_src and nat_dst. Tuples hold src, dst, protocol, sport, dport, icmp_id, icmp_type,
+// icmp_code and zone.
+func (f Flow) MarshalJSON() ([]byte, error) {
+
+	jf := newJSONFlow(f)
+	jf.Version = JSONVersion
+
+	return json.Marshal(jf)
+}
+
+// UnmarshalJSON decodes a Flow encoded by MarshalJSON. The Flow can be used to create or
+// update a connection in the table. Timestamps are decoded in the local time zone, like
+// those of Flows received from the kernel.
+func (f *Flow) UnmarshalJSON(b []byte) error {
+
+	var jf jsonFlow
+	if err := json.Unmarshal(b, &jf); err != nil {
+		return err
+	}
+
+	if err := checkJSONVersion(jf.Version); err != nil {
+		return err
+	}
+
+	nf, err := jf.flow()
+	if err != nil {
+		return err
+	}
+
+	*f = nf
+
+	return nil
+}
+
+// MarshalJSON encodes an Expect as a JSON object of schema JSONVersion, with the fields id,
+// timeout, master, tuple, mask, zone, helper, function, flags, class and nat. Tuples are
+// encoded like those of a Flow, see Flow.MarshalJSON. The nat object holds a tuple, and
+// reply, which is true when the NAT applies to the reply direction.
+func (ex Expect) MarshalJSON() ([]byte, error) {
+
+	je := newJSONExpect(ex)
+	je.Version = JSONVersion
+
+	return json.Marshal(je)
+}
+
+// UnmarshalJSON decodes an Expect encoded by MarshalJSON.
+func (ex *Expect) UnmarshalJSON(b []byte) error {
+
+	var je jsonExpect
+	if err := json.Unmarshal(b, &je); err != nil {
+		return err
+	}
+
+	if err := checkJSONVersion(je.Version); err != nil {
+		return err
+	}
+
+	ne, err := je.expect()
+	if err != nil {
+		return err
+	}
+
+	*ex = ne
+
+	return nil
+}
+
+// MarshalJSON encodes an Event as a JSON object of schema JSONVersion. It holds the type of
+// the Event by name, eg. NEW, UPDATE, DESTROY, EXP_NEW or RESYNC, the nsid, and the flow or
+// expect of the Event, encoded like Flow.MarshalJSON and Expect.MarshalJSON without their
+// version. The nsid is always written, since 0 is a valid NSID.
+func (e Event) MarshalJSON() ([]byte, error) {
+
+	je := jsonEvent{
+		Version: JSONVersion,
+		Type:    e.Type.name(),
+		NSID:    e.NSID,
+	}
+
+	if e.Flow != nil {
+		jf := newJSONFlow(*e.Flow)
+		je.Flow = &jf
+	}
+
+	if e.Expect != nil {
+		jx := newJSONExpect(*e.Expect)
+		je.Expect = &jx
+	}
+
+	return json.Marshal(je)
+}
+
+// UnmarshalJSON decodes an Event encoded by MarshalJSON.
+func (e *Event) UnmarshalJSON(b []byte) error {
+
+	var je jsonEvent
+	if err := json.Unmarshal(b, &je); err != nil {
+		return err
+	}
+
+	if err := checkJSONVersion(je.Version); err != nil {
+		return err
+	}
+
+	ne := Event{NSID: je.NSID}
+
+	if err := ne.Type.parse(je.Type); err != nil {
+		return err
+	}
+
+	if je.Flow != nil {
+		f, err := je.Flow.flow()
+		if err != nil {
+			return err
+		}
+		ne.Flow = &f
+	}
+
+	if je.Expect != nil {
+		ex, err := je.Expect.expect()
+		if err != nil {
+			return err
+		}
+		ne.Expect = &ex
+	}
+
+	*e = ne
+
+	return nil
+}
+
+// MarshalJSON encodes Stats as a JSON object of schema JSONVersion, with the fields cpu,
+// found, invalid, ignore, insert, insert_failed, drop, early_drop, error and search_restart.
+// Unlike the fields of Flows, counters that are zero are written.
+func (s Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonStats{
+		Version:       JSONVersion,
+		CPUID:         s.CPUID,
+		Found:         s.Found,
+		Invalid:       s.Invalid,
+		Ignore:        s.Ignore,
+		Insert:        s.Insert,
+		InsertFailed:  s.InsertFailed,
+		Drop:          s.Drop,
+		EarlyDrop:     s.EarlyDrop,
+		Error:         s.Error,
+		SearchRestart: s.SearchRestart,
+	})
+}
+
+// UnmarshalJSON decodes Stats encoded by MarshalJSON.
+func (s *Stats) UnmarshalJSON(b []byte) error {
+
+	var js jsonStats
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+
+	if err := checkJSONVersion(js.Version); err != nil {
+		return err
+	}
+
+	*s = Stats{
+		CPUID:         js.CPUID,
+		Found:         js.Found,
+		Invalid:       js.Invalid,
+		Ignore:        js.Ignore,
+		Insert:        js.Insert,
+		InsertFailed:  js.InsertFailed,
+		Drop:          js.Drop,
+		EarlyDrop:     js.EarlyDrop,
+		Error:         js.Error,
+		SearchRestart: js.SearchRestart,
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes StatsExpect as a JSON object of schema JSONVersion, with the fields
+// cpu, new, create and delete.
+func (se StatsExpect) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonStatsExpect{
+		Version: JSONVersion,
+		CPUID:   se.CPUID,
+		New:     se.New,
+		Create:  se.Create,
+		Delete:  se.Delete,
+	})
+}
+
+// UnmarshalJSON decodes StatsExpect encoded by MarshalJSON.
+func (se *StatsExpect) UnmarshalJSON(b []byte) error {
+
+	var js jsonStatsExpect
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+
+	if err := checkJSONVersion(js.Version); err != nil {
+		return err
+	}
+
+	*se = StatsExpect{CPUID: js.CPUID, New: js.New, Create: js.Create, Delete: js.Delete}
+
+	return nil
+}
+
+// MarshalJSON encodes StatsGlobal as a JSON object of schema JSONVersion, with the fields
+// entries and max_entries.
+func (sg StatsGlobal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonStatsGlobal{
+		Version:    JSONVersion,
+		Entries:    sg.Entries,
+		MaxEntries: sg.MaxEntries,
+	})
+}
+
+// UnmarshalJSON decodes StatsGlobal encoded by MarshalJSON.
+func (sg *StatsGlobal) UnmarshalJSON(b []byte) error {
+
+	var js jsonStatsGlobal
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+
+	if err := checkJSONVersion(js.Version); err != nil {
+		return err
+	}
+
+	*sg = StatsGlobal{Entries: js.Entries, MaxEntries: js.MaxEntries}
+
+	return nil
+}
+
+// checkJSONVersion returns an error if v is not the current JSONVersion.
+// A missing version is taken as the current one.
+func checkJSONVersion(v int) error {
+
+	if v != 0 && v != JSONVersion {
+		return fmt.Errorf(errJSONVersion, v, JSONVersion)
+	}
+
+	return nil
+}
+
+// jsonFlow is the JSON representation of a Flow.
+type jsonFlow struct {
+	Version int `json:"version,omitempty"`
+
+	ID      uint32 `json:"id,omitempty"`
+	Timeout uint32 `json:"timeout,omitempty"`
+	Start   string `json:"start,omitempty"`
+	Stop    string `json:"stop,omitempty"`
+
+	Status []string `json:"status,omitempty"`
+
+	TupleOrig   *jsonTuple `json:"orig,omitempty"`
+	TupleReply  *jsonTuple `json:"reply,omitempty"`
+	TupleMaster *jsonTuple `json:"master,omitempty"`
+
+	TCP  *jsonProtoInfoTCP  `json:"tcp,omitempty"`
+	DCCP *jsonProtoInfoDCCP `json:"dccp,omitempty"`
+	SCTP *jsonProtoInfoSCTP `json:"sctp,omitempty"`
+
+	Helper *jsonHelper `json:"helper,omitempty"`
+
+	Zone uint16 `json:"zone,omitempty"`
+
+	CountersOrig  *jsonCounter `json:"counters_orig,omitempty"`
+	CountersReply *jsonCounter `json:"counters_reply,omitempty"`
+
+	SecurityContext Security `json:"secctx,omitempty"`
+
+	SeqAdjOrig  *jsonSequenceAdjust `json:"seqadj_orig,omitempty"`
+	SeqAdjReply *jsonSequenceAdjust `json:"seqadj_reply,omitempty"`
+
+	Labels     *[]uint `json:"labels,omitempty"`
+	LabelsMask *[]uint `json:"labels_mask,omitempty"`
+
+	Mark uint32 `json:"mark,omitempty"`
+	Use  uint32 `json:"use,omitempty"`
+
+	SynProxy *jsonSynProxy `json:"synproxy,omitempty"`
+
+	NATSrc *jsonNAT `json:"nat_src,omitempty"`
+	NATDst *jsonNAT `json:"nat_dst,omitempty"`
+}
+
+// jsonTuple is the JSON representation of a Tuple.
+type jsonTuple struct {
+	SourceAddress      net.IP `json:"src,omitempty"`
+	DestinationAddress net.IP `json:"dst,omitempty"`
+
+	Protocol        string `json:"protocol,omitempty"`
+	SourcePort      uint16 `json:"sport,omitempty"`
+	DestinationPort uint16 `json:"dport,omitempty"`
+
+	ICMPID   uint16 `json:"icmp_id,omitempty"`
+	ICMPType uint8  `json:"icmp_type,omitempty"`
+	ICMPCode uint8  `json:"icmp_code,omitempty"`
+
+	Zone uint16 `json:"zone,omitempty"`
+}
+
+// jsonProtoInfoTCP is the JSON representation of a ProtoInfoTCP.
+type jsonProtoInfoTCP struct {
+	State               string `json:"state"`
+	OriginalWindowScale uint8  `json:"wscale_orig,omitempty"`
+	ReplyWindowScale    uint8  `json:"wscale_reply,omitempty"`
+	OriginalFlags       uint16 `json:"flags_orig,omitempty"`
+	ReplyFlags          uint16 `json:"flags_reply,omitempty"`
+}
+
+// jsonProtoInfoDCCP is the JSON representation of a ProtoInfoDCCP.
+type jsonProtoInfoDCCP struct {
+	State        uint8  `json:"state"`
+	Role         uint8  `json:"role,omitempty"`
+	HandshakeSeq uint64 `json:"handshake_seq,omitempty"`
+}
+
+// jsonProtoInfoSCTP is the JSON representation of a ProtoInfoSCTP.
+type jsonProtoInfoSCTP struct {
+	State        uint8  `json:"state"`
+	VTagOriginal uint32 `json:"vtag_orig,omitempty"`
+	VTagReply    uint32 `json:"vtag_reply,omitempty"`
+}
+
+// jsonHelper is the JSON representation of a Helper.
+type jsonHelper struct {
+	Name string `json:"name,omitempty"`
+	Info []byte `json:"info,omitempty"`
+}
+
+// jsonCounter is the JSON representation of a Counter. Its direction is implied by
+// the field holding it.
+type jsonCounter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// jsonSequenceAdjust is the JSON representation of a SequenceAdjust. Its direction is
+// implied by the field holding it.
+type jsonSequenceAdjust struct {
+	Position     uint32 `json:"position"`
+	OffsetBefore uint32 `json:"offset_before"`
+	OffsetAfter  uint32 `json:"offset_after"`
+}
+
+// jsonSynProxy is the JSON representation of a SynProxy.
+type jsonSynProxy struct {
+	ISN   uint32 `json:"isn"`
+	ITS   uint32 `json:"its"`
+	TSOff uint32 `json:"tsoff"`
+}
+
+// jsonNAT is the JSON representation of a NAT.
+type jsonNAT struct {
+	MinIP   net.IP `json:"min_ip,omitempty"`
+	MaxIP   net.IP `json:"max_ip,omitempty"`
+	MinPort uint16 `json:"min_port,omitempty"`
+	MaxPort uint16 `json:"max_port,omitempty"`
+}
+
+// jsonExpect is the JSON representation of an Expect.
+type jsonExpect struct {
+	Version int `json:"version,omitempty"`
+
+	ID      uint32 `json:"id,omitempty"`
+	Timeout uint32 `json:"timeout,omitempty"`
+
+	TupleMaster *jsonTuple `json:"master,omitempty"`
+	Tuple       *jsonTuple `json:"tuple,omitempty"`
+	Mask        *jsonTuple `json:"mask,omitempty"`
+
+	Zone uint16 `json:"zone,omitempty"`
+
+	HelpName string `json:"helper,omitempty"`
+	Function string `json:"function,omitempty"`
+
+	Flags uint32 `json:"flags,omitempty"`
+	Class uint32 `json:"class,omitempty"`
+
+	NAT *jsonExpectNAT `json:"nat,omitempty"`
+}
+
+// jsonExpectNAT is the JSON representation of an ExpectNAT.
+type jsonExpectNAT struct {
+	Reply bool       `json:"reply,omitempty"`
+	Tuple *jsonTuple `json:"tuple,omitempty"`
+}
+
+// jsonEvent is the JSON representation of an Event.
+type jsonEvent struct {
+	Version int    `json:"version,omitempty"`
+	Type    string `json:"type"`
+	NSID    int32  `json:"nsid"`
+
+	Flow   *jsonFlow   `json:"flow,omitempty"`
+	Expect *jsonExpect `json:"expect,omitempty"`
+}
+
+// jsonStats is the JSON representation of Stats.
+type jsonStats struct {
+	Version       int    `json:"version,omitempty"`
+	CPUID         uint16 `json:"cpu"`
+	Found         uint32 `json:"found"`
+	Invalid       uint32 `json:"invalid"`
+	Ignore        uint32 `json:"ignore"`
+	Insert        uint32 `json:"insert"`
+	InsertFailed  uint32 `json:"insert_failed"`
+	Drop          uint32 `json:"drop"`
+	EarlyDrop     uint32 `json:"early_drop"`
+	Error         uint32 `json:"error"`
+	SearchRestart uint32 `json:"search_restart"`
+}
+
+// jsonStatsExpect is the JSON representation of StatsExpect.
+type jsonStatsExpect struct {
+	Version int    `json:"version,omitempty"`
+	CPUID   uint16 `json:"cpu"`
+	New     uint32 `json:"new"`
+	Create  uint32 `json:"create"`
+	Delete  uint32 `json:"delete"`
+}
+
+// jsonStatsGlobal is the JSON representation of StatsGlobal.
+type jsonStatsGlobal struct {
+	Version    int    `json:"version,omitempty"`
+	Entries    uint32 `json:"entries"`
+	MaxEntries uint32 `json:"max_entries"`
+}
+
+// newJSONFlow returns the JSON representation of a Flow, without a version.
+func newJSONFlow(f Flow) jsonFlow {
+
+	jf := jsonFlow{
+		ID:              f.ID,
+		Timeout:         f.Timeout,
+		Start:           jsonTime(f.Timestamp.Start),
+		Stop:            jsonTime(f.Timestamp.Stop),
+		Status:          f.Status.names(),
+		TupleOrig:       newJSONTuple(f.TupleOrig),
+		TupleReply:      newJSONTuple(f.TupleReply),
+		TupleMaster:     newJSONTuple(f.TupleMaster),
+		Zone:            f.Zone,
+		CountersOrig:    newJSONCounter(f.CountersOrig),
+		CountersReply:   newJSONCounter(f.CountersReply),
+		SecurityContext: f.SecurityContext,
+		SeqAdjOrig:      newJSONSequenceAdjust(f.SeqAdjOrig),
+		SeqAdjReply:     newJSONSequenceAdjust(f.SeqAdjReply),
+		Labels:          newJSONLabels(f.Labels),
+		LabelsMask:      newJSONLabels(f.LabelsMask),
+		Mark:            f.Mark,
+		Use:             f.Use,
+		NATSrc:          newJSONNAT(f.NATSrc),
+		NATDst:          newJSONNAT(f.NATDst),
+	}
+
+	if tcp := f.ProtoInfo.TCP; tcp != nil {
+		jf.TCP = &jsonProtoInfoTCP{
+			State:               tcpStateLookup(tcp.State),
+			OriginalWindowScale: tcp.OriginalWindowScale,
+			ReplyWindowScale:    tcp.ReplyWindowScale,
+			OriginalFlags:       tcp.OriginalFlags,
+			ReplyFlags:          tcp.ReplyFlags,
+		}
+	}
+
+	if dccp := f.ProtoInfo.DCCP; dccp != nil {
+		jf.DCCP = &jsonProtoInfoDCCP{State: dccp.State, Role: dccp.Role, HandshakeSeq: dccp.HandshakeSeq}
+	}
+
+	if sctp := f.ProtoInfo.SCTP; sctp != nil {
+		jf.SCTP = &jsonProtoInfoSCTP{State: sctp.State, VTagOriginal: sctp.VTagOriginal, VTagReply: sctp.VTagReply}
+	}
+
+	if f.Helper.Name != "" || len(f.Helper.Info) != 0 {
+		jf.Helper = &jsonHelper{Name: f.Helper.Name, Info: f.Helper.Info}
+	}
+
+	if f.SynProxy.filled() {
+		jf.SynProxy = &jsonSynProxy{ISN: f.SynProxy.ISN, ITS: f.SynProxy.ITS, TSOff: f.SynProxy.TSOff}
+	}
+
+	return jf
+}
+
+// flow returns the Flow represented by jf.
+func (jf jsonFlow) flow() (Flow, error) {
+
+	f := Flow{
+		ID:              jf.ID,
+		Timeout:         jf.Timeout,
+		Zone:            jf.Zone,
+		SecurityContext: jf.SecurityContext,
+		Mark:            jf.Mark,
+		Use:             jf.Use,
+	}
+
+	var err error
+
+	if f.Timestamp.Start, err = parseJSONTime(jf.Start); err != nil {
+		return Flow{}, err
+	}
+	if f.Timestamp.Stop, err = parseJSONTime(jf.Stop); err != nil {
+		return Flow{}, err
+	}
+
+	if err := f.Status.parse(jf.Status); err != nil {
+		return Flow{}, err
+	}
+
+	for _, t := range []struct {
+		jt *jsonTuple
+		t  *Tuple
+	}{
+		{jf.TupleOrig, &f.TupleOrig},
+		{jf.TupleReply, &f.TupleReply},
+		{jf.TupleMaster, &f.TupleMaster},
+	} {
+		if *t.t, err = t.jt.tuple(); err != nil {
+			return Flow{}, err
+		}
+	}
+
+	if jf.TCP != nil {
+		state, err := tcpStateParse(jf.TCP.State)
+		if err != nil {
+			return Flow{}, err
+		}
+
+		f.ProtoInfo.TCP = &ProtoInfoTCP{
+			State:               state,
+			OriginalWindowScale: jf.TCP.OriginalWindowScale,
+			ReplyWindowScale:    jf.TCP.ReplyWindowScale,
+			OriginalFlags:       jf.TCP.OriginalFlags,
+			ReplyFlags:          jf.TCP.ReplyFlags,
+		}
+	}
+
+	if jf.DCCP != nil {
+		f.ProtoInfo.DCCP = &ProtoInfoDCCP{State: jf.DCCP.State, Role: jf.DCCP.Role, HandshakeSeq: jf.DCCP.HandshakeSeq}
+	}
+
+	if jf.SCTP != nil {
+		f.ProtoInfo.SCTP = &ProtoInfoSCTP{State: jf.SCTP.State, VTagOriginal: jf.SCTP.VTagOriginal, VTagReply: jf.SCTP.VTagReply}
+	}
+
+	if jf.Helper != nil {
+		f.Helper = Helper{Name: jf.Helper.Name, Info: jf.Helper.Info}
+	}
+
+	if jf.CountersOrig != nil {
+		f.CountersOrig = Counter{Packets: jf.CountersOrig.Packets, Bytes: jf.CountersOrig.Bytes}
+	}
+	if jf.CountersReply != nil {
+		f.CountersReply = Counter{Direction: true, Packets: jf.CountersReply.Packets, Bytes: jf.CountersReply.Bytes}
+	}
+
+	if s := jf.SeqAdjOrig; s != nil {
+		f.SeqAdjOrig = SequenceAdjust{Position: s.Position, OffsetBefore: s.OffsetBefore, OffsetAfter: s.OffsetAfter}
+	}
+	if s := jf.SeqAdjReply; s != nil {
+		f.SeqAdjReply = SequenceAdjust{Direction: true, Position: s.Position, OffsetBefore: s.OffsetBefore, OffsetAfter: s.OffsetAfter}
+	}
+
+	if f.Labels, err = jsonLabels(jf.Labels); err != nil {
+		return Flow{}, err
+	}
+	if f.LabelsMask, err = jsonLabels(jf.LabelsMask); err != nil {
+		return Flow{}, err
+	}
+
+	if jf.SynProxy != nil {
+		f.SynProxy = SynProxy{ISN: jf.SynProxy.ISN, ITS: jf.SynProxy.ITS, TSOff: jf.SynProxy.TSOff}
+	}
+
+	if n := jf.NATSrc; n != nil {
+		f.NATSrc = NAT{MinIP: n.MinIP, MaxIP: n.MaxIP, MinPort: n.MinPort, MaxPort: n.MaxPort}
+	}
+	if n := jf.NATDst; n != nil {
+		f.NATDst = NAT{MinIP: n.MinIP, MaxIP: n.MaxIP, MinPort: n.MinPort, MaxPort: n.MaxPort}
+	}
+
+	return f, nil
+}
+
+// newJSONTuple returns the JSON representation of a Tuple, or nil if the Tuple is empty.
+func newJSONTuple(t Tuple) *jsonTuple {
+
+	if !t.IP.filled() && !t.Proto.filled() && t.Zone == 0 {
+		return nil
+	}
+
+	jt := &jsonTuple{
+		SourceAddress:      t.IP.SourceAddress,
+		DestinationAddress: t.IP.DestinationAddress,
+		SourcePort:         t.Proto.SourcePort,
+		DestinationPort:    t.Proto.DestinationPort,
+		ICMPID:             t.Proto.ICMPID,
+		ICMPType:           t.Proto.ICMPType,
+		ICMPCode:           t.Proto.ICMPCode,
+		Zone:               t.Zone,
+	}
+
+	if t.Proto.Protocol != 0 {
+		jt.Protocol = protoLookup(t.Proto.Protocol)
+	}
+
+	return jt
+}
+
+// tuple returns the Tuple represented by jt. A nil jt is an empty Tuple.
+func (jt *jsonTuple) tuple() (Tuple, error) {
+
+	if jt == nil {
+		return Tuple{}, nil
+	}
+
+	t := Tuple{
+		IP: IPTuple{
+			SourceAddress:      jt.SourceAddress,
+			DestinationAddress: jt.DestinationAddress,
+		},
+		Proto: ProtoTuple{
+			SourcePort:      jt.SourcePort,
+			DestinationPort: jt.DestinationPort,
+			ICMPID:          jt.ICMPID,
+			ICMPType:        jt.ICMPType,
+			ICMPCode:        jt.ICMPCode,
+		},
+		Zone: jt.Zone,
+	}
+
+	if jt.Protocol != "" {
+		p, err := protoParse(jt.Protocol)
+		if err != nil {
+			return Tuple{}, err
+		}
+
+		t.Proto.Protocol = p
+		t.Proto.ICMPv4 = p == unix.IPPROTO_ICMP
+		t.Proto.ICMPv6 = p == unix.IPPROTO_ICMPV6
+	}
+
+	return t, nil
+}
+
+// newJSONCounter returns the JSON representation of a Counter, or nil if it is zero.
+func newJSONCounter(c Counter) *jsonCounter {
+
+	if c.Packets == 0 && c.Bytes == 0 {
+		return nil
+	}
+
+	return &jsonCounter{Packets: c.Packets, Bytes: c.Bytes}
+}
+
+// newJSONSequenceAdjust returns the JSON representation of a SequenceAdjust,
+// or nil if it is zero.
+func newJSONSequenceAdjust(s SequenceAdjust) *jsonSequenceAdjust {
+
+	if s.Position == 0 && s.OffsetBefore == 0 && s.OffsetAfter == 0 {
+		return nil
+	}
+
+	return &jsonSequenceAdjust{Position: s.Position, OffsetBefore: s.OffsetBefore, OffsetAfter: s.OffsetAfter}
+}
+
+// newJSONNAT returns the JSON representation of a NAT, or nil if it is not set.
+func newJSONNAT(n NAT) *jsonNAT {
+
+	if !n.filled() {
+		return nil
+	}
+
+	return &jsonNAT{MinIP: n.MinIP, MaxIP: n.MaxIP, MinPort: n.MinPort, MaxPort: n.MaxPort}
+}
+
+// newJSONExpect returns the JSON representation of an Expect, without a version.
+func newJSONExpect(ex Expect) jsonExpect {
+
+	je := jsonExpect{
+		ID:          ex.ID,
+		Timeout:     ex.Timeout,
+		TupleMaster: newJSONTuple(ex.TupleMaster),
+		Tuple:       newJSONTuple(ex.Tuple),
+		Mask:        newJSONTuple(ex.Mask),
+		Zone:        ex.Zone,
+		HelpName:    ex.HelpName,
+		Function:    ex.Function,
+		Flags:       ex.Flags,
+		Class:       ex.Class,
+	}
+
+	if nt := newJSONTuple(ex.NAT.Tuple); ex.NAT.Direction || nt != nil {
+		je.NAT = &jsonExpectNAT{Reply: ex.NAT.Direction, Tuple: nt}
+	}
+
+	return je
+}
+
+// expect returns the Expect represented by je.
+func (je jsonExpect) expect() (Expect, error) {
+
+	ex := Expect{
+		ID:       je.ID,
+		Timeout:  je.Timeout,
+		Zone:     je.Zone,
+		HelpName: je.HelpName,
+		Function: je.Function,
+		Flags:    je.Flags,
+		Class:    je.Class,
+	}
+
+	var err error
+
+	for _, t := range []struct {
+		jt *jsonTuple
+		t  *Tuple
+	}{
+		{je.TupleMaster, &ex.TupleMaster},
+		{je.Tuple, &ex.Tuple},
+		{je.Mask, &ex.Mask},
+	} {
+		if *t.t, err = t.jt.tuple(); err != nil {
+			return Expect{}, err
+		}
+	}
+
+	if je.NAT != nil {
+		ex.NAT.Direction = je.NAT.Reply
+		if ex.NAT.Tuple, err = je.NAT.Tuple.tuple(); err != nil {
+			return Expect{}, err
+		}
+	}
+
+	return ex, nil
+}
+
+// names returns the names of the flags set in the Status. Bits without a name
+// are represented by their value.
+func (s Status) names() []string {
+
+	var names []string
+
+	for i := uint32(0); i < 32; i++ {
+		f := StatusFlag(1 << i)
+		if s.Value&f == 0 {
+			continue
+		}
+
+		if int(i) < len(statusNames) {
+			names = append(names, statusNames[i])
+			continue
+		}
+
+		names = append(names, strconv.FormatUint(uint64(f), 10))
+	}
+
+	return names
+}
+
+// parse sets the Status to the flags with the given names.
+func (s *Status) parse(names []string) error {
+
+	s.Value = 0
+
+	for _, name := range names {
+		f, err := statusFlagParse(name)
+		if err != nil {
+			return err
+		}
+		s.Value |= f
+	}
+
+	return nil
+}
+
+// name returns the name of the eventType in JSON.
+func (et eventType) name() string {
+
+	if int(et) < len(eventTypeNames) {
+		return eventTypeNames[et]
+	}
+
+	return strconv.FormatUint(uint64(et), 10)
+}
+
+// parse sets the eventType to the one with the given name.
+func (et *eventType) parse(name string) error {
+
+	for i, n := range eventTypeNames {
+		if n == name {
+			*et = eventType(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf(errUnknownEventName, name)
+}
+
+// newJSONLabels returns the bits set in l, or nil if l is nil. Labels without
+// any bit set return an empty list, so they are not omitted.
+func newJSONLabels(l Labels) *[]uint {
+
+	if l == nil {
+		return nil
+	}
+
+	bits := l.Bits()
+	if bits == nil {
+		bits = []uint{}
+	}
+
+	return &bits
+}
+
+// jsonLabels returns the Labels with the given bits set, or nil if bits is nil.
+// An empty list returns Labels without any bit set.
+func jsonLabels(bits *[]uint) (Labels, error) {
+
+	if bits == nil {
+		return nil, nil
+	}
+
+	l := make(Labels, labelsLen)
+
+	for _, bit := range *bits {
+		if bit > MaxLabel {
+			return nil, errLabelsTooLong
+		}
+		l.Set(bit)
+	}
+
+	return l, nil
+}
+
+// jsonTime returns the RFC 3339 representation of t in UTC, or an empty string
+// if t is zero.
+func jsonTime(t time.Time) string {
+
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseJSONTime parses an RFC 3339 timestamp into the local time zone.
+// An empty string is the zero time.
+func parseJSONTime(s string) (time.Time, error) {
+
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, t.UnixNano()), nil
+}
@@ -0,0 +1,76 @@
+//+build integration
+
+package conntrack
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Encodes a Flow queried from the kernel as JSON, and creates it again from its JSON.
+func TestConnCreateFlowJSON(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	f := NewFlow(6, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 40000, 443, 120, 42)
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+
+	require.NoError(t, c.Create(f))
+
+	qf, err := c.Get(f)
+	require.NoError(t, err)
+
+	b, err := json.Marshal(qf)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Delete(qf))
+
+	var jf Flow
+	require.NoError(t, json.Unmarshal(b, &jf))
+	require.NoError(t, c.Create(jf))
+
+	rf, err := c.Get(jf)
+	require.NoError(t, err)
+
+	assert.Equal(t, qf.Status, rf.Status)
+	assert.Equal(t, qf.Mark, rf.Mark)
+	assert.Equal(t, qf.ProtoInfo.TCP.State, rf.ProtoInfo.TCP.State)
+	assert.True(t, rf.TupleReply.IP.SourceAddress.Equal(net.ParseIP("10.0.0.2")))
+}
+
+// Clears a label with an Update decoded from JSON, holding the mask and no labels.
+func TestConnUpdateLabelsJSON(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	require.NoError(t, enableLabels(nsid), "enabling connection labels")
+
+	f := NewFlow(6, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 1000, 80, 120, 0)
+	f.Labels.Set(1)
+	f.Labels.Set(42)
+	require.NoError(t, c.Create(f))
+
+	var upd Flow
+	upd.TupleOrig, upd.TupleReply = f.TupleOrig, f.TupleReply
+	upd.Labels = make(Labels, labelsLen)
+	upd.LabelsMask.Set(1)
+
+	b, err := json.Marshal(upd)
+	require.NoError(t, err)
+
+	var jf Flow
+	require.NoError(t, json.Unmarshal(b, &jf))
+	require.NoError(t, c.Update(jf))
+
+	qf, err := c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{42}, qf.Labels.Bits())
+
+	assert.NoError(t, c.Close())
+}
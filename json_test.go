@@ -0,0 +1,252 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowJSON(t *testing.T) {
+
+	f := NewFlow(6, StatusAssured|StatusSeenReply|1<<20, net.ParseIP("10.0.0.1"), net.ParseIP("192.0.2.1"), 40000, 443, 120, 42)
+	f.ID = 1
+	f.Use = 1
+	f.Zone = 3
+	f.Timestamp = Timestamp{Start: time.Unix(100, 500)}
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 3, OriginalWindowScale: 7, ReplyFlags: 0x23}
+	f.Helper = Helper{Name: "ftp", Info: []byte{1, 2}}
+	f.CountersOrig = Counter{Packets: 1, Bytes: 60}
+	f.CountersReply = Counter{Direction: true, Packets: 2, Bytes: 120}
+	f.SecurityContext = "system_u:object_r:unlabeled_t:s0"
+	f.TupleMaster = Tuple{
+		IP:    IPTuple{SourceAddress: net.ParseIP("10.0.0.1"), DestinationAddress: net.ParseIP("192.0.2.1")},
+		Proto: ProtoTuple{Protocol: 6, SourcePort: 40001, DestinationPort: 21},
+	}
+	f.SeqAdjReply = SequenceAdjust{Direction: true, Position: 1, OffsetBefore: 2, OffsetAfter: 3}
+	f.Labels.Set(1)
+	f.Labels.Set(100)
+	f.LabelsMask.Set(1)
+	f.SynProxy = SynProxy{ISN: 1, ITS: 2, TSOff: 3}
+	f.NATSrc = NAT{MinIP: net.ParseIP("198.51.100.1"), MinPort: 1024, MaxPort: 2048}
+
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	assert.Equal(t, float64(JSONVersion), m["version"])
+	assert.Equal(t, "1970-01-01T00:01:40.0000005Z", m["start"])
+	assert.NotContains(t, m, "stop")
+	assert.Equal(t, []interface{}{"SEEN_REPLY", "ASSURED", "1048576"}, m["status"])
+	assert.Equal(t, map[string]interface{}{
+		"src": "10.0.0.1", "dst": "192.0.2.1", "protocol": "tcp", "sport": float64(40000), "dport": float64(443),
+	}, m["orig"])
+	assert.Equal(t, map[string]interface{}{
+		"state": "ESTABLISHED", "wscale_orig": float64(7), "flags_reply": float64(0x23),
+	}, m["tcp"])
+	assert.Equal(t, []interface{}{float64(1), float64(100)}, m["labels"])
+	assert.Equal(t, map[string]interface{}{"name": "ftp", "info": "AQI="}, m["helper"])
+	assert.NotContains(t, m, "seqadj_orig")
+	assert.NotContains(t, m, "nat_dst")
+
+	var rf Flow
+	require.NoError(t, json.Unmarshal(b, &rf))
+	assert.Equal(t, f, rf)
+}
+
+func TestFlowJSONMinimal(t *testing.T) {
+
+	f := NewFlow(17, 0, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 53, 5353, 0, 0)
+
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"version": 1,
+		"orig": {"src": "2001:db8::1", "dst": "2001:db8::2", "protocol": "udp", "sport": 53, "dport": 5353},
+		"reply": {"src": "2001:db8::2", "dst": "2001:db8::1", "protocol": "udp", "sport": 5353, "dport": 53}
+	}`, string(b))
+
+	var rf Flow
+	require.NoError(t, json.Unmarshal(b, &rf))
+	assert.Equal(t, f, rf)
+
+	// ICMP tuples are marked as such, like those received from the kernel.
+	require.NoError(t, json.Unmarshal([]byte(`{"orig": {"protocol": "ipv6-icmp", "icmp_type": 128}}`), &rf))
+	assert.True(t, rf.TupleOrig.Proto.ICMPv6)
+	assert.Equal(t, uint8(58), rf.TupleOrig.Proto.Protocol)
+	assert.Equal(t, uint8(128), rf.TupleOrig.Proto.ICMPType)
+}
+
+// Labels without any bit set are kept, so they still clear the labels in the mask.
+func TestFlowJSONLabels(t *testing.T) {
+
+	var f Flow
+	f.Labels = make(Labels, labelsLen)
+	f.LabelsMask.Set(1)
+
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "labels": [], "labels_mask": [1]}`, string(b))
+
+	var rf Flow
+	require.NoError(t, json.Unmarshal(b, &rf))
+	assert.Equal(t, f, rf)
+
+	// Without labels, both fields are left out.
+	b, err = json.Marshal(Flow{})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1}`, string(b))
+
+	require.NoError(t, json.Unmarshal(b, &rf))
+	assert.Nil(t, rf.Labels)
+	assert.Nil(t, rf.LabelsMask)
+}
+
+func TestFlowJSONError(t *testing.T) {
+
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`{"version": 2}`, fmt.Sprintf(errJSONVersion, 2, JSONVersion)},
+		{`{"orig": {"protocol": "foo"}}`, fmt.Sprintf(errUnknownProtocol, "foo")},
+		{`{"orig": {"protocol": "256"}}`, fmt.Sprintf(errUnknownProtocol, "256")},
+		{`{"status": ["FOO"]}`, fmt.Sprintf(errUnknownStatusFlag, "FOO")},
+		{`{"tcp": {"state": "FOO"}}`, fmt.Sprintf(errUnknownTCPState, "FOO")},
+		{`{"labels": [128]}`, errLabelsTooLong.Error()},
+		{`{"start": "yesterday"}`, `parsing time "yesterday" as "2006-01-02T15:04:05.999999999Z07:00": cannot parse "yesterday" as "2006"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var f Flow
+			assert.EqualError(t, json.Unmarshal([]byte(tt.json), &f), tt.err)
+		})
+	}
+}
+
+func TestExpectJSON(t *testing.T) {
+
+	tpl := Tuple{
+		IP:    IPTuple{SourceAddress: net.ParseIP("10.0.0.1"), DestinationAddress: net.ParseIP("192.0.2.1")},
+		Proto: ProtoTuple{Protocol: 6, SourcePort: 0, DestinationPort: 30000},
+	}
+
+	ex := Expect{
+		ID:          5,
+		Timeout:     300,
+		TupleMaster: tpl,
+		Tuple:       tpl,
+		Mask: Tuple{
+			IP:    IPTuple{SourceAddress: net.ParseIP("255.255.255.255"), DestinationAddress: net.ParseIP("255.255.255.255")},
+			Proto: ProtoTuple{Protocol: 255, DestinationPort: 0xffff},
+		},
+		HelpName: "ftp",
+		Class:    1,
+		NAT:      ExpectNAT{Direction: true, Tuple: tpl},
+	}
+
+	b, err := json.Marshal(ex)
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	assert.Equal(t, float64(JSONVersion), m["version"])
+	assert.Equal(t, "ftp", m["helper"])
+	assert.Equal(t, "255", m["mask"].(map[string]interface{})["protocol"])
+	assert.Equal(t, true, m["nat"].(map[string]interface{})["reply"])
+
+	var rex Expect
+	require.NoError(t, json.Unmarshal(b, &rex))
+	assert.Equal(t, ex, rex)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"id": 1}`), &rex))
+	assert.Equal(t, Expect{ID: 1}, rex)
+}
+
+func TestEventJSON(t *testing.T) {
+
+	f := NewFlow(6, StatusConfirmed, net.ParseIP("10.0.0.1"), net.ParseIP("192.0.2.1"), 40000, 443, 120, 0)
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 7}
+
+	e := Event{Type: EventDestroy, Flow: &f, NSID: NSIDLocal}
+
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"version": 1,
+		"type": "DESTROY",
+		"nsid": -1,
+		"flow": {
+			"timeout": 120,
+			"status": ["CONFIRMED"],
+			"orig": {"src": "10.0.0.1", "dst": "192.0.2.1", "protocol": "tcp", "sport": 40000, "dport": 443},
+			"reply": {"src": "192.0.2.1", "dst": "10.0.0.1", "protocol": "tcp", "sport": 443, "dport": 40000},
+			"tcp": {"state": "TIME_WAIT"}
+		}
+	}`, string(b))
+
+	var re Event
+	require.NoError(t, json.Unmarshal(b, &re))
+	assert.Equal(t, e, re)
+
+	ee := Event{Type: EventExpNew, Expect: &Expect{ID: 1, HelpName: "ftp"}}
+
+	b, err = json.Marshal(ee)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "type": "EXP_NEW", "nsid": 0, "expect": {"id": 1, "helper": "ftp"}}`, string(b))
+
+	require.NoError(t, json.Unmarshal(b, &re))
+	assert.Equal(t, ee, re)
+
+	assert.EqualError(t, json.Unmarshal([]byte(`{"type": "FOO"}`), &re), fmt.Sprintf(errUnknownEventName, "FOO"))
+	assert.EqualError(t, json.Unmarshal([]byte(`{"version": 2, "type": "NEW"}`), &re),
+		fmt.Sprintf(errJSONVersion, 2, JSONVersion))
+}
+
+func TestStatsJSON(t *testing.T) {
+
+	s := Stats{CPUID: 1, Found: 2, Insert: 3, SearchRestart: 4}
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": 1, "cpu": 1, "found": 2, "invalid": 0, "ignore": 0, "insert": 3,
+		"insert_failed": 0, "drop": 0, "early_drop": 0, "error": 0, "search_restart": 4
+	}`, string(b))
+
+	var rs Stats
+	require.NoError(t, json.Unmarshal(b, &rs))
+	assert.Equal(t, s, rs)
+
+	se := StatsExpect{CPUID: 1, New: 2, Create: 3, Delete: 4}
+
+	b, err = json.Marshal(se)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "cpu": 1, "new": 2, "create": 3, "delete": 4}`, string(b))
+
+	var rse StatsExpect
+	require.NoError(t, json.Unmarshal(b, &rse))
+	assert.Equal(t, se, rse)
+
+	sg := StatsGlobal{Entries: 10, MaxEntries: 65536}
+
+	b, err = json.Marshal(sg)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "entries": 10, "max_entries": 65536}`, string(b))
+
+	var rsg StatsGlobal
+	require.NoError(t, json.Unmarshal(b, &rsg))
+	assert.Equal(t, sg, rsg)
+
+	assert.EqualError(t, json.Unmarshal([]byte(`{"version": 2}`), &rsg), fmt.Sprintf(errJSONVersion, 2, JSONVersion))
+}
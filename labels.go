@@ -0,0 +1,229 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+const (
+	// labelsLen is the size of a connection's labels in the kernel (NF_CT_LABELS_MAX_SIZE).
+	labelsLen = 16
+
+	// MaxLabel is the highest connection label bit supported by the kernel.
+	MaxLabel = labelsLen*8 - 1
+
+	// DefaultLabelMapPath is the default location of the file mapping connection
+	// label names to bits, used by iptables and nftables.
+	DefaultLabelMapPath = "/etc/xtables/connlabel.conf"
+)
+
+// Labels is a bitset holding the connection labels (connlabels) of a Flow.
+// Label bits range from 0 to MaxLabel.
+//
+// Labels are stored in the kernel's format, as a sequence of 32-bit words in host
+// byte order. Bit n is stored in word n/32 at position n%32.
+type Labels []byte
+
+// Set sets the given label bit, growing the Labels if needed.
+// Panics if bit is larger than MaxLabel.
+func (l *Labels) Set(bit uint) {
+
+	w, m := labelWord(bit)
+
+	if len(*l) < labelsLen {
+		nl := make(Labels, labelsLen)
+		copy(nl, *l)
+		*l = nl
+	}
+
+	nlenc.PutUint32((*l)[w:w+4], nlenc.Uint32((*l)[w:w+4])|m)
+}
+
+// Clear clears the given label bit. Panics if bit is larger than MaxLabel.
+func (l Labels) Clear(bit uint) {
+
+	w, m := labelWord(bit)
+
+	if len(l) < w+4 {
+		return
+	}
+
+	nlenc.PutUint32(l[w:w+4], nlenc.Uint32(l[w:w+4])&^m)
+}
+
+// Has returns true if the given label bit is set. Panics if bit is larger than MaxLabel.
+func (l Labels) Has(bit uint) bool {
+
+	w, m := labelWord(bit)
+
+	if len(l) < w+4 {
+		return false
+	}
+
+	return nlenc.Uint32(l[w:w+4])&m != 0
+}
+
+// Bits returns the label bits that are set, in ascending order.
+func (l Labels) Bits() []uint {
+
+	var bits []uint
+
+	for bit := uint(0); bit <= MaxLabel; bit++ {
+		if l.Has(bit) {
+			bits = append(bits, bit)
+		}
+	}
+
+	return bits
+}
+
+// labelWord returns the byte offset of the word holding a label bit,
+// and the bit's mask within the word.
+func labelWord(bit uint) (int, uint32) {
+
+	if bit > MaxLabel {
+		panic(fmt.Sprintf("connection label bit %d out of range", bit))
+	}
+
+	return int(bit/32) * 4, 1 << (bit % 32)
+}
+
+// marshal returns the Labels padded to the kernel's size. The kernel clears all
+// words of a connection's labels that are not part of an update, even with a mask.
+// When mask is non-nil, only the bits that are set in the mask are kept.
+func (l Labels) marshal(mask Labels) []byte {
+
+	b := make([]byte, labelsLen)
+	copy(b, l)
+
+	if mask == nil {
+		return b
+	}
+
+	for i := range b {
+		if i < len(mask) {
+			b[i] &= mask[i]
+		} else {
+			b[i] = 0
+		}
+	}
+
+	return b
+}
+
+// A LabelMap maps the names of connection labels to their bits,
+// as configured in connlabel.conf.
+type LabelMap struct {
+	bits  map[string]uint
+	names map[uint]string
+}
+
+// LoadLabelMap reads a LabelMap from the file at the given path,
+// usually DefaultLabelMapPath.
+func LoadLabelMap(path string) (*LabelMap, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseLabelMap(f)
+}
+
+// ParseLabelMap reads a LabelMap in connlabel.conf format from r. Each line holds
+// a label bit followed by whitespace and the label's name. Lines starting with '#'
+// and lines without a valid bit are ignored, like iptables and nftables do.
+// When a bit or a name occurs more than once, the first occurrence is used.
+func ParseLabelMap(r io.Reader) (*LabelMap, error) {
+
+	lm := &LabelMap{
+		bits:  make(map[string]uint),
+		names: make(map[uint]string),
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		bit, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil || bit > MaxLabel {
+			continue
+		}
+
+		// Names can contain whitespace.
+		name := strings.TrimSpace(line[len(fields[0]):])
+
+		if _, ok := lm.bits[name]; !ok {
+			lm.bits[name] = uint(bit)
+		}
+		if _, ok := lm.names[uint(bit)]; !ok {
+			lm.names[uint(bit)] = name
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return lm, nil
+}
+
+// Bit returns the label bit with the given name.
+func (lm *LabelMap) Bit(name string) (uint, bool) {
+	bit, ok := lm.bits[name]
+	return bit, ok
+}
+
+// Name returns the name of the given label bit.
+func (lm *LabelMap) Name(bit uint) (string, bool) {
+	name, ok := lm.names[bit]
+	return name, ok
+}
+
+// Labels returns Labels with the bits of the given label names set.
+// Returns an error if any of the names are unknown.
+func (lm *LabelMap) Labels(names ...string) (Labels, error) {
+
+	var l Labels
+
+	for _, name := range names {
+		bit, ok := lm.bits[name]
+		if !ok {
+			return nil, fmt.Errorf(errUnknownLabel, name)
+		}
+
+		l.Set(bit)
+	}
+
+	return l, nil
+}
+
+// Names returns the names of the label bits set in l, in ascending order of their bits.
+// Bits without a name are omitted.
+func (lm *LabelMap) Names(l Labels) []string {
+
+	var names []string
+
+	for _, bit := range l.Bits() {
+		if name, ok := lm.names[bit]; ok {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
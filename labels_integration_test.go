@@ -0,0 +1,69 @@
+//+build integration
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+)
+
+// enableLabels installs an nftables rule setting a connection label in the given network namespace.
+// The kernel only attaches labels to connections when the labels are in use by a ruleset.
+func enableLabels(nsid int) error {
+
+	return addNFTRule(nsid, "labels",
+		nftExpr("immediate",
+			nftU32(nftaImmediateDreg, nftReg1),
+			netfilter.Attribute{Type: nftaImmediateData, Nested: true, Children: []netfilter.Attribute{
+				{Type: nftaDataValue, Data: make([]byte, labelsLen)},
+			}},
+		),
+		nftExpr("ct",
+			nftU32(nftaCTKey, nftCTLabels),
+			nftU32(nftaCTSreg, nftReg1),
+		),
+	)
+}
+
+// Creates flows with connection labels, and changes individual labels using a mask.
+func TestConnLabels(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	require.NoError(t, enableLabels(nsid), "enabling connection labels")
+
+	f := NewFlow(6, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"), 1000, 80, 120, 0)
+	f.Labels.Set(1)
+	f.Labels.Set(42)
+	require.NoError(t, c.Create(f))
+
+	qf, err := c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 42}, qf.Labels.Bits())
+
+	// Set label 100 and clear label 1, leave label 42 untouched.
+	var upd Flow
+	upd.TupleOrig, upd.TupleReply = f.TupleOrig, f.TupleReply
+	upd.Labels.Set(100)
+	upd.LabelsMask.Set(100)
+	upd.LabelsMask.Set(1)
+	require.NoError(t, c.Update(upd))
+
+	qf, err = c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{42, 100}, qf.Labels.Bits())
+
+	// Without a mask, all labels are replaced.
+	upd.Labels, upd.LabelsMask = nil, nil
+	upd.Labels.Set(7)
+	require.NoError(t, c.Update(upd))
+
+	qf, err = c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{7}, qf.Labels.Bits())
+}
@@ -0,0 +1,132 @@
+package conntrack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+
+	var l Labels
+	assert.False(t, l.Has(0))
+	assert.Nil(t, l.Bits())
+
+	// Clearing bits on empty Labels does not grow them.
+	l.Clear(1)
+	assert.Len(t, l, 0)
+
+	l.Set(0)
+	l.Set(33)
+	l.Set(MaxLabel)
+	assert.Len(t, l, labelsLen)
+
+	assert.True(t, l.Has(0))
+	assert.True(t, l.Has(33))
+	assert.False(t, l.Has(32))
+	assert.Equal(t, []uint{0, 33, MaxLabel}, l.Bits())
+
+	// Words are in host byte order.
+	assert.Equal(t, uint32(1), nlenc.Uint32(l[0:4]))
+	assert.Equal(t, uint32(2), nlenc.Uint32(l[4:8]))
+
+	l.Clear(33)
+	assert.Equal(t, []uint{0, MaxLabel}, l.Bits())
+
+	// Short Labels are grown when setting a bit.
+	short := Labels{0xff}
+	short.Set(64)
+	assert.Len(t, short, labelsLen)
+	assert.Equal(t, byte(0xff), short[0])
+	assert.True(t, short.Has(64))
+
+	assert.Panics(t, func() { l.Set(MaxLabel + 1) })
+	assert.Panics(t, func() { l.Has(MaxLabel + 1) })
+}
+
+func TestLabelsMarshal(t *testing.T) {
+
+	var l, mask Labels
+	l.Set(1)
+	l.Set(2)
+	mask.Set(2)
+	mask.Set(3)
+
+	b := l.marshal(nil)
+	assert.Len(t, b, labelsLen)
+	assert.Equal(t, []uint{1, 2}, Labels(b).Bits())
+
+	// Bits outside of the mask are not sent.
+	assert.Equal(t, []uint{2}, Labels(l.marshal(mask)).Bits())
+	assert.Equal(t, []uint(nil), Labels(l.marshal(Labels{0})).Bits())
+
+	_, err := Flow{
+		TupleOrig: flowIPPT, TupleReply: flowIPPT,
+		Labels: make(Labels, labelsLen+4),
+	}.marshal()
+	assert.EqualError(t, err, errLabelsTooLong.Error())
+}
+
+func TestParseLabelMap(t *testing.T) {
+
+	conf := `# connlabel.conf
+0	eth0-in
+1 eth0-out
+  2   spaced name
+0x10	hex
+# 3	commented
+4
+five	invalid
+128	out-of-range
+1	duplicate-bit
+5	eth0-in
+`
+
+	lm, err := ParseLabelMap(strings.NewReader(conf))
+	require.NoError(t, err)
+
+	for name, bit := range map[string]uint{
+		"eth0-in":       0,
+		"eth0-out":      1,
+		"spaced name":   2,
+		"hex":           16,
+		"duplicate-bit": 1,
+	} {
+		b, ok := lm.Bit(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, bit, b, name)
+	}
+
+	for _, name := range []string{"commented", "invalid", "out-of-range"} {
+		_, ok := lm.Bit(name)
+		assert.False(t, ok, name)
+	}
+
+	// The first name of a bit is used.
+	name, ok := lm.Name(1)
+	assert.True(t, ok)
+	assert.Equal(t, "eth0-out", name)
+
+	name, ok = lm.Name(5)
+	assert.True(t, ok)
+	assert.Equal(t, "eth0-in", name)
+
+	_, ok = lm.Name(3)
+	assert.False(t, ok)
+
+	l, err := lm.Labels("eth0-out", "hex")
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 16}, l.Bits())
+
+	l.Set(42)
+	assert.Equal(t, []string{"eth0-out", "hex"}, lm.Names(l))
+
+	_, err = lm.Labels("eth0-out", "nope")
+	assert.EqualError(t, err, "unknown connection label 'nope'")
+
+	_, err = LoadLabelMap("/nonexistent/connlabel.conf")
+	assert.Error(t, err)
+}
@@ -0,0 +1,503 @@
+package conntrack
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// ListenerConfig holds the optional configuration of a Listener.
+type ListenerConfig struct {
+	// Resync makes the Listener send an Event of type EventResync on the event channel
+	// when the kernel dropped events because the socket's receive buffer was full.
+	// Consumers keeping state derived from events should discard or verify it.
+	// The events left in the socket's receive buffer are discarded after sending
+	// EventResync, so the kernel reports the next overrun.
+	Resync bool
+
+	// ResyncDump is used to dump the Flow table after sending EventResync, and implies
+	// Resync. Every Flow is sent as an EventResyncFlow, followed by an EventResyncDone.
+	// It must be a separate Conn without listeners, in the same network namespace.
+	//
+	// Resync and ResyncDump need a Listener with a single worker, which stops reading
+	// events while it discards the socket's queue and dumps the table. Events sent by the
+	// kernel in the meantime are received after EventResyncDone, so consumers rebuilding
+	// their state from the dump don't lose them. Starting a Listener with more workers
+	// returns an error.
+	ResyncDump *Conn
+
+	// Reliable enables reliable delivery of destroy events. Failures to deliver an event
+	// to the Listener are reported to the kernel, which keeps a destroyed Flow on its dying
+	// list and retries sending its destroy event until it succeeds. Failed new and update
+	// events are not retried, their event types are merged into the next event of the Flow.
+	//
+	// The kernel no longer reports dropped events to a reliable Listener, so Resync and
+	// ResyncDump have no effect. Reliable Listeners start with a larger receive buffer
+	// and grow it when it fills up, up to MaxReadBuffer.
+	//
+	// The sysctl net.netfilter.nf_conntrack_events of the Listener's network namespace
+	// controls which Flows generate events at all. When it is 1, all Flows do. When it is 2,
+	// the default on recent kernels, only Flows created while a Conntrack event listener
+	// was attached to the namespace do, and Flows that existed before the first listener
+	// started will never send a destroy event. Set it to 1, or start the Listener
+	// before any traffic flows, to receive the destroy event of every Flow. When it is 0,
+	// no events are generated.
+	Reliable bool
+
+	// ReadBuffer is the initial size of the socket's receive buffer in bytes. When zero,
+	// reliable Listeners use 1 MiB and others keep the Conn's current buffer.
+	// Setting sizes above the sysctl net.core.rmem_max requires CAP_NET_ADMIN.
+	ReadBuffer int
+
+	// MaxReadBuffer is the size in bytes up to which the receive buffer is grown when it
+	// fills up or overruns. When zero, reliable Listeners grow the buffer up to 16 MiB and
+	// others don't grow it. The buffer keeps its size when the Listener is stopped.
+	MaxReadBuffer int
+}
+
+const (
+	// Default receive buffer sizes of reliable Listeners.
+	reliableReadBuffer    = 1 << 20
+	reliableMaxReadBuffer = 16 << 20
+
+	// Amount of messages received by a worker between checks of the receive buffer's fill.
+	readBufferCheckInterval = 32
+)
+
+// Listener is a handle to the event workers started by Conn.StartListener.
+// It is used to stop the workers and to wait for them to exit.
+type Listener struct {
+	// Amount of times the kernel dropped events, and the amount of messages
+	// received by the workers, accessed atomically.
+	overruns uint64
+	received uint64
+
+	c      *Conn
+	cancel context.CancelFunc
+
+	// Survive socket buffer overruns instead of halting the worker. Only
+	// the Listener API exposes the overrun counter and resync options.
+	handleOverruns bool
+	config         ListenerConfig
+
+	// Serializes the resyncs of the workers.
+	resyncMu sync.Mutex
+
+	// The size requested for the receive buffer and the size it may grow to.
+	// The buffer is not resized when maxReadBuffer is zero.
+	bufMu         sync.Mutex
+	readBuffer    int
+	maxReadBuffer int
+
+	// Receives at most one error from each worker, never blocks.
+	errChan chan error
+
+	// Closed when all workers have exited and the Conn was detached from its groups.
+	done chan struct{}
+
+	// Error leaving the multicast groups or restoring the socket options,
+	// valid once done is closed.
+	leaveErr error
+
+	waitOnce sync.Once
+	err      error
+}
+
+// StartListener is like Listen, but returns a Listener that can stop the workers and wait for
+// them to exit, instead of an error channel. When all workers have exited, either because of
+// a call to Stop or because of errors, evChan is closed and the Conn leaves its multicast groups.
+// The first error that halted a worker is returned by Wait.
+//
+// Unlike Listen, the workers survive overruns of the socket's receive buffer, in which case the
+// kernel drops events. Overruns are counted, and can be signaled on evChan using the config.
+// A nil config uses the defaults.
+func (c *Conn) StartListener(evChan chan<- Event, numWorkers uint8, groups []netfilter.NetlinkGroup, config *ListenerConfig) (*Listener, error) {
+	return c.StartListenerContext(context.Background(), evChan, numWorkers, groups, config)
+}
+
+// StartListenerContext is like StartListener, but stops all workers when ctx is cancelled,
+// like calling Stop on the Listener.
+func (c *Conn) StartListenerContext(ctx context.Context, evChan chan<- Event, numWorkers uint8,
+	groups []netfilter.NetlinkGroup, config *ListenerConfig) (*Listener, error) {
+
+	if config == nil {
+		config = &ListenerConfig{}
+	}
+
+	return c.listen(ctx, evChan, numWorkers, groups, config)
+}
+
+// listen joins the Conn to the multicast groups and starts numWorkers event workers.
+// Once all workers have exited, the Conn leaves the groups so it can be used for queries
+// or listening again. A nil config selects the behaviour of Listen: buffer overruns
+// halt the workers and evChan is left open. Otherwise, evChan is closed after the
+// workers exited.
+func (c *Conn) listen(ctx context.Context, evChan chan<- Event, numWorkers uint8,
+	groups []netfilter.NetlinkGroup, config *ListenerConfig) (*Listener, error) {
+
+	if numWorkers == 0 {
+		return nil, errors.Errorf(errWorkerCount, numWorkers)
+	}
+
+	if config != nil {
+		if err := config.check(numWorkers); err != nil {
+			return nil, err
+		}
+	}
+
+	// Prevent Listen() from being called twice on the same Conn.
+	// This is checked again in JoinGroups(), but an early failure is preferred.
+	if c.multicast() {
+		return nil, errConnHasListeners
+	}
+
+	l := &Listener{
+		c:       c,
+		errChan: make(chan error, numWorkers),
+		done:    make(chan struct{}),
+	}
+
+	if config != nil {
+		l.handleOverruns = true
+		l.config = *config
+
+		if err := l.configure(); err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.joinGroups(groups)
+	if err != nil {
+		_ = l.unconfigure()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	l.cancel = cancel
+
+	var wg sync.WaitGroup
+	wg.Add(int(numWorkers))
+
+	// Start numWorkers amount of worker goroutines
+	for id := uint8(0); id < numWorkers; id++ {
+		go func(id uint8) {
+			defer wg.Done()
+			c.eventWorker(ctx, l, id, evChan)
+		}(id)
+	}
+
+	exited := make(chan struct{})
+	unblocked := make(chan struct{})
+
+	// Unblock workers stuck in Receive when the context is cancelled.
+	go func() {
+		defer close(unblocked)
+
+		select {
+		case <-ctx.Done():
+			_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+		case <-exited:
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(exited)
+		<-unblocked
+
+		l.leaveErr = c.leaveGroups(groups)
+		if err := l.unconfigure(); l.leaveErr == nil {
+			l.leaveErr = err
+		}
+
+		// Release the context's resources when all workers exited by themselves.
+		cancel()
+
+		if config != nil {
+			close(evChan)
+		}
+
+		close(l.errChan)
+		close(l.done)
+	}()
+
+	return l, nil
+}
+
+// Stop stops the Listener's workers and waits for them to exit. Afterwards, the event channel
+// is closed and the Conn has left its multicast groups, discarding any events that were not
+// yet received. The Conn can then be used for queries, or for listening again.
+//
+// Stop can be called multiple times, and after the workers exited by themselves.
+// Returns an error if the Conn failed to leave its multicast groups, or to disable
+// reliable delivery.
+func (l *Listener) Stop() error {
+
+	l.cancel()
+	<-l.done
+
+	return l.leaveErr
+}
+
+// Wait blocks until all of the Listener's workers have exited, and returns the first error
+// that halted a worker. Returns nil if all workers were stopped using Stop or by cancelling
+// the Listener's context.
+func (l *Listener) Wait() error {
+
+	<-l.done
+
+	l.waitOnce.Do(func() {
+		for err := range l.errChan {
+			if l.err == nil {
+				l.err = err
+			}
+		}
+	})
+
+	return l.err
+}
+
+// Overruns returns the amount of times the kernel dropped events because the
+// socket's receive buffer was full.
+func (l *Listener) Overruns() uint64 {
+	return atomic.LoadUint64(&l.overruns)
+}
+
+// check returns an error if the config can't be used by a Listener with numWorkers workers.
+// Other workers would keep reading the socket and sending events during a resync.
+func (lc ListenerConfig) check(numWorkers uint8) error {
+
+	if (lc.Resync || lc.ResyncDump != nil) && numWorkers > 1 {
+		return errResyncWorkers
+	}
+
+	return nil
+}
+
+// BufferFill returns the amount of bytes used in the receive buffer of the Listener's socket,
+// and the size of the buffer. Both include the kernel's bookkeeping overhead of each message,
+// so the size is double the size requested using ListenerConfig.ReadBuffer.
+func (l *Listener) BufferFill() (used int, size int, err error) {
+	return l.c.readBufferFill()
+}
+
+// configure applies the Listener's config to the socket of its Conn.
+func (l *Listener) configure() error {
+
+	l.readBuffer = l.config.ReadBuffer
+	l.maxReadBuffer = l.config.MaxReadBuffer
+
+	if l.config.Reliable {
+		if l.readBuffer == 0 {
+			l.readBuffer = reliableReadBuffer
+		}
+		if l.maxReadBuffer == 0 {
+			l.maxReadBuffer = reliableMaxReadBuffer
+		}
+
+		if err := l.c.setReliable(true); err != nil {
+			return err
+		}
+	}
+
+	if l.readBuffer != 0 {
+		if err := l.c.setReadBuffer(l.readBuffer); err != nil {
+			_ = l.unconfigure()
+			return err
+		}
+	} else if l.maxReadBuffer != 0 {
+		// Start growing from the current size, which the kernel reports doubled.
+		_, size, err := l.c.readBufferFill()
+		if err != nil {
+			_ = l.unconfigure()
+			return err
+		}
+		l.readBuffer = size / 2
+	}
+
+	return nil
+}
+
+// unconfigure restores the socket options changed by configure, except for the
+// size of the receive buffer.
+func (l *Listener) unconfigure() error {
+
+	if l.config.Reliable {
+		return l.c.setReliable(false)
+	}
+
+	return nil
+}
+
+// receiveDone is called by a worker after receiving a message. Every readBufferCheckInterval
+// messages, it grows the receive buffer if it is more than three quarters full.
+func (l *Listener) receiveDone() error {
+
+	if l.maxReadBuffer == 0 {
+		return nil
+	}
+
+	if atomic.AddUint64(&l.received, 1)%readBufferCheckInterval != 0 {
+		return nil
+	}
+
+	used, size, err := l.c.readBufferFill()
+	if err != nil {
+		return err
+	}
+
+	if used < size/4*3 {
+		return nil
+	}
+
+	return l.growReadBuffer()
+}
+
+// growReadBuffer doubles the size of the receive buffer, up to the maximum size.
+func (l *Listener) growReadBuffer() error {
+
+	l.bufMu.Lock()
+	defer l.bufMu.Unlock()
+
+	if l.readBuffer >= l.maxReadBuffer {
+		return nil
+	}
+
+	size := l.readBuffer * 2
+	if size > l.maxReadBuffer {
+		size = l.maxReadBuffer
+	}
+
+	if err := l.c.setReadBuffer(size); err != nil {
+		return err
+	}
+
+	l.readBuffer = size
+
+	return nil
+}
+
+// overrun is called by a worker when the kernel dropped events. It counts the overrun,
+// grows the receive buffer if allowed and performs a resync if configured. Returns an
+// error if growing the buffer or the resync dump failed.
+func (l *Listener) overrun(ctx context.Context, evChan chan<- Event) error {
+
+	atomic.AddUint64(&l.overruns, 1)
+
+	if l.maxReadBuffer != 0 {
+		if err := l.growReadBuffer(); err != nil {
+			return errors.Wrap(err, opGrowReadBuffer)
+		}
+	}
+
+	if !l.config.Resync && l.config.ResyncDump == nil {
+		return nil
+	}
+
+	l.resyncMu.Lock()
+	defer l.resyncMu.Unlock()
+
+	// send sends ev on evChan, returns false if the context was cancelled.
+	send := func(ev Event) bool {
+		select {
+		case evChan <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if !send(Event{Type: EventResync, NSID: NSIDLocal}) {
+		return nil
+	}
+
+	// The kernel only reports the first overrun until the socket's queue was emptied,
+	// later events are dropped silently. Empty it, the dump supersedes the queued events.
+	if err := l.c.discard(); err != nil {
+		return errors.Wrap(err, opResyncDiscard)
+	}
+
+	if l.config.ResyncDump == nil {
+		return nil
+	}
+
+	sent := true
+	err := l.config.ResyncDump.DumpFuncContext(ctx, func(f Flow) bool {
+		sent = send(Event{Type: EventResyncFlow, Flow: &f, NSID: NSIDLocal})
+		return sent
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, opResyncDump)
+	}
+
+	if sent {
+		send(Event{Type: EventResyncDone, NSID: NSIDLocal})
+	}
+
+	return nil
+}
+
+// leaveGroups detaches the Conn from the multicast groups joined by Listen, and discards
+// any multicast messages left in the socket's receive buffer. Clears the Conn's multicast flag.
+func (c *Conn) leaveGroups(groups []netfilter.NetlinkGroup) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.isMulticast = false
+
+	// Reset the deadline that unblocked the workers.
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if err := c.conn.LeaveGroup(uint32(group)); err != nil {
+			return err
+		}
+	}
+
+	return c.discard()
+}
+
+// discard reads and drops all messages in the socket's receive buffer without blocking.
+func (c *Conn) discard() error {
+
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, os.Getpagesize())
+
+	var rerr error
+	err = rc.Control(func(fd uintptr) {
+		for {
+			_, _, _, _, rerr = unix.Recvmsg(int(fd), b, nil, unix.MSG_DONTWAIT|unix.MSG_TRUNC)
+
+			// ENOBUFS means messages were dropped by the kernel, which doesn't matter here.
+			if rerr != nil && rerr != unix.ENOBUFS && rerr != unix.EINTR {
+				break
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// An empty buffer is reported as EAGAIN.
+	if rerr == unix.EAGAIN {
+		return nil
+	}
+
+	return os.NewSyscallError("recvmsg", rerr)
+}
@@ -0,0 +1,195 @@
+package conntrack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// openMetricsContentType is the Content-Type of the OpenMetrics text format.
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Metrics is a snapshot of the Conntrack statistics of a network namespace. It can be
+// written in the OpenMetrics text format, which can be scraped by Prometheus.
+type Metrics struct {
+	Stats  []Stats
+	Expect []StatsExpect
+	Global StatsGlobal
+
+	// Flows holds the amount of Flows in the table per protocol and TCP state.
+	// It is nil when the table was not dumped.
+	Flows map[FlowClass]uint64
+}
+
+// FlowClass is a class of Flows counted in Metrics. TCPState is 0 for other protocols.
+type FlowClass struct {
+	Protocol uint8
+	TCPState uint8
+}
+
+// Metrics gets the per-CPU and global statistics of the Conntrack table and its Expects.
+// When flows is true, the table is dumped to count its Flows by protocol and TCP state.
+// Dumping can be expensive on large tables.
+func (c *Conn) Metrics(flows bool) (Metrics, error) {
+	return c.MetricsContext(context.Background(), flows)
+}
+
+// MetricsContext is like Metrics, but takes a context.Context to bound the operation.
+func (c *Conn) MetricsContext(ctx context.Context, flows bool) (Metrics, error) {
+
+	var m Metrics
+	var err error
+
+	if m.Stats, err = c.StatsContext(ctx); err != nil {
+		return Metrics{}, err
+	}
+
+	if m.Expect, err = c.StatsExpectContext(ctx); err != nil {
+		return Metrics{}, err
+	}
+
+	if m.Global, err = c.StatsGlobalContext(ctx); err != nil {
+		return Metrics{}, err
+	}
+
+	if !flows {
+		return m, nil
+	}
+
+	m.Flows = make(map[FlowClass]uint64)
+	err = c.DumpFuncContext(ctx, func(f Flow) bool {
+		fc := FlowClass{Protocol: f.TupleOrig.Proto.Protocol}
+		if f.ProtoInfo.TCP != nil {
+			fc.TCPState = f.ProtoInfo.TCP.State
+		}
+		m.Flows[fc]++
+		return true
+	})
+	if err != nil {
+		return Metrics{}, err
+	}
+
+	return m, nil
+}
+
+// MetricsHandler returns an http.Handler that serves the Metrics of c in the OpenMetrics
+// text format. See Conn.Metrics for flows.
+func MetricsHandler(c *Conn, flows bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		m, err := c.MetricsContext(r.Context(), flows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", openMetricsContentType)
+		_, _ = m.WriteTo(w)
+	})
+}
+
+// metricsCounter is a per-CPU counter exported by Metrics.
+type metricsCounter struct {
+	name, help string
+	value      func(s Stats) uint32
+}
+
+// metricsExpectCounter is a per-CPU Expect counter exported by Metrics.
+type metricsExpectCounter struct {
+	name, help string
+	value      func(s StatsExpect) uint32
+}
+
+var metricsCounters = []metricsCounter{
+	{"found", "Lookups that found an existing Flow", func(s Stats) uint32 { return s.Found }},
+	{"invalid", "Packets that could not be tracked", func(s Stats) uint32 { return s.Invalid }},
+	{"ignore", "Packets that were already tracked, or not to be tracked", func(s Stats) uint32 { return s.Ignore }},
+	{"insert", "Flows that were inserted into the table", func(s Stats) uint32 { return s.Insert }},
+	{"insert_failed", "Flows that could not be inserted into the table", func(s Stats) uint32 { return s.InsertFailed }},
+	{"drop", "Packets dropped because their Flow could not be created", func(s Stats) uint32 { return s.Drop }},
+	{"early_drop", "Flows dropped to make room for new Flows in a full table", func(s Stats) uint32 { return s.EarlyDrop }},
+	{"error", "Packets that could not be tracked because of an error", func(s Stats) uint32 { return s.Error }},
+	{"search_restart", "Table lookups restarted because the table changed", func(s Stats) uint32 { return s.SearchRestart }},
+}
+
+var metricsExpectCounters = []metricsExpectCounter{
+	{"expect_new", "Expects that were initialized", func(s StatsExpect) uint32 { return s.New }},
+	{"expect_create", "Expects that were created", func(s StatsExpect) uint32 { return s.Create }},
+	{"expect_delete", "Expects that were deleted", func(s StatsExpect) uint32 { return s.Delete }},
+}
+
+// WriteTo writes the Metrics to w in the OpenMetrics text format. Each counter is written
+// per CPU, with a cpu label, and summed over all CPUs in a metric without the _cpu infix,
+// eg. conntrack_cpu_found_total{cpu="0"} and conntrack_found_total.
+func (m Metrics) WriteTo(w io.Writer) (int64, error) {
+
+	var b bytes.Buffer
+
+	for _, c := range metricsCounters {
+		var sum uint64
+
+		writeMetricsHeader(&b, "conntrack_cpu_"+c.name, "counter", c.help+", per CPU")
+		for _, s := range m.Stats {
+			fmt.Fprintf(&b, "conntrack_cpu_%s_total{cpu=\"%d\"} %d\n", c.name, s.CPUID, c.value(s))
+			sum += uint64(c.value(s))
+		}
+
+		writeMetricsHeader(&b, "conntrack_"+c.name, "counter", c.help)
+		fmt.Fprintf(&b, "conntrack_%s_total %d\n", c.name, sum)
+	}
+
+	for _, c := range metricsExpectCounters {
+		var sum uint64
+
+		writeMetricsHeader(&b, "conntrack_cpu_"+c.name, "counter", c.help+", per CPU")
+		for _, s := range m.Expect {
+			fmt.Fprintf(&b, "conntrack_cpu_%s_total{cpu=\"%d\"} %d\n", c.name, s.CPUID, c.value(s))
+			sum += uint64(c.value(s))
+		}
+
+		writeMetricsHeader(&b, "conntrack_"+c.name, "counter", c.help)
+		fmt.Fprintf(&b, "conntrack_%s_total %d\n", c.name, sum)
+	}
+
+	writeMetricsHeader(&b, "conntrack_entries", "gauge", "Flows in the table")
+	fmt.Fprintf(&b, "conntrack_entries %d\n", m.Global.Entries)
+
+	writeMetricsHeader(&b, "conntrack_max_entries", "gauge", "Maximum amount of Flows in the table")
+	fmt.Fprintf(&b, "conntrack_max_entries %d\n", m.Global.MaxEntries)
+
+	if m.Flows != nil {
+		classes := make([]FlowClass, 0, len(m.Flows))
+		for fc := range m.Flows {
+			classes = append(classes, fc)
+		}
+		sort.Slice(classes, func(i, j int) bool {
+			if classes[i].Protocol != classes[j].Protocol {
+				return classes[i].Protocol < classes[j].Protocol
+			}
+			return classes[i].TCPState < classes[j].TCPState
+		})
+
+		writeMetricsHeader(&b, "conntrack_flows", "gauge", "Flows in the table by protocol and TCP state")
+		for _, fc := range classes {
+			if fc.Protocol == 6 {
+				fmt.Fprintf(&b, "conntrack_flows{protocol=\"tcp\",tcp_state=\"%s\"} %d\n",
+					tcpStateLookup(fc.TCPState), m.Flows[fc])
+				continue
+			}
+			fmt.Fprintf(&b, "conntrack_flows{protocol=\"%s\"} %d\n", protoLookup(fc.Protocol), m.Flows[fc])
+		}
+	}
+
+	b.WriteString("# EOF\n")
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+// writeMetricsHeader writes the TYPE and HELP lines of a metric family.
+func writeMetricsHeader(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# TYPE %s %s\n# HELP %s %s\n", name, typ, name, help)
+}
@@ -0,0 +1,60 @@
+//+build integration
+
+package conntrack
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnMetrics(t *testing.T) {
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	for i := uint16(1); i <= 3; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, i, 120, 0)
+		require.NoError(t, c.Create(f))
+	}
+
+	f := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+	require.NoError(t, c.Create(f))
+
+	m, err := c.Metrics(true)
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, m.Stats)
+	assert.EqualValues(t, 4, m.Global.Entries)
+	assert.Equal(t, map[FlowClass]uint64{
+		{Protocol: 17}:             3,
+		{Protocol: 6, TCPState: 3}: 1,
+	}, m.Flows)
+
+	m, err = c.Metrics(false)
+	require.NoError(t, err)
+	assert.Nil(t, m.Flows)
+
+	srv := httptest.NewServer(MetricsHandler(c, true))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, openMetricsContentType, resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "conntrack_entries 4\n")
+	assert.Contains(t, string(body), `conntrack_flows{protocol="udp"} 3`)
+
+	assert.NoError(t, c.Close())
+}
@@ -0,0 +1,68 @@
+package conntrack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+
+	m := Metrics{
+		Stats: []Stats{
+			{CPUID: 0, Found: 1, InsertFailed: 2},
+			{CPUID: 1, Found: 10, EarlyDrop: 3},
+		},
+		Expect: []StatsExpect{{CPUID: 0, New: 4}, {CPUID: 1, New: 5}},
+		Global: StatsGlobal{Entries: 6, MaxEntries: 65536},
+		Flows: map[FlowClass]uint64{
+			{Protocol: 17}:             2,
+			{Protocol: 6, TCPState: 3}: 7,
+			{Protocol: 6, TCPState: 7}: 1,
+			{Protocol: 1}:              1,
+		},
+	}
+
+	var b bytes.Buffer
+	n, err := m.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+
+	out := b.String()
+	for _, l := range []string{
+		"# TYPE conntrack_cpu_found counter",
+		`conntrack_cpu_found_total{cpu="0"} 1`,
+		`conntrack_cpu_found_total{cpu="1"} 10`,
+		"# TYPE conntrack_found counter",
+		"conntrack_found_total 11",
+		"conntrack_insert_failed_total 2",
+		`conntrack_cpu_early_drop_total{cpu="1"} 3`,
+		"conntrack_search_restart_total 0",
+		"conntrack_expect_new_total 9",
+		"# TYPE conntrack_entries gauge",
+		"conntrack_entries 6",
+		"conntrack_max_entries 65536",
+		`conntrack_flows{protocol="icmp"} 1`,
+		`conntrack_flows{protocol="tcp",tcp_state="ESTABLISHED"} 7`,
+		`conntrack_flows{protocol="tcp",tcp_state="TIME_WAIT"} 1`,
+		`conntrack_flows{protocol="udp"} 2`,
+	} {
+		assert.Contains(t, out, l+"\n")
+	}
+
+	// Flows are ordered by protocol and state.
+	assert.True(t, strings.Index(out, `tcp_state="ESTABLISHED"`) < strings.Index(out, `tcp_state="TIME_WAIT"`))
+	assert.True(t, strings.Index(out, `protocol="icmp"`) < strings.Index(out, `protocol="udp"`))
+
+	assert.True(t, strings.HasSuffix(out, "\n# EOF\n"))
+
+	// Flows are left out when the table was not dumped.
+	b.Reset()
+	m.Flows = nil
+	_, err = m.WriteTo(&b)
+	require.NoError(t, err)
+	assert.NotContains(t, b.String(), "conntrack_flows")
+}
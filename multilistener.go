@@ -0,0 +1,543 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/ti-mo/netfilter"
+)
+
+// NSEvent is an Event received by a MultiListener, along with the name of the
+// network namespace it was received in.
+type NSEvent struct {
+	Event
+
+	NetNS string
+}
+
+// MultiListener merges the events of many network namespaces into a single channel.
+// Namespaces are added and removed at any time, each of them is identified by a name.
+// Every namespace has its own Listener, and a separate Conn for the namespace's queries.
+//
+// The Conns of a namespace keep it alive after all of its processes exited and it was
+// unmounted, but it won't generate any more events. Call Prune to remove namespaces that
+// are no longer reachable through the path they were added with. When the Listener of a
+// namespace fails, the namespace is removed and the error is sent on errChan.
+type MultiListener struct {
+	evChan  chan<- NSEvent
+	errChan chan<- error
+
+	numWorkers uint8
+	groups     []netfilter.NetlinkGroup
+	config     ListenerConfig
+
+	mu     sync.RWMutex
+	netns  map[string]*netnsListener
+	closed bool
+
+	// Closed by Close to unblock goroutines sending errors.
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// netnsListener is a network namespace watched by a MultiListener.
+type netnsListener struct {
+	path string
+
+	// Device and inode of the namespace, used to find out if it's
+	// still reachable through the path.
+	dev, ino uint64
+
+	conn  *Conn
+	lconn *Conn
+	l     *Listener
+
+	// Closed when the namespace is removed, and when its events were forwarded.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMultiListener returns a MultiListener that sends the events of its namespaces on evChan.
+// numWorkers, groups and config are used to start the Listener of each namespace, see
+// Conn.StartListener. Errors of the Listeners are sent on errChan if it is not nil, which
+// needs to be read from until Close returns. When config.ResyncDump is set, each namespace's
+// table is dumped using its own Conn instead.
+func NewMultiListener(evChan chan<- NSEvent, errChan chan<- error, numWorkers uint8,
+	groups []netfilter.NetlinkGroup, config *ListenerConfig) (*MultiListener, error) {
+
+	if numWorkers == 0 {
+		return nil, errors.Errorf(errWorkerCount, numWorkers)
+	}
+
+	if len(groups) == 0 {
+		return nil, errNoMulticastGroups
+	}
+
+	if config != nil {
+		if err := config.check(numWorkers); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &MultiListener{
+		evChan:     evChan,
+		errChan:    errChan,
+		numWorkers: numWorkers,
+		groups:     groups,
+		netns:      make(map[string]*netnsListener),
+		closing:    make(chan struct{}),
+	}
+
+	if config != nil {
+		m.config = *config
+	}
+
+	return m, nil
+}
+
+// Add starts listening for events in the network namespace at path, eg. /proc/<pid>/ns/net,
+// and names it name. Returns an error if the name is taken.
+func (m *MultiListener) Add(name, path string) error {
+
+	// Opening the namespace takes a while, don't block the other operations
+	// of the MultiListener in the meantime.
+	m.mu.RLock()
+	err := m.addable(name)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return err
+	}
+
+	n := &netnsListener{
+		path: path,
+		dev:  uint64(st.Dev),
+		ino:  uint64(st.Ino),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	n.conn, err = DialNetNS(path)
+	if err != nil {
+		return err
+	}
+
+	n.lconn, err = DialNetNS(path)
+	if err != nil {
+		n.conn.Close()
+		return err
+	}
+
+	config := m.config
+	if config.ResyncDump != nil {
+		config.ResyncDump = n.conn
+	}
+
+	ev := make(chan Event)
+	n.l, err = n.lconn.StartListener(ev, m.numWorkers, m.groups, &config)
+	if err != nil {
+		n.close()
+		return err
+	}
+
+	m.mu.Lock()
+	err = m.addable(name)
+	if err == nil {
+		m.netns[name] = n
+		m.wg.Add(1)
+	}
+	m.mu.Unlock()
+
+	// The name was taken or the MultiListener was closed while the namespace
+	// was being opened.
+	if err != nil {
+		go func() {
+			for range ev {
+			}
+		}()
+		_ = n.l.Stop()
+		n.close()
+		return err
+	}
+
+	go func() {
+		defer m.wg.Done()
+		m.forward(name, n, ev)
+	}()
+
+	return nil
+}
+
+// addable returns an error if a namespace can't be added with the given name.
+// m.mu must be held by the caller.
+func (m *MultiListener) addable(name string) error {
+
+	if m.closed {
+		return errMultiListenerClosed
+	}
+
+	if _, ok := m.netns[name]; ok {
+		return fmt.Errorf(errNetNSExists, name)
+	}
+
+	return nil
+}
+
+// forward sends the events of the namespace on the MultiListener's channel until
+// its Listener exits. When the Listener failed, the namespace is removed.
+func (m *MultiListener) forward(name string, n *netnsListener, ev <-chan Event) {
+
+	defer close(n.done)
+
+	for e := range ev {
+		select {
+		case m.evChan <- NSEvent{Event: e, NetNS: name}:
+		case <-n.stop:
+			// Drain the events of the stopping Listener.
+			for range ev {
+			}
+			return
+		}
+	}
+
+	err := n.l.Wait()
+	if err == nil {
+		return
+	}
+
+	m.mu.Lock()
+	owned := m.netns[name] == n
+	if owned {
+		delete(m.netns, name)
+	}
+	m.mu.Unlock()
+
+	// The namespace was removed while the Listener failed.
+	if !owned {
+		return
+	}
+
+	n.close()
+
+	if m.errChan == nil {
+		return
+	}
+
+	select {
+	case m.errChan <- errors.Wrap(err, fmt.Sprintf(errNetNSListener, name)):
+	case <-m.closing:
+	}
+}
+
+// Remove stops listening for events in the namespace with the given name, and closes its Conns.
+func (m *MultiListener) Remove(name string) error {
+
+	m.mu.Lock()
+	n, ok := m.netns[name]
+	if ok {
+		delete(m.netns, name)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf(errNetNSNotFound, name)
+	}
+
+	return n.remove()
+}
+
+// Prune removes all namespaces that can no longer be reached through the path they were
+// added with, because the path no longer exists or refers to another namespace.
+// Returns the names of the removed namespaces.
+func (m *MultiListener) Prune() []string {
+
+	var pruned []string
+	var removed []*netnsListener
+
+	m.mu.Lock()
+	for name, n := range m.netns {
+		var st syscall.Stat_t
+		if err := syscall.Stat(n.path, &st); err == nil && uint64(st.Dev) == n.dev && uint64(st.Ino) == n.ino {
+			continue
+		}
+
+		delete(m.netns, name)
+		pruned = append(pruned, name)
+		removed = append(removed, n)
+	}
+	m.mu.Unlock()
+
+	// Don't hold the lock while waiting for the Listeners.
+	for _, n := range removed {
+		_ = n.remove()
+	}
+
+	sort.Strings(pruned)
+
+	return pruned
+}
+
+// Namespaces returns the sorted names of the MultiListener's namespaces.
+func (m *MultiListener) Namespaces() []string {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.netns))
+	for name := range m.netns {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Close removes all namespaces and closes evChan.
+func (m *MultiListener) Close() error {
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+
+	netns := m.netns
+	m.netns = make(map[string]*netnsListener)
+	m.mu.Unlock()
+
+	close(m.closing)
+
+	var err error
+	for _, n := range netns {
+		if rerr := n.remove(); err == nil {
+			err = rerr
+		}
+	}
+
+	m.wg.Wait()
+	close(m.evChan)
+
+	return err
+}
+
+// Dump gets all Flows in the namespace with the given name.
+func (m *MultiListener) Dump(name string) ([]Flow, error) {
+	return m.DumpContext(context.Background(), name)
+}
+
+// DumpContext is like Dump, but takes a context.Context to bound the operation.
+func (m *MultiListener) DumpContext(ctx context.Context, name string) ([]Flow, error) {
+
+	c, err := m.conn(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.DumpContext(ctx)
+}
+
+// DumpAll gets all Flows of all namespaces, by namespace name. When dumping a namespace
+// fails, the Flows of all other namespaces are returned along with the first error.
+func (m *MultiListener) DumpAll() (map[string][]Flow, error) {
+	return m.DumpAllContext(context.Background())
+}
+
+// DumpAllContext is like DumpAll, but takes a context.Context to bound the operation.
+func (m *MultiListener) DumpAllContext(ctx context.Context) (map[string][]Flow, error) {
+
+	out := make(map[string][]Flow)
+
+	err := m.each(func(name string, c *Conn) error {
+		flows, err := c.DumpContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		out[name] = flows
+		return nil
+	})
+
+	return out, err
+}
+
+// Stats gets the per-CPU performance counters of the namespace with the given name.
+func (m *MultiListener) Stats(name string) ([]Stats, error) {
+	return m.StatsContext(context.Background(), name)
+}
+
+// StatsContext is like Stats, but takes a context.Context to bound the operation.
+func (m *MultiListener) StatsContext(ctx context.Context, name string) ([]Stats, error) {
+
+	c, err := m.conn(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.StatsContext(ctx)
+}
+
+// StatsAll gets the per-CPU performance counters of all namespaces, summed per CPU.
+// Like DumpAll, the counters of all other namespaces are returned when a namespace fails.
+func (m *MultiListener) StatsAll() ([]Stats, error) {
+	return m.StatsAllContext(context.Background())
+}
+
+// StatsAllContext is like StatsAll, but takes a context.Context to bound the operation.
+func (m *MultiListener) StatsAllContext(ctx context.Context) ([]Stats, error) {
+
+	var out []Stats
+
+	err := m.each(func(name string, c *Conn) error {
+		stats, err := c.StatsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		out = sumStats(out, stats)
+		return nil
+	})
+
+	return out, err
+}
+
+// StatsGlobal gets the global counters of the namespace with the given name.
+func (m *MultiListener) StatsGlobal(name string) (StatsGlobal, error) {
+	return m.StatsGlobalContext(context.Background(), name)
+}
+
+// StatsGlobalContext is like StatsGlobal, but takes a context.Context to bound the operation.
+func (m *MultiListener) StatsGlobalContext(ctx context.Context, name string) (StatsGlobal, error) {
+
+	c, err := m.conn(name)
+	if err != nil {
+		return StatsGlobal{}, err
+	}
+
+	return c.StatsGlobalContext(ctx)
+}
+
+// StatsGlobalAll gets the sum of the Entries of all namespaces. The namespaces share
+// their MaxEntries, the largest one is returned. Like DumpAll, the counters of all
+// other namespaces are returned when a namespace fails.
+func (m *MultiListener) StatsGlobalAll() (StatsGlobal, error) {
+	return m.StatsGlobalAllContext(context.Background())
+}
+
+// StatsGlobalAllContext is like StatsGlobalAll, but takes a context.Context to bound the operation.
+func (m *MultiListener) StatsGlobalAllContext(ctx context.Context) (StatsGlobal, error) {
+
+	var out StatsGlobal
+
+	err := m.each(func(name string, c *Conn) error {
+		sg, err := c.StatsGlobalContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		out.Entries += sg.Entries
+		if sg.MaxEntries > out.MaxEntries {
+			out.MaxEntries = sg.MaxEntries
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+// conn returns the query Conn of the namespace with the given name.
+func (m *MultiListener) conn(name string) (*Conn, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n, ok := m.netns[name]
+	if !ok {
+		return nil, fmt.Errorf(errNetNSNotFound, name)
+	}
+
+	return n.conn, nil
+}
+
+// each calls fn with the query Conn of every namespace, in order of their names.
+// Returns the first error returned by fn, annotated with the namespace's name.
+func (m *MultiListener) each(fn func(name string, c *Conn) error) error {
+
+	var err error
+	for _, name := range m.Namespaces() {
+
+		// Skip namespaces removed in the meantime.
+		c, cerr := m.conn(name)
+		if cerr != nil {
+			continue
+		}
+
+		if ferr := fn(name, c); ferr != nil && err == nil {
+			err = errors.Wrap(ferr, fmt.Sprintf(errNetNSListener, name))
+		}
+	}
+
+	return err
+}
+
+// sumStats adds the counters in stats to the counters of the same CPU in sum.
+func sumStats(sum, stats []Stats) []Stats {
+
+	for _, s := range stats {
+
+		i := sort.Search(len(sum), func(i int) bool { return sum[i].CPUID >= s.CPUID })
+		if i == len(sum) || sum[i].CPUID != s.CPUID {
+			sum = append(sum, Stats{})
+			copy(sum[i+1:], sum[i:])
+			sum[i] = Stats{CPUID: s.CPUID}
+		}
+
+		t := &sum[i]
+		t.Found += s.Found
+		t.Invalid += s.Invalid
+		t.Ignore += s.Ignore
+		t.Insert += s.Insert
+		t.InsertFailed += s.InsertFailed
+		t.Drop += s.Drop
+		t.EarlyDrop += s.EarlyDrop
+		t.Error += s.Error
+		t.SearchRestart += s.SearchRestart
+	}
+
+	return sum
+}
+
+// remove stops the namespace's Listener, waits for its events to be forwarded,
+// and closes its Conns.
+func (n *netnsListener) remove() error {
+
+	close(n.stop)
+	err := n.l.Stop()
+	<-n.done
+
+	if cerr := n.close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// close closes the namespace's Conns.
+func (n *netnsListener) close() error {
+
+	err := n.lconn.Close()
+	if cerr := n.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
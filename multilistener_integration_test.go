@@ -0,0 +1,183 @@
+//+build integration
+
+package conntrack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/netfilter"
+)
+
+func TestMultiListener(t *testing.T) {
+
+	ev := make(chan NSEvent)
+	errChan := make(chan error)
+
+	_, err := NewMultiListener(ev, errChan, 0, netfilter.GroupsCT, nil)
+	assert.EqualError(t, err, "invalid worker count 0")
+
+	_, err = NewMultiListener(ev, errChan, 1, nil, nil)
+	assert.EqualError(t, err, errNoMulticastGroups.Error())
+
+	m, err := NewMultiListener(ev, errChan, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew}, nil)
+	require.NoError(t, err)
+
+	// Create two namespaces, each with a Conn to create Flows in.
+	conns := make(map[string]*Conn)
+	fds := make(map[string]int)
+	for _, name := range []string{"a", "b"} {
+		c, fd, err := makeNSConn()
+		require.NoError(t, err)
+
+		require.NoError(t, m.Add(name, fmt.Sprintf("/proc/self/fd/%d", fd)))
+
+		conns[name], fds[name] = c, fd
+	}
+
+	assert.EqualError(t, m.Add("a", "/proc/self/ns/net"), "network namespace 'a' already exists")
+	assert.Equal(t, []string{"a", "b"}, m.Namespaces())
+
+	fa := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	require.NoError(t, conns["a"].Create(fa))
+
+	fb := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 81, 120, 0)
+	require.NoError(t, conns["b"].Create(fb))
+
+	// Events are tagged with the name of their namespace.
+	got := make(map[string]uint16)
+	for len(got) < 2 {
+		select {
+		case re := <-ev:
+			assert.Equal(t, EventNew, re.Type)
+			got[re.NetNS] = re.Flow.TupleOrig.Proto.DestinationPort
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for events")
+		}
+	}
+	assert.Equal(t, map[string]uint16{"a": 80, "b": 81}, got)
+
+	flows, err := m.Dump("a")
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+
+	all, err := m.DumpAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Len(t, all["b"], 1)
+
+	_, err = m.Dump("c")
+	assert.EqualError(t, err, "no network namespace named 'c'")
+
+	stats, err := m.Stats("a")
+	require.NoError(t, err)
+	sa, err := m.StatsAll()
+	require.NoError(t, err)
+	assert.Len(t, sa, len(stats))
+
+	var inserts uint32
+	for _, s := range sa {
+		inserts += s.Insert
+	}
+	assert.Equal(t, uint32(2), inserts)
+
+	sg, err := m.StatsGlobalAll()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), sg.Entries)
+
+	// Namespace b disappears when its file descriptor is closed.
+	assert.Empty(t, m.Prune())
+	require.NoError(t, unix.Close(fds["b"]))
+	assert.Equal(t, []string{"b"}, m.Prune())
+	assert.Equal(t, []string{"a"}, m.Namespaces())
+
+	require.NoError(t, m.Remove("a"))
+	assert.EqualError(t, m.Remove("a"), "no network namespace named 'a'")
+
+	// No events of removed namespaces are received.
+	require.NoError(t, conns["a"].Create(fb))
+
+	require.NoError(t, m.Close())
+	_, ok := <-ev
+	assert.False(t, ok, "evChan not closed")
+
+	assert.Equal(t, errMultiListenerClosed, m.Add("a", "/proc/self/ns/net"))
+
+	for _, c := range conns {
+		assert.NoError(t, c.Close())
+	}
+}
+
+func TestMultiListenerAddRace(t *testing.T) {
+
+	ev := make(chan NSEvent)
+
+	m, err := NewMultiListener(ev, nil, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew}, nil)
+	require.NoError(t, err)
+
+	c, fd, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+	defer unix.Close(fd)
+
+	before := openSockets(t)
+
+	// Namespaces are opened without holding the MultiListener's lock, only one
+	// of the concurrent Adds of a name wins, the others close their Conns.
+	const adds = 8
+
+	// Let the Adds open the namespace at the same time on machines with few CPUs.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(adds))
+
+	start := make(chan struct{})
+	errs := make(chan error, adds)
+	for i := 0; i < adds; i++ {
+		go func() {
+			<-start
+			errs <- m.Add("a", fmt.Sprintf("/proc/self/fd/%d", fd))
+		}()
+	}
+	close(start)
+
+	var added int
+	for i := 0; i < adds; i++ {
+		if err := <-errs; err == nil {
+			added++
+		} else {
+			assert.EqualError(t, err, "network namespace 'a' already exists")
+		}
+	}
+	assert.Equal(t, 1, added)
+	assert.Equal(t, []string{"a"}, m.Namespaces())
+
+	require.NoError(t, m.Close())
+	assert.Equal(t, before, openSockets(t))
+}
+
+// openSockets returns the number of sockets opened by the current process.
+func openSockets(t *testing.T) int {
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+
+	var n int
+	for _, fd := range fds {
+		l, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(l, "socket:") {
+			n++
+		}
+	}
+
+	return n
+}
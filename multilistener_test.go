@@ -0,0 +1,40 @@
+package conntrack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestSumStats(t *testing.T) {
+
+	var sum []Stats
+
+	sum = sumStats(sum, []Stats{{CPUID: 1, Found: 1, Insert: 2}, {CPUID: 3, Drop: 4}})
+	sum = sumStats(sum, []Stats{{CPUID: 0, Error: 1}, {CPUID: 1, Found: 2, SearchRestart: 1}, {CPUID: 3, Drop: 1}})
+
+	assert.Equal(t, []Stats{
+		{CPUID: 0, Error: 1},
+		{CPUID: 1, Found: 3, Insert: 2, SearchRestart: 1},
+		{CPUID: 3, Drop: 5},
+	}, sum)
+}
+
+func TestNewMultiListenerResyncWorkers(t *testing.T) {
+
+	ev := make(chan NSEvent)
+	groups := []netfilter.NetlinkGroup{netfilter.GroupCTNew}
+
+	_, err := NewMultiListener(ev, nil, 2, groups, &ListenerConfig{Resync: true})
+	assert.Equal(t, errResyncWorkers, err)
+
+	_, err = NewMultiListener(ev, nil, 2, groups, &ListenerConfig{ResyncDump: &Conn{}})
+	assert.Equal(t, errResyncWorkers, err)
+
+	_, err = NewMultiListener(ev, nil, 2, groups, &ListenerConfig{Reliable: true})
+	assert.NoError(t, err)
+
+	_, err = NewMultiListener(ev, nil, 1, groups, &ListenerConfig{Resync: true})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,494 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NetFlow v9 message format constants, see RFC 3954.
+const (
+	netflowVersion       = 9
+	netflowHeaderLen     = 20
+	netflowTemplateSetID = 0
+
+	netflowTemplateIPv4 = 256
+	netflowTemplateIPv6 = 257
+
+	netflowDefaultActiveTimeout   = 30 * time.Minute
+	netflowDefaultInactiveTimeout = 15 * time.Second
+)
+
+// NetFlow v9 field types without an equal IPFIX information element in use.
+const (
+	nfLastSwitched  = 21
+	nfFirstSwitched = 22
+	nfOutBytes      = 23
+	nfOutPkts       = 24
+	nfNATEvent      = 230
+)
+
+// Values of the NetFlow v9 NAT_EVENT field.
+const (
+	natEventNone   = 0
+	natEventDelete = 2
+)
+
+// NetFlowConfig holds the options of a NetFlowExporter. The zero value uses the defaults.
+type NetFlowConfig struct {
+	// SourceID identifies the exporter's observation domain to the collector.
+	SourceID uint32
+
+	// TemplateRefresh is the interval at which the templates are sent again over UDP.
+	// Defaults to 10 minutes. Over TCP, the templates are only sent once.
+	TemplateRefresh time.Duration
+
+	// MaxMessageSize is the maximum size of an export packet. Defaults to 1400 bytes,
+	// so a UDP datagram fits in an Ethernet frame.
+	MaxMessageSize int
+
+	// Flows passed to ExportActive are exported when they have been active for longer than
+	// ActiveTimeout since they started or were last exported, or when their counters did
+	// not change for InactiveTimeout. Default to 30 minutes and 15 seconds.
+	ActiveTimeout, InactiveTimeout time.Duration
+}
+
+// NetFlowExporter exports the Records of connections to a NetFlow v9 (RFC 3954) collector over
+// UDP or TCP. It is a RecordSink, so it can export the Records built by an Aggregator.
+//
+// The original tuple is exported in the source and destination address and port fields, with
+// the counters of the original direction in IN_BYTES and IN_PKTS, and those of the reply
+// direction in OUT_BYTES and OUT_PKTS. The addresses and ports of the original direction after
+// NAT are exported in the NAT fields of NetFlow v9 (225-228, and 281-282 for IPv6), which are
+// equal to the original ones for Flows without NAT. The NAT_EVENT of the final Records of
+// Flows with NAT is a delete event (2).
+//
+// FIRST_SWITCHED and LAST_SWITCHED are relative to the system uptime in the packet header,
+// which counts the milliseconds since the NetFlowExporter was created. Like on a router,
+// times before its creation wrap around.
+//
+// Conntrack only reports the counters of a Flow when it is destroyed. To export long-lived
+// Flows periodically, pass dumps of the table to ExportActive, see NetFlowConfig.
+type NetFlowExporter struct {
+	conn     net.Conn
+	datagram bool
+
+	source   uint32
+	refresh  time.Duration
+	size     int
+	active   time.Duration
+	inactive time.Duration
+
+	templates [2]exportTemplate
+
+	boot time.Time
+	now  func() time.Time
+
+	mu            sync.Mutex
+	seq           uint32
+	templatesSent time.Time
+
+	// Set while exporting the interim Records of active Flows.
+	interim bool
+
+	// Counters of active Flows exported by ExportActive.
+	flows map[aggregatorKey]*netflowActive
+}
+
+// netflowActive is the export state of an active Flow.
+type netflowActive struct {
+	// Start of the period that was not exported yet.
+	start time.Time
+
+	// The counters that were exported, and the last counters seen.
+	exportedOrig, exportedReply Counter
+	orig, reply                 Counter
+
+	// When the counters last changed, and when the Flow was last seen in a dump.
+	changed, seen time.Time
+}
+
+// DialNetFlow connects to the NetFlow v9 collector at address, see net.Dial, and returns a
+// NetFlowExporter that exports Records to it. network must be one of the UDP or TCP networks.
+// A nil config uses the defaults.
+func DialNetFlow(network, address string, config *NetFlowConfig) (*NetFlowExporter, error) {
+
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := NewNetFlowExporter(c, config)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// NewNetFlowExporter returns a NetFlowExporter that exports Records over conn. Each packet is
+// written with a single call to conn.Write, so a UDP conn sends one packet per datagram.
+// A nil config uses the defaults.
+func NewNetFlowExporter(conn net.Conn, config *NetFlowConfig) (*NetFlowExporter, error) {
+
+	var cfg NetFlowConfig
+	if config != nil {
+		cfg = *config
+	}
+
+	if cfg.TemplateRefresh == 0 {
+		cfg.TemplateRefresh = exportDefaultTemplateRefresh
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = exportDefaultMessageSize
+	}
+	if cfg.ActiveTimeout == 0 {
+		cfg.ActiveTimeout = netflowDefaultActiveTimeout
+	}
+	if cfg.InactiveTimeout == 0 {
+		cfg.InactiveTimeout = netflowDefaultInactiveTimeout
+	}
+
+	e := &NetFlowExporter{
+		conn:     conn,
+		datagram: isDatagram(conn),
+		source:   cfg.SourceID,
+		refresh:  cfg.TemplateRefresh,
+		size:     cfg.MaxMessageSize,
+		active:   cfg.ActiveTimeout,
+		inactive: cfg.InactiveTimeout,
+		boot:     time.Now(),
+		now:      time.Now,
+		flows:    make(map[aggregatorKey]*netflowActive),
+	}
+
+	e.templates = e.netflowTemplates()
+
+	// The first packet holds the templates and a record of the largest template.
+	min := netflowHeaderLen + exportSetHeaderLen + exportSetHeaderLen + 3
+	for _, t := range e.templates {
+		min += t.netflowLen()
+	}
+	min += e.templates[1].length + 3
+
+	if e.size < min || e.size > 0xffff {
+		return nil, errExportMessageSize
+	}
+
+	return e, nil
+}
+
+// Close closes the NetFlowExporter's connection.
+func (e *NetFlowExporter) Close() error {
+	return e.conn.Close()
+}
+
+// WriteRecord exports a single Record.
+func (e *NetFlowExporter) WriteRecord(r Record) error {
+	return e.Export(r)
+}
+
+// ExportFlow exports the Flow of a destroy event. The start and end of the Flow are taken
+// from its Timestamp. When the kernel did not report it, both are set to the current time.
+func (e *NetFlowExporter) ExportFlow(f Flow) error {
+
+	r := newRecord(f, NSIDLocal)
+
+	if r.Stop.IsZero() {
+		r.Stop = e.now()
+	}
+	if r.Start.IsZero() {
+		r.Start = r.Stop
+	}
+
+	return e.Export(r)
+}
+
+// Export exports the Records of connections that ended, in as few packets as possible.
+// When the Flow of a Record was exported by ExportActive, only the counters and the
+// duration since it was last exported are exported.
+func (e *NetFlowExporter) Export(records ...Record) error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	recs := make([]Record, len(records))
+	copy(recs, records)
+
+	for i := range recs {
+		r := &recs[i]
+
+		k := aggregatorKey{r.NSID, r.ID}
+		st, ok := e.flows[k]
+		if !ok {
+			continue
+		}
+		delete(e.flows, k)
+
+		r.CountersOrig = subCounter(r.CountersOrig, st.exportedOrig)
+		r.CountersReply = subCounter(r.CountersReply, st.exportedReply)
+		r.Start = st.start
+		r.Duration = r.Stop.Sub(r.Start)
+	}
+
+	return e.export(recs, e.now())
+}
+
+// ExportActive exports interim Records of the Flows that are still active, like the Flows
+// dumped from the Conntrack table with Conn.Dump. Only Flows that reached the ActiveTimeout
+// or InactiveTimeout are exported, with the counters since they were last exported.
+// Call it periodically, with a period shorter than the InactiveTimeout.
+//
+// The counters of the Flows are only dumped when the net.netfilter.nf_conntrack_acct sysctl
+// is enabled. Flows are identified by their ID in the namespace of the Records with NSIDLocal.
+// Flows that were not passed to ExportActive for longer than the ActiveTimeout are forgotten.
+func (e *NetFlowExporter) ExportActive(flows ...Flow) error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+
+	var recs []Record
+	for _, f := range flows {
+		k := aggregatorKey{NSIDLocal, f.ID}
+
+		st, ok := e.flows[k]
+		if !ok {
+			st = &netflowActive{start: f.Timestamp.Start, changed: now}
+			if st.start.IsZero() {
+				st.start = now
+			}
+			e.flows[k] = st
+		}
+
+		st.seen = now
+		if f.CountersOrig != st.orig || f.CountersReply != st.reply {
+			st.orig, st.reply = f.CountersOrig, f.CountersReply
+			st.changed = now
+		}
+
+		orig := subCounter(f.CountersOrig, st.exportedOrig)
+		reply := subCounter(f.CountersReply, st.exportedReply)
+		if orig.Packets == 0 && reply.Packets == 0 {
+			continue
+		}
+
+		// An inactive Flow ended its period when its counters last changed.
+		stop := now
+		if now.Sub(st.changed) >= e.inactive {
+			stop = st.changed
+		} else if now.Sub(st.start) < e.active {
+			continue
+		}
+
+		r := newRecord(f, NSIDLocal)
+		r.CountersOrig, r.CountersReply = orig, reply
+		r.Start, r.Stop = st.start, stop
+		r.Duration = r.Stop.Sub(r.Start)
+		recs = append(recs, r)
+
+		st.exportedOrig, st.exportedReply = f.CountersOrig, f.CountersReply
+		st.start = stop
+	}
+
+	for k, st := range e.flows {
+		if now.Sub(st.seen) > e.active {
+			delete(e.flows, k)
+		}
+	}
+
+	e.interim = true
+	defer func() { e.interim = false }()
+
+	return e.export(recs, now)
+}
+
+// export exports Records in as few packets as possible.
+func (e *NetFlowExporter) export(records []Record, now time.Time) error {
+
+	m := e.newMessage(now)
+	for i := range records {
+		t := &e.templates[0]
+		if !isIPv4(records[i].TupleOrig) {
+			t = &e.templates[1]
+		}
+
+		if !m.fits(t, e.size) {
+			if err := e.send(m, now); err != nil {
+				return err
+			}
+			m = e.newMessage(now)
+		}
+
+		m.add(t, &records[i])
+	}
+
+	if m.records == 0 {
+		return nil
+	}
+
+	return e.send(m, now)
+}
+
+// newMessage starts an export packet, holding the templates when they need to be sent.
+func (e *NetFlowExporter) newMessage(now time.Time) *exportMessage {
+
+	m := &exportMessage{
+		b:     make([]byte, netflowHeaderLen, e.size),
+		set:   -1,
+		align: true,
+	}
+
+	if e.templatesSent.IsZero() || (e.datagram && now.Sub(e.templatesSent) >= e.refresh) {
+		m.templates = true
+		m.startSet(netflowTemplateSetID)
+		for _, t := range e.templates {
+			m.b = t.appendNetFlow(m.b)
+		}
+	}
+
+	return m
+}
+
+// send completes the header of an export packet and writes it to the connection.
+func (e *NetFlowExporter) send(m *exportMessage, now time.Time) error {
+
+	m.endSet()
+
+	// The count includes the template records.
+	count := m.records
+	if m.templates {
+		count += uint32(len(e.templates))
+	}
+
+	binary.BigEndian.PutUint16(m.b[0:2], netflowVersion)
+	binary.BigEndian.PutUint16(m.b[2:4], uint16(count))
+	binary.BigEndian.PutUint32(m.b[4:8], e.uptime(now))
+	binary.BigEndian.PutUint32(m.b[8:12], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(m.b[12:16], e.seq)
+	binary.BigEndian.PutUint32(m.b[16:20], e.source)
+
+	if _, err := e.conn.Write(m.b); err != nil {
+		return errors.Wrap(err, opExportNetFlow)
+	}
+
+	// Unlike in IPFIX, the sequence number counts the packets.
+	e.seq++
+	if m.templates {
+		e.templatesSent = now
+	}
+
+	return nil
+}
+
+// uptime returns the milliseconds between the creation of the exporter and t.
+func (e *NetFlowExporter) uptime(t time.Time) uint32 {
+	return uint32(int64(t.Sub(e.boot) / time.Millisecond))
+}
+
+// netflowTemplates returns the IPv4 and IPv6 templates of NetFlow v9 packets.
+func (e *NetFlowExporter) netflowTemplates() [2]exportTemplate {
+
+	common := []exportField{
+		{id: ieProtocolIdentifier, length: 1, put: putProtocol},
+		{id: ieSourceTransportPort, length: 2, put: putSourcePort},
+		{id: ieDestinationTransportPort, length: 2, put: putDestinationPort},
+		{id: iePostNAPTSourceTransportPort, length: 2, put: putPostNATSourcePort},
+		{id: iePostNAPTDestinationTransportPort, length: 2, put: putPostNATDestinationPort},
+		{id: ieOctetDeltaCount, length: 8, put: putOctetsOrig},
+		{id: iePacketDeltaCount, length: 8, put: putPacketsOrig},
+		{id: nfOutBytes, length: 8, put: putOctetsReply},
+		{id: nfOutPkts, length: 8, put: putPacketsReply},
+		{id: nfFirstSwitched, length: 4, put: e.putFirstSwitched},
+		{id: nfLastSwitched, length: 4, put: e.putLastSwitched},
+		{id: nfNATEvent, length: 1, put: e.putNATEvent},
+	}
+
+	v4 := []exportField{
+		{id: ieSourceIPv4Address, length: 4, put: putSourceAddress},
+		{id: ieDestinationIPv4Address, length: 4, put: putDestinationAddress},
+		{id: iePostNATSourceIPv4Address, length: 4, put: putPostNATSourceAddress},
+		{id: iePostNATDestinationIPv4Address, length: 4, put: putPostNATDestinationAddress},
+		{id: ieICMPTypeCodeIPv4, length: 2, put: putICMPTypeCode},
+	}
+
+	v6 := []exportField{
+		{id: ieSourceIPv6Address, length: 16, put: putSourceAddress},
+		{id: ieDestinationIPv6Address, length: 16, put: putDestinationAddress},
+		{id: iePostNATSourceIPv6Address, length: 16, put: putPostNATSourceAddress},
+		{id: iePostNATDestinationIPv6Address, length: 16, put: putPostNATDestinationAddress},
+		{id: ieICMPTypeCodeIPv6, length: 2, put: putICMPTypeCode},
+	}
+
+	return [2]exportTemplate{
+		newExportTemplate(netflowTemplateIPv4, append(v4, common...)),
+		newExportTemplate(netflowTemplateIPv6, append(v6, common...)),
+	}
+}
+
+func (e *NetFlowExporter) putFirstSwitched(b []byte, r *Record) {
+	binary.BigEndian.PutUint32(b, e.uptime(r.Start))
+}
+
+func (e *NetFlowExporter) putLastSwitched(b []byte, r *Record) {
+	binary.BigEndian.PutUint32(b, e.uptime(r.Stop))
+}
+
+// putNATEvent writes a delete event for the final Records of Flows with NAT.
+func (e *NetFlowExporter) putNATEvent(b []byte, r *Record) {
+
+	b[0] = natEventNone
+	if !e.interim && hasNAT(r) {
+		b[0] = natEventDelete
+	}
+}
+
+// netflowLen returns the length of the template's NetFlow v9 template record.
+func (t exportTemplate) netflowLen() int {
+	return 4 + 4*len(t.fields)
+}
+
+// appendNetFlow appends the template's NetFlow v9 template record to b.
+func (t exportTemplate) appendNetFlow(b []byte) []byte {
+
+	b = appendUint16(b, t.id)
+	b = appendUint16(b, uint16(len(t.fields)))
+
+	for _, f := range t.fields {
+		b = appendUint16(b, f.id)
+		b = appendUint16(b, f.length)
+	}
+
+	return b
+}
+
+// hasNAT returns true if the addresses or ports of a Record's reply tuple are not
+// those of its original tuple.
+func hasNAT(r *Record) bool {
+
+	o, rp := r.TupleOrig, r.TupleReply
+
+	return !o.IP.SourceAddress.Equal(rp.IP.DestinationAddress) ||
+		!o.IP.DestinationAddress.Equal(rp.IP.SourceAddress) ||
+		o.Proto.SourcePort != rp.Proto.DestinationPort ||
+		o.Proto.DestinationPort != rp.Proto.SourcePort
+}
+
+// subCounter returns the packets and bytes counted by c since it counted base.
+// Returns c if it was reset since.
+func subCounter(c, base Counter) Counter {
+
+	if c.Packets < base.Packets || c.Bytes < base.Bytes {
+		return c
+	}
+
+	c.Packets -= base.Packets
+	c.Bytes -= base.Bytes
+
+	return c
+}
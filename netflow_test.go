@@ -0,0 +1,234 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// netflowPacket is a decoded NetFlow v9 export packet.
+type netflowPacket struct {
+	version, count     uint16
+	uptime, unixSecs   uint32
+	seq, source        uint32
+	templates, records int
+
+	data []map[uint16][]byte
+}
+
+// netflowField is a field of a decoded NetFlow v9 template.
+type netflowField struct {
+	typ    uint16
+	length int
+}
+
+// decodeNetFlow decodes a NetFlow v9 packet, using and adding to the given templates.
+func decodeNetFlow(t *testing.T, b []byte, templates map[uint16][]netflowField) netflowPacket {
+
+	t.Helper()
+
+	require.True(t, len(b) >= netflowHeaderLen)
+
+	p := netflowPacket{
+		version:  binary.BigEndian.Uint16(b[0:2]),
+		count:    binary.BigEndian.Uint16(b[2:4]),
+		uptime:   binary.BigEndian.Uint32(b[4:8]),
+		unixSecs: binary.BigEndian.Uint32(b[8:12]),
+		seq:      binary.BigEndian.Uint32(b[12:16]),
+		source:   binary.BigEndian.Uint32(b[16:20]),
+	}
+
+	for b = b[netflowHeaderLen:]; len(b) > 0; {
+		id := binary.BigEndian.Uint16(b[0:2])
+		l := int(binary.BigEndian.Uint16(b[2:4]))
+		require.True(t, l >= exportSetHeaderLen && l <= len(b))
+		require.Zero(t, l%4, "FlowSet not padded")
+
+		set := b[exportSetHeaderLen:l]
+		b = b[l:]
+
+		if id == netflowTemplateSetID {
+			for len(set) >= 4 {
+				tid := binary.BigEndian.Uint16(set[0:2])
+				n := int(binary.BigEndian.Uint16(set[2:4]))
+				set = set[4:]
+
+				var fields []netflowField
+				for i := 0; i < n; i++ {
+					fields = append(fields, netflowField{
+						typ:    binary.BigEndian.Uint16(set[0:2]),
+						length: int(binary.BigEndian.Uint16(set[2:4])),
+					})
+					set = set[4:]
+				}
+
+				templates[tid] = fields
+				p.templates++
+			}
+			continue
+		}
+
+		fields, ok := templates[id]
+		require.True(t, ok, "FlowSet of unknown template %d", id)
+
+		rl := 0
+		for _, f := range fields {
+			rl += f.length
+		}
+
+		// Skip the padding at the end of the FlowSet.
+		for len(set) >= rl {
+			rec := make(map[uint16][]byte)
+			for _, f := range fields {
+				rec[f.typ] = set[:f.length]
+				set = set[f.length:]
+			}
+			p.data = append(p.data, rec)
+			p.records++
+		}
+	}
+
+	return p
+}
+
+func TestNetFlowExporter(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	e, err := DialNetFlow("udp", pc.LocalAddr().String(), &NetFlowConfig{SourceID: 7})
+	require.NoError(t, err)
+	defer e.Close()
+
+	e.boot = time.Unix(50, 0)
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	buf := make([]byte, 65535)
+	templates := make(map[uint16][]netflowField)
+
+	read := func() netflowPacket {
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		return decodeNetFlow(t, buf[:n], templates)
+	}
+
+	require.NoError(t, e.Export(testRecords()...))
+
+	p := read()
+	assert.Equal(t, uint16(netflowVersion), p.version)
+	assert.Equal(t, uint16(4), p.count)
+	assert.Equal(t, uint32(950000), p.uptime)
+	assert.Equal(t, uint32(1000), p.unixSecs)
+	assert.Equal(t, uint32(0), p.seq)
+	assert.Equal(t, uint32(7), p.source)
+	assert.Equal(t, 2, p.templates)
+	require.Len(t, p.data, 2)
+
+	r := p.data[0]
+	assert.Equal(t, []byte{10, 0, 0, 1}, r[ieSourceIPv4Address])
+	assert.Equal(t, []byte{192, 0, 2, 1}, r[iePostNATSourceIPv4Address])
+	assert.Equal(t, uint16(40000), binary.BigEndian.Uint16(r[iePostNAPTSourceTransportPort]))
+	assert.Equal(t, uint64(1000), binary.BigEndian.Uint64(r[ieOctetDeltaCount]))
+	assert.Equal(t, uint64(20), binary.BigEndian.Uint64(r[nfOutPkts]))
+	assert.Equal(t, uint32(50000), binary.BigEndian.Uint32(r[nfFirstSwitched]))
+	assert.Equal(t, uint32(55500), binary.BigEndian.Uint32(r[nfLastSwitched]))
+	assert.Equal(t, []byte{natEventDelete}, r[nfNATEvent])
+
+	r = p.data[1]
+	assert.Equal(t, net.ParseIP("2001:db8::1"), net.IP(r[ieSourceIPv6Address]))
+	assert.Equal(t, []byte{natEventNone}, r[nfNATEvent])
+
+	// The sequence number counts packets.
+	require.NoError(t, e.Export(testRecords()[1]))
+	p = read()
+	assert.Equal(t, uint32(1), p.seq)
+	assert.Equal(t, uint16(1), p.count)
+	assert.Zero(t, p.templates)
+}
+
+func TestNetFlowExporterActive(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	e, err := DialNetFlow("udp", pc.LocalAddr().String(), &NetFlowConfig{
+		ActiveTimeout:   time.Minute,
+		InactiveTimeout: 10 * time.Second,
+	})
+	require.NoError(t, err)
+	defer e.Close()
+
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+	e.boot = now
+
+	buf := make([]byte, 65535)
+	templates := make(map[uint16][]netflowField)
+
+	read := func() netflowPacket {
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		return decodeNetFlow(t, buf[:n], templates)
+	}
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 53, 120, 0)
+	f.ID = 1
+	f.CountersOrig = Counter{Packets: 1, Bytes: 100}
+
+	// Nothing is exported before a timeout expired.
+	require.NoError(t, e.ExportActive(f))
+	now = now.Add(5 * time.Second)
+	f.CountersOrig = Counter{Packets: 2, Bytes: 200}
+	require.NoError(t, e.ExportActive(f))
+
+	// The active timeout expired.
+	now = now.Add(time.Minute)
+	f.CountersOrig = Counter{Packets: 5, Bytes: 500}
+	require.NoError(t, e.ExportActive(f))
+
+	p := read()
+	require.Len(t, p.data, 1)
+	assert.Equal(t, uint64(500), binary.BigEndian.Uint64(p.data[0][ieOctetDeltaCount]))
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(p.data[0][nfFirstSwitched]))
+	assert.Equal(t, uint32(65000), binary.BigEndian.Uint32(p.data[0][nfLastSwitched]))
+
+	// The counters did not change for the inactive timeout.
+	now = now.Add(2 * time.Second)
+	f.CountersOrig = Counter{Packets: 6, Bytes: 600}
+	require.NoError(t, e.ExportActive(f))
+	now = now.Add(10 * time.Second)
+	require.NoError(t, e.ExportActive(f))
+
+	p = read()
+	require.Len(t, p.data, 1)
+	assert.Equal(t, uint64(100), binary.BigEndian.Uint64(p.data[0][ieOctetDeltaCount]))
+	assert.Equal(t, uint32(65000), binary.BigEndian.Uint32(p.data[0][nfFirstSwitched]))
+	assert.Equal(t, uint32(67000), binary.BigEndian.Uint32(p.data[0][nfLastSwitched]))
+
+	// The final Record only holds the counters since the last export.
+	now = now.Add(time.Second)
+	f.CountersOrig = Counter{Packets: 8, Bytes: 800}
+	r := newRecord(f, NSIDLocal)
+	r.Stop = now
+	require.NoError(t, e.Export(r))
+
+	p = read()
+	require.Len(t, p.data, 1)
+	assert.Equal(t, uint64(200), binary.BigEndian.Uint64(p.data[0][ieOctetDeltaCount]))
+	assert.Equal(t, uint64(2), binary.BigEndian.Uint64(p.data[0][iePacketDeltaCount]))
+	assert.Equal(t, uint32(67000), binary.BigEndian.Uint32(p.data[0][nfFirstSwitched]))
+	assert.Empty(t, e.flows)
+
+	// Flows that are no longer dumped are forgotten.
+	require.NoError(t, e.ExportActive(f))
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, e.ExportActive())
+	assert.Empty(t, e.flows)
+}
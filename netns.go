@@ -0,0 +1,72 @@
+package conntrack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mdlayher/netlink"
+)
+
+// netnsRunDir is the directory holding the network namespaces named by iproute2 (NETNS_RUN_DIR).
+const netnsRunDir = "/var/run/netns"
+
+// DialNetNS opens a Conn in the network namespace at path, eg. /proc/<pid>/ns/net or a
+// namespace bind-mounted by 'ip netns'. The Conn's socket is created and used by a goroutine
+// locked to an OS thread that entered the namespace, like when calling Dial with the
+// namespace's file descriptor in netlink.Config. The namespace of the calling goroutine's
+// thread is never changed, so this is safe to call from any goroutine, whether it is locked
+// to its thread or not.
+func DialNetNS(path string) (*Conn, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DialNetNSFD(int(f.Fd()))
+}
+
+// DialNetNSFD is like DialNetNS, but takes a file descriptor referring to a network namespace.
+// The file descriptor is only used while dialing, and can be closed when DialNetNSFD returns.
+func DialNetNSFD(fd int) (*Conn, error) {
+
+	// A zero NetNS makes netlink.Dial use the current namespace.
+	if fd <= 0 {
+		return nil, fmt.Errorf(errNetNSFD, fd)
+	}
+
+	return Dial(&netlink.Config{NetNS: fd})
+}
+
+// DialNetNSByName is like DialNetNS, but takes the name of a network namespace created
+// using 'ip netns add'.
+func DialNetNSByName(name string) (*Conn, error) {
+
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		return nil, fmt.Errorf(errNetNSName, name)
+	}
+
+	return DialNetNS(filepath.Join(netnsRunDir, name))
+}
+
+// WithNetNS calls fn with a Conn in the network namespace at path, for operating on the
+// namespace's Conntrack table. The Conn is closed when fn returns, and must not be used
+// afterwards. Like DialNetNS, this does not change the namespace of the calling goroutine's
+// thread. Returns the error returned by fn, or the error opening or closing the Conn.
+func WithNetNS(path string, fn func(*Conn) error) error {
+
+	c, err := DialNetNS(path)
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,114 @@
+//+build integration
+
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDialNetNS(t *testing.T) {
+
+	// Pin the test to its thread to check its namespace is left alone.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	self := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+	orig, err := os.Readlink(self)
+	require.NoError(t, err)
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	require.NoError(t, sc.Create(f))
+
+	path := fmt.Sprintf("/proc/self/fd/%d", nsid)
+
+	c, err := DialNetNS(path)
+	require.NoError(t, err)
+
+	flows, err := c.Dump()
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+	require.NoError(t, c.Close())
+
+	err = WithNetNS(path, func(c *Conn) error {
+		return c.Delete(f)
+	})
+	require.NoError(t, err)
+
+	flows, err = sc.Dump()
+	require.NoError(t, err)
+	assert.Len(t, flows, 0)
+
+	// Errors returned by the function are passed through.
+	err = WithNetNS(path, func(c *Conn) error {
+		return c.Delete(f)
+	})
+	en, ok := errno(err)
+	require.True(t, ok)
+	assert.Equal(t, unix.ENOENT, en)
+
+	_, err = DialNetNS("/nonexistent")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = DialNetNSFD(0)
+	assert.EqualError(t, err, "invalid network namespace file descriptor 0")
+
+	// A file descriptor that doesn't refer to a network namespace.
+	_, err = DialNetNSFD(int(os.Stdout.Fd()))
+	assert.Error(t, err)
+
+	now, err := os.Readlink(self)
+	require.NoError(t, err)
+	assert.Equal(t, orig, now, "namespace of the test's thread changed")
+
+	assert.NoError(t, sc.Close())
+}
+
+// Dials a namespace bind-mounted like 'ip netns add' does.
+func TestDialNetNSByName(t *testing.T) {
+
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	name := fmt.Sprintf("conntrack-test-%d", os.Getpid())
+	path := filepath.Join(netnsRunDir, name)
+
+	require.NoError(t, os.MkdirAll(netnsRunDir, 0755))
+
+	nf, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, nf.Close())
+	defer os.Remove(path)
+
+	require.NoError(t, unix.Mount(fmt.Sprintf("/proc/self/fd/%d", nsid), path, "none", unix.MS_BIND, ""))
+	defer unix.Unmount(path, unix.MNT_DETACH)
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	require.NoError(t, sc.Create(f))
+
+	c, err := DialNetNSByName(name)
+	require.NoError(t, err)
+
+	flows, err := c.Dump()
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+
+	for _, n := range []string{"", ".", "..", "../" + name} {
+		_, err = DialNetNSByName(n)
+		assert.EqualError(t, err, fmt.Sprintf("invalid network namespace name '%s'", n))
+	}
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, sc.Close())
+}
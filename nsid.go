@@ -0,0 +1,318 @@
+package conntrack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// NSIDResolver resolves the NSIDs of Events to the paths of their network namespaces.
+// NSIDs are assigned to other namespaces by each network namespace, so the resolver
+// needs to be created in the namespace of the Conn that received the Events.
+//
+// The namespaces named by iproute2 ('ip netns'), the namespaces of all processes and the
+// namespaces opened by the current process are searched. A path in /proc is only valid
+// while its process or file descriptor exists. Open the path to obtain a handle to the
+// namespace, or pass it to DialNetNS.
+//
+// Resolved paths are cached until the kernel reports that their NSID was released or
+// assigned again, or until they are invalidated with Invalidate. Searching all namespaces
+// is expensive, so NSIDs that cannot be resolved are searched for at most once every
+// second, unless the kernel reports that a new NSID was assigned. If receiving the
+// notifications fails for another reason than lost messages, cached paths are checked
+// with NSID before they are returned.
+type NSIDResolver struct {
+	conn   *netlink.Conn
+	notify *netlink.Conn
+
+	now  func() time.Time
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	paths   map[int32]string
+	scanned time.Time
+	verify  bool
+}
+
+const (
+	// rtnlGroupNSID is the rtnetlink multicast group of NSID assignments (RTNLGRP_NSID).
+	rtnlGroupNSID = 28
+
+	// nsidScanInterval is the minimum interval between searches for unresolved NSIDs.
+	nsidScanInterval = time.Second
+)
+
+// NewNSIDResolver opens an rtnetlink socket to resolve the NSIDs assigned by the network
+// namespace in config.NetNS, like Dial. A nil config uses the current namespace.
+func NewNSIDResolver(config *netlink.Config) (*NSIDResolver, error) {
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// A second socket receives the NSID notifications, so they don't end up
+	// in the replies to queries.
+	n, err := netlink.Dial(unix.NETLINK_ROUTE, config)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	if err := n.JoinGroup(rtnlGroupNSID); err != nil {
+		_ = c.Close()
+		_ = n.Close()
+		return nil, err
+	}
+
+	r := &NSIDResolver{
+		conn:   c,
+		notify: n,
+		now:    time.Now,
+		done:   make(chan struct{}),
+		paths:  make(map[int32]string),
+	}
+
+	r.wg.Add(1)
+	go r.watch()
+
+	return r, nil
+}
+
+// Close closes the NSIDResolver's sockets.
+func (r *NSIDResolver) Close() error {
+
+	// Unblock the watcher before closing its socket, like Listener does.
+	close(r.done)
+	_ = r.notify.SetReadDeadline(time.Unix(1, 0))
+	r.wg.Wait()
+
+	err := r.notify.Close()
+
+	if cerr := r.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Invalidate removes the cached path of an NSID, eg. after opening it failed.
+// The next Resolve of the NSID searches all namespaces again.
+func (r *NSIDResolver) Invalidate(nsid int32) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.paths, nsid)
+	r.scanned = time.Time{}
+}
+
+// Resolve returns the path of the network namespace with the given NSID.
+// NSIDLocal and NSIDs without a namespace in any of the searched locations
+// cannot be resolved.
+func (r *NSIDResolver) Resolve(nsid int32) (string, error) {
+
+	if nsid < 0 {
+		return "", fmt.Errorf(errNSIDNotFound, nsid)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.paths[nsid]; ok {
+		if !r.verify {
+			return p, nil
+		}
+		if id, err := r.NSID(p); err == nil && id == nsid {
+			return p, nil
+		}
+		delete(r.paths, nsid)
+	}
+
+	now := r.now()
+	if now.Sub(r.scanned) < nsidScanInterval {
+		return "", fmt.Errorf(errNSIDNotFound, nsid)
+	}
+
+	r.scan()
+	r.scanned = now
+
+	if p, ok := r.paths[nsid]; ok {
+		return p, nil
+	}
+
+	return "", fmt.Errorf(errNSIDNotFound, nsid)
+}
+
+// NSID returns the NSID the resolver's network namespace assigned to the network
+// namespace at path. Returns NSIDLocal if the namespace has no ID.
+func (r *NSIDResolver) NSID(path string) (int32, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return NSIDLocal, err
+	}
+	defer f.Close()
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NETNSA_FD, Data: nlenc.Uint32Bytes(uint32(f.Fd()))},
+	})
+	if err != nil {
+		return NSIDLocal, err
+	}
+
+	// The request starts with a struct rtgenmsg, padded to 4 bytes.
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_GETNSID,
+			Flags: netlink.Request,
+		},
+		Data: append(make([]byte, unix.SizeofRtGenmsg+3), attrs...),
+	}
+
+	msgs, err := r.conn.Execute(req)
+	if err != nil {
+		return NSIDLocal, err
+	}
+
+	for _, m := range msgs {
+		if id, ok := nsidAttr(m); ok {
+			return id, nil
+		}
+	}
+
+	return NSIDLocal, errNSIDReply
+}
+
+// watch removes the cached paths of NSIDs the kernel reports as released or assigned,
+// until the NSIDResolver is closed. An NSID is released when its namespace is destroyed,
+// and can be assigned to another namespace. Newly assigned NSIDs may be resolved right away.
+//
+// When notifications were lost, the whole cache is dropped once for each run of ENOBUFS
+// errors. Any other error stops the watcher, after which Resolve checks cached paths.
+func (r *NSIDResolver) watch() {
+
+	defer r.wg.Done()
+
+	var lost bool
+
+	for {
+		msgs, err := r.notify.Receive()
+
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+
+		if err != nil {
+			if en, ok := errno(err); !ok || en != unix.ENOBUFS {
+				r.mu.Lock()
+				r.verify = true
+				r.mu.Unlock()
+				return
+			}
+
+			if !lost {
+				lost = true
+				r.mu.Lock()
+				r.paths = make(map[int32]string)
+				r.scanned = time.Time{}
+				r.mu.Unlock()
+			}
+
+			continue
+		}
+
+		lost = false
+
+		r.mu.Lock()
+
+		for _, m := range msgs {
+			if m.Header.Type != unix.RTM_NEWNSID && m.Header.Type != unix.RTM_DELNSID {
+				continue
+			}
+
+			if id, ok := nsidAttr(m); ok {
+				delete(r.paths, id)
+			}
+
+			if m.Header.Type == unix.RTM_NEWNSID {
+				r.scanned = time.Time{}
+			}
+		}
+
+		r.mu.Unlock()
+	}
+}
+
+// nsidAttr returns the NETNSA_NSID attribute of an RTM_NEWNSID or RTM_DELNSID message,
+// which starts with a struct rtgenmsg padded to 4 bytes.
+func nsidAttr(m netlink.Message) (int32, bool) {
+
+	if len(m.Data) < 4 {
+		return 0, false
+	}
+
+	attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+	if err != nil {
+		return 0, false
+	}
+
+	for _, a := range attrs {
+		if a.Type == unix.NETNSA_NSID && len(a.Data) == 4 {
+			return nlenc.Int32(a.Data), true
+		}
+	}
+
+	return 0, false
+}
+
+// scan rebuilds the cache of NSIDs by querying the NSIDs of all network namespaces
+// that can be found. Each namespace is queried once.
+func (r *NSIDResolver) scan() {
+
+	r.paths = make(map[int32]string)
+	seen := make(map[uint64]bool)
+
+	add := func(path string) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil || seen[uint64(st.Ino)] {
+			return
+		}
+		seen[uint64(st.Ino)] = true
+
+		if id, err := r.NSID(path); err == nil && id >= 0 {
+			r.paths[id] = path
+		}
+	}
+
+	names, _ := filepath.Glob(filepath.Join(netnsRunDir, "*"))
+	for _, p := range names {
+		add(p)
+	}
+
+	// Namespaces held open by the current process, eg. by Conns dialed into them.
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	for _, fd := range fds {
+		p := filepath.Join("/proc/self/fd", fd.Name())
+		if l, err := os.Readlink(p); err == nil && strings.HasPrefix(l, "net:[") {
+			add(p)
+		}
+	}
+
+	procs, _ := filepath.Glob("/proc/[0-9]*/ns/net")
+	for _, p := range procs {
+		add(p)
+	}
+}
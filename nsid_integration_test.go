@@ -0,0 +1,148 @@
+//+build integration
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// Receives events from another namespace and resolves the namespace's NSID.
+func TestConnListenAllNSID(t *testing.T) {
+
+	lc, lns, err := makeNSConn()
+	require.NoError(t, err)
+
+	sc, sns, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Conn in the listener's namespace.
+	lsc, err := Dial(&netlink.Config{NetNS: lns})
+	require.NoError(t, err)
+
+	// The listener only receives events from namespaces it assigned an ID to.
+	nsid := int32(42)
+	require.NoError(t, assignNSID(lns, sns, nsid))
+
+	require.NoError(t, lc.SetOption(netlink.ListenAllNSID, true))
+
+	ev := make(chan Event, 2)
+	l, err := lc.StartListener(ev, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew}, nil)
+	require.NoError(t, err)
+
+	f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 0)
+	require.NoError(t, sc.Create(f))
+	require.NoError(t, lsc.Create(f))
+
+	for _, want := range []int32{nsid, NSIDLocal} {
+		select {
+		case re := <-ev:
+			assert.Equal(t, want, re.NSID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+
+	require.NoError(t, l.Stop())
+
+	r, err := NewNSIDResolver(&netlink.Config{NetNS: lns})
+	require.NoError(t, err)
+
+	// The test process holds the namespaces open.
+	path, err := r.Resolve(nsid)
+	require.NoError(t, err)
+
+	id, err := r.NSID(path)
+	require.NoError(t, err)
+	assert.Equal(t, nsid, id)
+
+	// Resolved from the cache.
+	cpath, err := r.Resolve(nsid)
+	require.NoError(t, err)
+	assert.Equal(t, path, cpath)
+
+	_, err = r.Resolve(nsid + 1)
+	assert.EqualError(t, err, "no network namespace found with NSID 43")
+
+	// Misses don't search all namespaces again right away.
+	r.mu.Lock()
+	scanned := r.scanned
+	r.mu.Unlock()
+
+	_, err = r.Resolve(nsid + 1)
+	assert.EqualError(t, err, "no network namespace found with NSID 43")
+
+	r.mu.Lock()
+	assert.Equal(t, scanned, r.scanned)
+	r.mu.Unlock()
+
+	// Unless the kernel reports a new NSID.
+	tns, err := newNetNS()
+	require.NoError(t, err)
+	require.NoError(t, assignNSID(lns, int(tns), nsid+1))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = r.Resolve(nsid + 1); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+
+	// Explicit invalidation drops the cached path.
+	r.Invalidate(nsid)
+	r.mu.Lock()
+	_, ok := r.paths[nsid]
+	r.mu.Unlock()
+	assert.False(t, ok)
+
+	ipath, err := r.Resolve(nsid)
+	require.NoError(t, err)
+	assert.Equal(t, path, ipath)
+
+	_, err = r.Resolve(NSIDLocal)
+	assert.Error(t, err)
+
+	assert.NoError(t, r.Close())
+	assert.NoError(t, lsc.Close())
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, sc.Close())
+}
+
+// assignNSID makes the network namespace netns assign the ID nsid to the namespace target.
+func assignNSID(netns, target int, nsid int32) error {
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{NetNS: netns})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NETNSA_NSID, Data: nlenc.Int32Bytes(nsid)},
+		{Type: unix.NETNSA_FD, Data: nlenc.Uint32Bytes(uint32(target))},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWNSID,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(make([]byte, 4), attrs...),
+	})
+
+	return err
+}
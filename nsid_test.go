@@ -0,0 +1,108 @@
+package conntrack
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// funcSocket is a netlink.Socket that returns the results of its receive functions in order.
+type funcSocket struct {
+	receive []func() ([]netlink.Message, error)
+}
+
+func (s *funcSocket) Close() error                           { return nil }
+func (s *funcSocket) Send(m netlink.Message) error           { return nil }
+func (s *funcSocket) SendMessages(m []netlink.Message) error { return nil }
+
+func (s *funcSocket) Receive() ([]netlink.Message, error) {
+
+	f := s.receive[0]
+	s.receive = s.receive[1:]
+	return f()
+}
+
+func TestNSIDResolverWatchErrors(t *testing.T) {
+
+	r := &NSIDResolver{
+		now:     time.Now,
+		done:    make(chan struct{}),
+		paths:   map[int32]string{1: "one"},
+		scanned: time.Now(),
+	}
+
+	enobufs := func() ([]netlink.Message, error) {
+		return nil, os.NewSyscallError("recvmsg", unix.ENOBUFS)
+	}
+
+	var seen []map[int32]string
+
+	// paths returns a copy of the resolver's cache.
+	paths := func() map[int32]string {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		p := make(map[int32]string)
+		for k, v := range r.paths {
+			p[k] = v
+		}
+		return p
+	}
+
+	put := func(nsid int32, path string) {
+		r.mu.Lock()
+		r.paths[nsid] = path
+		r.mu.Unlock()
+	}
+
+	r.notify = netlink.NewConn(&funcSocket{receive: []func() ([]netlink.Message, error){
+		enobufs,
+		func() ([]netlink.Message, error) {
+			seen = append(seen, paths())
+			put(2, "two")
+			return enobufs()
+		},
+		func() ([]netlink.Message, error) {
+			// Still the same run of errors, the cache is only dropped once.
+			seen = append(seen, paths())
+			return nil, nil
+		},
+		func() ([]netlink.Message, error) {
+			put(3, "three")
+			return enobufs()
+		},
+		func() ([]netlink.Message, error) {
+			seen = append(seen, paths())
+			return nil, os.NewSyscallError("recvmsg", unix.EBADF)
+		},
+	}}, 0)
+
+	r.wg.Add(1)
+	go r.watch()
+
+	stopped := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop after a fatal error")
+	}
+
+	require.Len(t, seen, 3)
+	assert.Empty(t, seen[0])
+	assert.Equal(t, map[int32]string{2: "two"}, seen[1])
+	assert.Empty(t, seen[2])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.True(t, r.verify)
+	assert.True(t, r.scanned.IsZero())
+}
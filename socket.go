@@ -0,0 +1,633 @@
+package conntrack
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/pkg/errors"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// query sends a Netfilter message over Netlink and returns all messages received
+// in response. The call will fail if the Conn is marked as Multicast. Any errors
+// returned from the underlying Netlink layer are wrapped using pkg/errors.Wrap().
+// Use errors.Cause() to unwrap to compare to Errno.
+func (c *Conn) query(ctx context.Context, nlm netlink.Message) ([]netlink.Message, error) {
+
+	var ret []netlink.Message
+
+	err := c.queryFunc(ctx, nlm, func(m netlink.Message) bool {
+		ret = append(ret, m)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// queryOne sends a Netfilter message answered by a single message, and returns it. Since the
+// request is not a dump and has the Acknowledge flag set, the kernel's reply is followed by
+// a Netlink (non-)error message. The error is already parsed by the netlink library, so the
+// acknowledgement is dropped. Errors are wrapped like in query.
+func (c *Conn) queryOne(ctx context.Context, nlm netlink.Message) (netlink.Message, error) {
+
+	msgs, err := c.query(ctx, nlm)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	if len(msgs) == 0 || msgs[0].Header.Type == netlink.Error {
+		return netlink.Message{}, errNoReply
+	}
+
+	return msgs[0], nil
+}
+
+// queryFunc sends a Netfilter message over Netlink and calls fn for every
+// message received in response, as soon as the socket buffer it arrived in has
+// been read. Only a single socket read's worth of messages is held in memory at
+// any given time.
+//
+// When fn returns false, it is not called again, but the remainder of the response
+// is drained from the socket to keep it usable for subsequent queries.
+// Errors are wrapped like in query.
+//
+// The deadline and cancellation of ctx are applied to the socket. When ctx expires
+// before all replies were read, ctx.Err() is returned and the remaining replies are
+// discarded at the start of the next query.
+func (c *Conn) queryFunc(ctx context.Context, nlm netlink.Message, fn func(netlink.Message) bool) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isMulticast {
+		return errConnIsMulticast
+	}
+
+	return c.withContext(ctx, func() error {
+
+		if err := c.drain(); err != nil {
+			return errors.Wrap(err, opQuery)
+		}
+
+		req, err := c.conn.Send(nlm)
+		if err != nil {
+			return errors.Wrap(err, opQuery)
+		}
+
+		c.pending = req.Header.Sequence
+
+		if err := c.receiveReplies(fn); err != nil {
+			return errors.Wrap(err, opQuery)
+		}
+
+		return nil
+	})
+}
+
+// batchAckSize is the amount of receive buffer space reserved for the acknowledgement
+// of each request in a batch. The kernel processes a batch before the sendmsg call
+// returns, so the socket's receive buffer needs to hold all of its acknowledgements.
+// Acknowledgements of failed requests carry a copy of the request, and the buffer's
+// accounting includes the kernel's per-packet overhead, so leave plenty of margin.
+const batchAckSize = 2048
+
+// batchSize returns the amount of requests queryBatch sends in a single sendmsg call,
+// based on the size of the socket's receive buffer.
+func (c *Conn) batchSize() (int, error) {
+
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		size, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if n := size / batchAckSize; n > 1 {
+		return n, nil
+	}
+
+	return 1, nil
+}
+
+// setReadBuffer sets the size of the socket's receive buffer in bytes. It uses
+// SO_RCVBUFFORCE to exceed the rmem_max sysctl, falling back to SO_RCVBUF when
+// the process lacks CAP_NET_ADMIN. The kernel doubles the size to account for
+// its bookkeeping overhead.
+func (c *Conn) setReadBuffer(bytes int) error {
+
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, bytes)
+		if serr == unix.EPERM {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, bytes)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return os.NewSyscallError("setsockopt", serr)
+	}
+
+	return nil
+}
+
+// Indices of the values returned by the SO_MEMINFO socket option, and their amount.
+// uapi/linux/sock_diag.h
+const (
+	skMemInfoRmemAlloc = 0 // SK_MEMINFO_RMEM_ALLOC
+	skMemInfoRcvbuf    = 1 // SK_MEMINFO_RCVBUF
+	skMemInfoVars      = 9 // SK_MEMINFO_VARS
+)
+
+// readBufferFill returns the amount of bytes allocated in the socket's receive buffer
+// and the size of the buffer, as accounted by the kernel.
+func (c *Conn) readBufferFill() (int, int, error) {
+
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// SO_MEMINFO fills an array of SK_MEMINFO_VARS uint32s, or less when the buffer is shorter.
+	var mi [skMemInfoVars]uint32
+	l := uint32(unsafe.Sizeof(mi))
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_SOCKET, unix.SO_MEMINFO,
+			uintptr(unsafe.Pointer(&mi[0])), uintptr(unsafe.Pointer(&l)), 0)
+		if errno != 0 {
+			serr = errno
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if serr != nil {
+		return 0, 0, os.NewSyscallError("getsockopt", serr)
+	}
+
+	return int(mi[skMemInfoRmemAlloc]), int(mi[skMemInfoRcvbuf]), nil
+}
+
+// setReliable enables or disables the socket options for reliable delivery of
+// multicast messages. NETLINK_BROADCAST_ERROR reports failed deliveries to the
+// kernel subsystem that sent the message, and NETLINK_NO_ENOBUFS stops the socket
+// from returning ENOBUFS when messages were dropped.
+func (c *Conn) setReliable(enable bool) error {
+
+	if err := c.conn.SetOption(netlink.BroadcastError, enable); err != nil {
+		return err
+	}
+
+	return c.conn.SetOption(netlink.NoENOBUFS, enable)
+}
+
+// queryBatch sends Netfilter messages requesting an acknowledgement over Netlink,
+// packing as many of them into a single sendmsg call as the socket's receive buffer
+// can hold the acknowledgements of. Acknowledgements are
+// matched to their messages by sequence number. Returns the error carried by each
+// message's acknowledgement, in order, wrapped like in query.
+//
+// When sending or receiving fails, the error is returned, and is also set as the
+// outcome of all messages that were not acknowledged.
+func (c *Conn) queryBatch(ctx context.Context, msgs []netlink.Message) ([]error, error) {
+
+	errs := make([]error, len(msgs))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isMulticast {
+		return fillErrors(errs, 0, errConnIsMulticast), errConnIsMulticast
+	}
+
+	// Index of the first message not yet sent, and the indices
+	// of sent messages awaiting acknowledgement by sequence number.
+	sent := 0
+	seqs := make(map[uint32]int)
+
+	err := c.withContext(ctx, func() error {
+
+		if err := c.drain(); err != nil {
+			return errors.Wrap(err, opQuery)
+		}
+
+		n, err := c.batchSize()
+		if err != nil {
+			return errors.Wrap(err, opQuery)
+		}
+
+		for sent < len(msgs) {
+			end := sent + n
+			if end > len(msgs) {
+				end = len(msgs)
+			}
+
+			reqs, err := c.conn.SendMessages(msgs[sent:end])
+			if err != nil {
+				return errors.Wrap(err, opQuery)
+			}
+
+			for i, req := range reqs {
+				seqs[req.Header.Sequence] = sent + i
+			}
+			sent = end
+
+			// The kernel acknowledges messages in order, the last one
+			// terminates the batch.
+			c.pending = reqs[len(reqs)-1].Header.Sequence
+
+			for len(seqs) > 0 {
+				replies, err := c.receive()
+				if err != nil {
+					return errors.Wrap(err, opQuery)
+				}
+
+				for _, m := range replies {
+					i, ok := seqs[m.Header.Sequence]
+					if !ok || m.Header.Type != netlink.Error {
+						continue
+					}
+
+					if err := checkError(m); err != nil {
+						errs[i] = errors.Wrap(err, opQuery)
+					}
+
+					delete(seqs, m.Header.Sequence)
+				}
+			}
+
+			c.pending = 0
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		for _, i := range seqs {
+			errs[i] = err
+		}
+		return fillErrors(errs, sent, err), err
+	}
+
+	return errs, nil
+}
+
+// fillErrors sets all entries of errs starting at index from to err.
+func fillErrors(errs []error, from int, err error) []error {
+
+	for i := from; i < len(errs); i++ {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// receiveReplies reads replies to the request with the pending sequence number
+// from the socket, calling fn for each of them until it returns false. Returns
+// when the reply terminating the request was received, clearing the pending
+// sequence number. Replies to other requests are skipped.
+func (c *Conn) receiveReplies(fn func(netlink.Message) bool) error {
+
+	stop := false
+	for {
+		msgs, err := c.receive()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+
+			// Skip any stale replies to earlier requests.
+			if m.Header.Sequence != c.pending {
+				continue
+			}
+
+			switch m.Header.Type {
+			case netlink.Error, netlink.Done:
+				// A Done message terminates a dump, an Error message with
+				// code 0 is the acknowledgement of a non-dump request.
+				c.pending = 0
+				return checkError(m)
+			}
+
+			if !stop && !fn(m) {
+				stop = true
+			}
+		}
+	}
+}
+
+// drain discards the replies to an earlier request that was interrupted before
+// all of them were read. The outcome of the earlier request is ignored.
+func (c *Conn) drain() error {
+
+	if c.pending == 0 {
+		return nil
+	}
+
+	err := c.receiveReplies(func(netlink.Message) bool { return false })
+	if c.pending != 0 {
+		return err
+	}
+
+	return nil
+}
+
+// withContext calls fn with the deadline of ctx applied to the Conn's socket.
+// When ctx is cancelled, any socket operations performed by fn are unblocked.
+// If fn fails after ctx expired, ctx.Err() is returned instead of fn's error.
+func (c *Conn) withContext(ctx context.Context, fn func() error) error {
+
+	// Fast path for contexts that can never be cancelled.
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if d, ok := ctx.Deadline(); ok {
+		if err := c.conn.SetDeadline(d); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		select {
+		case <-ctx.Done():
+			// Unblock any pending reads or writes on the socket.
+			_ = c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err := fn()
+
+	close(done)
+	<-exited
+
+	// Reset the socket's deadline for future operations.
+	if derr := c.conn.SetDeadline(time.Time{}); derr != nil && err == nil {
+		err = derr
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// receive performs a single read on the Conn's socket and returns the Netlink
+// messages it contained. Unlike netlink.Conn.Receive, it does not wait for the
+// remaining parts of a multi-part message.
+func (c *Conn) receive() ([]netlink.Message, error) {
+
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	var rerr error
+
+	b := make([]byte, os.Getpagesize())
+	for {
+		// Peek at the socket to determine the size of the next datagram.
+		// MSG_TRUNC makes recvmsg return its full length.
+		err = rc.Read(func(fd uintptr) bool {
+			n, _, _, _, rerr = unix.Recvmsg(int(fd), b, nil, unix.MSG_PEEK|unix.MSG_TRUNC)
+			return rerr != unix.EAGAIN
+		})
+		if err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return nil, &netlink.OpError{Op: "receive", Err: os.NewSyscallError("recvmsg", err)}
+		}
+
+		if n <= len(b) {
+			break
+		}
+
+		b = make([]byte, nlmsgAlign(n))
+	}
+
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, _, _, rerr = unix.Recvmsg(int(fd), b, nil, 0)
+		return rerr != unix.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return nil, &netlink.OpError{Op: "receive", Err: os.NewSyscallError("recvmsg", err)}
+	}
+
+	return parseMessages(b[:nlmsgAlign(n)])
+}
+
+// receiveEvent performs a single read of a multicast message on the Conn's socket.
+// Returns the message and the ID of the network namespace it was sent in, taken from
+// the message's NETLINK_LISTEN_ALL_NSID control message. The ID is NSIDLocal when the
+// message had no control message. Multicast messages are never larger than a page.
+func (c *Conn) receiveEvent() (netlink.Message, int32, error) {
+
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return netlink.Message{}, NSIDLocal, err
+	}
+
+	var n, oobn, flags int
+	var rerr error
+
+	b := make([]byte, os.Getpagesize())
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	err = rc.Read(func(fd uintptr) bool {
+		n, oobn, flags, _, rerr = unix.Recvmsg(int(fd), b, oob, 0)
+		return rerr != unix.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return netlink.Message{}, NSIDLocal, &netlink.OpError{Op: "receive", Err: os.NewSyscallError("recvmsg", err)}
+	}
+
+	if flags&unix.MSG_TRUNC != 0 {
+		return netlink.Message{}, NSIDLocal, errTruncatedEvent
+	}
+
+	msgs, err := parseMessages(b[:nlmsgAlign(n)])
+	if err != nil {
+		return netlink.Message{}, NSIDLocal, err
+	}
+
+	if len(msgs) != 1 {
+		return netlink.Message{}, NSIDLocal, errMultipartEvent
+	}
+
+	nsid, err := parseNSID(oob[:oobn])
+	if err != nil {
+		return netlink.Message{}, NSIDLocal, &netlink.OpError{Op: "receive", Err: err}
+	}
+
+	return msgs[0], nsid, nil
+}
+
+// parseNSID returns the network namespace ID held by a NETLINK_LISTEN_ALL_NSID
+// control message in oob, or NSIDLocal if oob holds no such message.
+func parseNSID(oob []byte) (int32, error) {
+
+	if len(oob) == 0 {
+		return NSIDLocal, nil
+	}
+
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return NSIDLocal, err
+	}
+
+	for _, cm := range cmsgs {
+		if cm.Header.Level == unix.SOL_NETLINK && cm.Header.Type == unix.NETLINK_LISTEN_ALL_NSID && len(cm.Data) >= 4 {
+			return nlenc.Int32(cm.Data[:4]), nil
+		}
+	}
+
+	return NSIDLocal, nil
+}
+
+// parseMessages parses the Netlink messages contained in a buffer read from the socket.
+func parseMessages(b []byte) ([]netlink.Message, error) {
+
+	raw, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, &netlink.OpError{Op: "receive", Err: err}
+	}
+
+	msgs := make([]netlink.Message, 0, len(raw))
+	for _, r := range raw {
+		msgs = append(msgs, netlink.Message{
+			Header: netlink.Header{
+				Length:   r.Header.Len,
+				Type:     netlink.HeaderType(r.Header.Type),
+				Flags:    netlink.HeaderFlags(r.Header.Flags),
+				Sequence: r.Header.Seq,
+				PID:      r.Header.Pid,
+			},
+			Data: r.Data,
+		})
+	}
+
+	return msgs, nil
+}
+
+// checkError returns the error code carried by a Netlink Error or Done
+// message as a netlink.OpError. Returns nil if the code is zero.
+func checkError(m netlink.Message) error {
+
+	// Done messages don't always carry an error code.
+	if len(m.Data) < 4 {
+		if m.Header.Type == netlink.Error {
+			return &netlink.OpError{Op: "receive", Err: errShortErrorMessage}
+		}
+		return nil
+	}
+
+	if code := nlenc.Int32(m.Data[0:4]); code < 0 {
+		return &netlink.OpError{Op: "receive", Err: syscall.Errno(-code)}
+	}
+
+	return nil
+}
+
+// errno returns the error code of an error reply received from the kernel,
+// or of a failed system call on the Netlink socket. Returns false if err was
+// caused by neither.
+func errno(err error) (syscall.Errno, bool) {
+
+	oerr, ok := errors.Cause(err).(*netlink.OpError)
+	if !ok {
+		return 0, false
+	}
+
+	if serr, ok := oerr.Err.(*os.SyscallError); ok {
+		en, ok := serr.Err.(syscall.Errno)
+		return en, ok
+	}
+
+	en, ok := oerr.Err.(syscall.Errno)
+	return en, ok
+}
+
+// nlmsgAlign rounds the length of a Netlink message up to a multiple of 4.
+func nlmsgAlign(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+// joinGroups attaches the Netlink socket to one or more Netfilter multicast groups.
+// Marks the Conn as Multicast, meaning it can no longer be used for any queries.
+func (c *Conn) joinGroups(groups []netfilter.NetlinkGroup) error {
+
+	if len(groups) == 0 {
+		return errNoMulticastGroups
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, group := range groups {
+		err := c.conn.JoinGroup(uint32(group))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mark the Conn as being attached to a multicast group
+	c.isMulticast = true
+
+	return nil
+}
+
+// multicast returns the Conn's Multicast flag. It is set by calling Listen().
+func (c *Conn) multicast() bool {
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.isMulticast
+}
@@ -5,52 +5,145 @@ import (
 	"strconv"
 )
 
+// protoNames holds the names of common layer 4 protocols, as in /etc/protocols.
+var protoNames = map[uint8]string{
+	1:   "icmp",
+	2:   "igmp",
+	6:   "tcp",
+	17:  "udp",
+	33:  "dccp",
+	47:  "gre",
+	58:  "ipv6-icmp",
+	94:  "ipip",
+	115: "l2tp",
+	132: "sctp",
+	136: "udplite",
+}
+
+// tcpStateNames holds the names of Conntrack TCP states, as in enum tcp_conntrack.
+var tcpStateNames = []string{
+	"NONE",
+	"SYN_SENT",
+	"SYN_RECV",
+	"ESTABLISHED",
+	"FIN_WAIT",
+	"CLOSE_WAIT",
+	"LAST_ACK",
+	"TIME_WAIT",
+	"CLOSE",
+	"SYN_SENT2",
+}
+
+// statusNames holds the names of the bits of a Status, as in enum ip_conntrack_status.
+var statusNames = []string{
+	"EXPECTED",
+	"SEEN_REPLY",
+	"ASSURED",
+	"CONFIRMED",
+	"SRC_NAT",
+	"DST_NAT",
+	"SEQ_ADJUST",
+	"SRC_NAT_DONE",
+	"DST_NAT_DONE",
+	"DYING",
+	"FIXED_TIMEOUT",
+	"TEMPLATE",
+	"UNTRACKED",
+	"HELPER",
+	"OFFLOAD",
+}
+
+// eventTypeNames holds the names of the event types, indexed by eventType.
+var eventTypeNames = []string{
+	"UNKNOWN",
+	"NEW",
+	"UPDATE",
+	"DESTROY",
+	"EXP_NEW",
+	"EXP_DESTROY",
+	"RESYNC",
+	"RESYNC_FLOW",
+	"RESYNC_DONE",
+}
+
 // protoLookup translates a protocol integer into its string representation.
 func protoLookup(p uint8) string {
-	protos := map[uint8]string{
-		1:   "icmp",
-		2:   "igmp",
-		6:   "tcp",
-		17:  "udp",
-		33:  "dccp",
-		47:  "gre",
-		58:  "ipv6-icmp",
-		94:  "ipip",
-		115: "l2tp",
-		132: "sctp",
-		136: "udplite",
-	}
 
-	if val, ok := protos[p]; ok {
+	if val, ok := protoNames[p]; ok {
 		return val
 	}
 
 	return strconv.FormatUint(uint64(p), 10)
 }
 
-func (s Status) String() string {
-	names := []string{
-		"EXPECTED",
-		"SEEN_REPLY",
-		"ASSURED",
-		"CONFIRMED",
-		"SRC_NAT",
-		"DST_NAT",
-		"SEQ_ADJUST",
-		"SRC_NAT_DONE",
-		"DST_NAT_DONE",
-		"DYING",
-		"FIXED_TIMEOUT",
-		"TEMPLATE",
-		"UNTRACKED",
-		"HELPER",
-		"OFFLOAD",
+// protoParse translates the string representation of a protocol into its integer.
+func protoParse(s string) (uint8, error) {
+
+	for p, name := range protoNames {
+		if name == s {
+			return p, nil
+		}
+	}
+
+	p, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf(errUnknownProtocol, s)
+	}
+
+	return uint8(p), nil
+}
+
+// tcpStateLookup translates a Conntrack TCP state into its name, as in enum tcp_conntrack.
+func tcpStateLookup(s uint8) string {
+
+	if int(s) < len(tcpStateNames) {
+		return tcpStateNames[s]
 	}
 
+	return strconv.FormatUint(uint64(s), 10)
+}
+
+// tcpStateParse translates the name of a Conntrack TCP state into its integer.
+func tcpStateParse(s string) (uint8, error) {
+
+	for i, name := range tcpStateNames {
+		if name == s {
+			return uint8(i), nil
+		}
+	}
+
+	st, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf(errUnknownTCPState, s)
+	}
+
+	return uint8(st), nil
+}
+
+// statusFlagParse translates the name of a Status bit into its StatusFlag.
+func statusFlagParse(s string) (StatusFlag, error) {
+
+	for i, name := range statusNames {
+		if name == s {
+			return 1 << uint32(i), nil
+		}
+	}
+
+	// Bits without a name are represented by their value.
+	f, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf(errUnknownStatusFlag, s)
+	}
+
+	return StatusFlag(f), nil
+}
+
+func (s Status) String() string {
+
 	var rs string
 
 	// Loop over the field's bits
-	for i, name := range names {
+	for i, name := range statusNames {
 		if s.Value&(1<<uint32(i)) != 0 {
 			if rs != "" {
 				rs += "|"
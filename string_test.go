@@ -20,6 +20,13 @@ func TestProtoLookup(t *testing.T) {
 	}
 }
 
+func TestTCPStateLookup(t *testing.T) {
+
+	assert.Equal(t, "ESTABLISHED", tcpStateLookup(3))
+	assert.Equal(t, "SYN_SENT2", tcpStateLookup(9))
+	assert.Equal(t, "42", tcpStateLookup(42))
+}
+
 func TestEventString(t *testing.T) {
 
 	tpl := Tuple{
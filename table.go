@@ -0,0 +1,530 @@
+package conntrack
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/ti-mo/netfilter"
+)
+
+// Table is an in-memory mirror of the Conntrack table, built from a dump of the table
+// and kept in sync by listening for events. It is safe for concurrent use by readers.
+//
+// Flows are identified by their ID, and by their original and reply tuples. Since a tuple
+// only belongs to a single Flow at a time, a Flow evicts any other Flow with the same tuple.
+// Events are applied in the order they were sent by the kernel. Events of Flows that were
+// created and destroyed while the table was dumped are received after the dump, so the
+// table is always eventually consistent with the kernel.
+//
+// When the kernel drops events because the listening socket's buffer overflowed, the table
+// is dumped again. The Table keeps serving the previous state until the dump is complete.
+//
+// With the net.netfilter.nf_conntrack_events sysctl set to 2, the kernel only sends events
+// for Flows created while a listener exists in the network namespace. Flows that were
+// created before are dumped, but their updates and destruction are not seen by the Table
+// until it is dumped again.
+//
+// Flows returned by a Table share their Labels and addresses with the Table's copies, and
+// must not be modified.
+type Table struct {
+	mu    sync.RWMutex
+	state *tableState
+
+	// State built from a resync dump, swapped in when the dump completes.
+	// Only accessed by the goroutine applying events.
+	resync *tableState
+
+	l    *Listener
+	done chan struct{}
+}
+
+// NewTable dumps the Conntrack table using dc, and starts listening for events using lc to
+// keep the Table in sync. lc and dc must be separate Conns in the same network namespace, and
+// are used by the Table until it is closed. lc can't have any listeners, and dc is used to dump
+// the table again when events were lost. The config is used like in Conn.StartListener, its
+// ResyncDump is replaced by dc.
+func NewTable(lc, dc *Conn, config *ListenerConfig) (*Table, error) {
+	return NewTableContext(context.Background(), lc, dc, config)
+}
+
+// NewTableContext is like NewTable, but takes a context.Context to bound the initial dump,
+// and stops updating the Table when ctx is cancelled.
+func NewTableContext(ctx context.Context, lc, dc *Conn, config *ListenerConfig) (*Table, error) {
+
+	lcfg := ListenerConfig{}
+	if config != nil {
+		lcfg = *config
+	}
+	lcfg.ResyncDump = dc
+
+	// Start listening before the dump, so no events are missed. The events sent during
+	// the dump are received and queued while the dump runs, so they don't fill up the
+	// socket's buffer, and are applied once the dump is installed.
+	ev := make(chan Event)
+	l, err := lc.StartListenerContext(ctx, ev, 1, groupsFlow, &lcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Table{
+		state: newTableState(),
+		l:     l,
+		done:  make(chan struct{}),
+	}
+
+	dumped := make(chan struct{})
+	go t.run(ev, dumped)
+
+	state := newTableState()
+	err = dc.DumpFuncContext(ctx, func(f Flow) bool {
+		state.insert(f)
+		return true
+	})
+	if err != nil {
+		_ = l.Stop()
+		<-t.done
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.state = state
+	t.mu.Unlock()
+
+	close(dumped)
+
+	return t, nil
+}
+
+// groupsFlow are the multicast groups carrying the events of Flows.
+var groupsFlow = []netfilter.NetlinkGroup{netfilter.GroupCTNew, netfilter.GroupCTUpdate, netfilter.GroupCTDestroy}
+
+// run applies events to the Table until the Listener exits. Events received before
+// dumped is closed are queued, and applied in order after the initial dump is installed.
+func (t *Table) run(ev <-chan Event, dumped <-chan struct{}) {
+
+	defer close(t.done)
+
+	var queue []Event
+	for dumped != nil {
+		select {
+		case e, ok := <-ev:
+			if !ok {
+				return
+			}
+			queue = append(queue, e)
+		case <-dumped:
+			dumped = nil
+		}
+	}
+
+	for _, e := range queue {
+		t.apply(e)
+	}
+
+	for e := range ev {
+		t.apply(e)
+	}
+}
+
+// apply applies an event to the Table.
+func (t *Table) apply(e Event) {
+
+	switch e.Type {
+	case EventResync:
+		t.resync = newTableState()
+		return
+	case EventResyncFlow:
+		if t.resync != nil {
+			t.resync.insert(*e.Flow)
+		}
+		return
+	case EventResyncDone:
+		if t.resync != nil {
+			t.mu.Lock()
+			t.state, t.resync = t.resync, nil
+			t.mu.Unlock()
+		}
+		return
+	}
+
+	if e.Flow == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch e.Type {
+	case EventNew, EventUpdate:
+		t.state.update(*e.Flow)
+	case EventDestroy:
+		t.state.destroy(*e.Flow)
+	}
+}
+
+// Close stops updating the Table and closes its Listener. Returns the error that stopped
+// the Listener before the Table was closed, if any. The Table can still be read afterwards.
+func (t *Table) Close() error {
+
+	err := t.l.Stop()
+	<-t.done
+
+	if werr := t.l.Wait(); werr != nil {
+		return werr
+	}
+
+	return err
+}
+
+// Done returns a channel that is closed when the Table stops being updated, either because
+// it was closed, its context was cancelled or its Listener failed. Err returns the error
+// that stopped the Listener.
+func (t *Table) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns the error that stopped the Table's Listener, or nil if the Table is still being
+// updated or was stopped by Close or by cancelling its context.
+func (t *Table) Err() error {
+
+	select {
+	case <-t.done:
+		return t.l.Wait()
+	default:
+		return nil
+	}
+}
+
+// Overruns returns the amount of times the Table was dumped again because events were lost.
+func (t *Table) Overruns() uint64 {
+	return t.l.Overruns()
+}
+
+// Len returns the amount of Flows in the Table.
+func (t *Table) Len() int {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.state.flows)
+}
+
+// Flows returns all Flows in the Table, ordered by ID.
+func (t *Table) Flows() []Flow {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	out := make([]Flow, 0, len(t.state.flows))
+	for _, f := range t.state.flows {
+		out = append(out, f)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out
+}
+
+// Get returns the Flow with the given ID.
+func (t *Table) Get(id uint32) (Flow, bool) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	f, ok := t.state.flows[id]
+	return f, ok
+}
+
+// Lookup returns the Flow with an original or reply tuple equal to the given Tuple,
+// including its Zone.
+func (t *Table) Lookup(tuple Tuple) (Flow, bool) {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	id, ok := t.state.tuples[newTupleKey(tuple)]
+	if !ok {
+		return Flow{}, false
+	}
+
+	return t.state.flows[id], true
+}
+
+// BySource returns the Flows with the given source address in their original tuple, ordered by ID.
+func (t *Table) BySource(ip net.IP) []Flow {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.collect(t.state.src[ipKey(ip)])
+}
+
+// ByDestination returns the Flows with the given destination address in their original tuple,
+// ordered by ID.
+func (t *Table) ByDestination(ip net.IP) []Flow {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.collect(t.state.dst[ipKey(ip)])
+}
+
+// ByMark returns the Flows with the given Mark, ordered by ID.
+func (t *Table) ByMark(mark uint32) []Flow {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.collect(t.state.marks[mark])
+}
+
+// ByZone returns the Flows in the given Zone, ordered by ID.
+func (t *Table) ByZone(zone uint16) []Flow {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.collect(t.state.zones[zone])
+}
+
+// ByLabel returns the Flows that have the given label bit set, ordered by ID.
+func (t *Table) ByLabel(bit uint) []Flow {
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.collect(t.state.labels[bit])
+}
+
+// idSet is a set of Flow IDs.
+type idSet map[uint32]struct{}
+
+// tableState holds the Flows of a Table and their indices.
+type tableState struct {
+	flows  map[uint32]Flow
+	tuples map[tupleKey]uint32
+
+	src, dst map[[16]byte]idSet
+	marks    map[uint32]idSet
+	zones    map[uint16]idSet
+	labels   map[uint]idSet
+}
+
+// newTableState returns an empty tableState.
+func newTableState() *tableState {
+	return &tableState{
+		flows:  make(map[uint32]Flow),
+		tuples: make(map[tupleKey]uint32),
+		src:    make(map[[16]byte]idSet),
+		dst:    make(map[[16]byte]idSet),
+		marks:  make(map[uint32]idSet),
+		zones:  make(map[uint16]idSet),
+		labels: make(map[uint]idSet),
+	}
+}
+
+// update inserts the Flow of a new or update event, merged with the Flow's current state.
+func (s *tableState) update(f Flow) {
+
+	if old, ok := s.flows[f.ID]; ok {
+		mergeFlow(&f, old)
+	}
+
+	s.insert(f)
+}
+
+// mergeFlow fills the attributes missing from the Flow of an event with those of old,
+// the previous state of the same Flow. Update events only carry some attributes when
+// they changed, or when the Flow is destroyed.
+func mergeFlow(f *Flow, old Flow) {
+
+	if !f.ProtoInfo.filled() {
+		f.ProtoInfo = old.ProtoInfo
+	}
+	if !f.Helper.filled() {
+		f.Helper = old.Helper
+	}
+	if !f.TupleMaster.filled() {
+		f.TupleMaster = old.TupleMaster
+	}
+	if !f.SeqAdjOrig.filled() && !f.SeqAdjReply.filled() {
+		f.SeqAdjOrig, f.SeqAdjReply = old.SeqAdjOrig, old.SeqAdjReply
+	}
+	if !f.SynProxy.filled() {
+		f.SynProxy = old.SynProxy
+	}
+	if f.Labels == nil {
+		f.Labels, f.LabelsMask = old.Labels, old.LabelsMask
+	}
+	if f.SecurityContext == "" {
+		f.SecurityContext = old.SecurityContext
+	}
+	if !f.CountersOrig.filled() && !f.CountersReply.filled() {
+		f.CountersOrig, f.CountersReply = old.CountersOrig, old.CountersReply
+	}
+	if f.Timestamp == (Timestamp{}) {
+		f.Timestamp = old.Timestamp
+	}
+}
+
+// destroy removes the Flow of a destroy event, identified by its ID. Flows without
+// an ID are identified by their original tuple.
+func (s *tableState) destroy(f Flow) {
+
+	if f.ID == 0 {
+		id, ok := s.tuples[newTupleKey(f.TupleOrig)]
+		if !ok {
+			return
+		}
+		f.ID = id
+	}
+
+	s.remove(f.ID)
+}
+
+// insert adds a Flow to the state, replacing the Flow with the same ID and
+// evicting the Flows with the same tuples.
+func (s *tableState) insert(f Flow) {
+
+	s.remove(f.ID)
+
+	keys := []tupleKey{newTupleKey(f.TupleOrig), newTupleKey(f.TupleReply)}
+	for _, k := range keys {
+		if id, ok := s.tuples[k]; ok {
+			s.remove(id)
+		}
+	}
+
+	s.flows[f.ID] = f
+	for _, k := range keys {
+		s.tuples[k] = f.ID
+	}
+
+	addID(s.src, ipKey(f.TupleOrig.IP.SourceAddress), f.ID)
+	addID(s.dst, ipKey(f.TupleOrig.IP.DestinationAddress), f.ID)
+
+	if s.marks[f.Mark] == nil {
+		s.marks[f.Mark] = make(idSet)
+	}
+	s.marks[f.Mark][f.ID] = struct{}{}
+
+	if s.zones[f.Zone] == nil {
+		s.zones[f.Zone] = make(idSet)
+	}
+	s.zones[f.Zone][f.ID] = struct{}{}
+
+	for _, bit := range f.Labels.Bits() {
+		if s.labels[bit] == nil {
+			s.labels[bit] = make(idSet)
+		}
+		s.labels[bit][f.ID] = struct{}{}
+	}
+}
+
+// remove removes the Flow with the given ID and its index entries from the state.
+func (s *tableState) remove(id uint32) {
+
+	f, ok := s.flows[id]
+	if !ok {
+		return
+	}
+
+	delete(s.flows, id)
+
+	for _, k := range []tupleKey{newTupleKey(f.TupleOrig), newTupleKey(f.TupleReply)} {
+		if s.tuples[k] == id {
+			delete(s.tuples, k)
+		}
+	}
+
+	removeID(s.src, ipKey(f.TupleOrig.IP.SourceAddress), id)
+	removeID(s.dst, ipKey(f.TupleOrig.IP.DestinationAddress), id)
+
+	delete(s.marks[f.Mark], id)
+	if len(s.marks[f.Mark]) == 0 {
+		delete(s.marks, f.Mark)
+	}
+
+	delete(s.zones[f.Zone], id)
+	if len(s.zones[f.Zone]) == 0 {
+		delete(s.zones, f.Zone)
+	}
+
+	for _, bit := range f.Labels.Bits() {
+		delete(s.labels[bit], id)
+		if len(s.labels[bit]) == 0 {
+			delete(s.labels, bit)
+		}
+	}
+}
+
+// collect returns the Flows with the given IDs, ordered by ID.
+func (s *tableState) collect(ids idSet) []Flow {
+
+	out := make([]Flow, 0, len(ids))
+	for id := range ids {
+		out = append(out, s.flows[id])
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out
+}
+
+// addID adds a Flow ID to the set of an address in an address index.
+func addID(idx map[[16]byte]idSet, k [16]byte, id uint32) {
+
+	if idx[k] == nil {
+		idx[k] = make(idSet)
+	}
+
+	idx[k][id] = struct{}{}
+}
+
+// removeID removes a Flow ID from the set of an address in an address index.
+func removeID(idx map[[16]byte]idSet, k [16]byte, id uint32) {
+
+	delete(idx[k], id)
+	if len(idx[k]) == 0 {
+		delete(idx, k)
+	}
+}
+
+// tupleKey is a comparable representation of a Tuple, used as a map key.
+type tupleKey struct {
+	src, dst [16]byte
+
+	proto        uint8
+	sport, dport uint16
+
+	icmpID             uint16
+	icmpType, icmpCode uint8
+
+	zone uint16
+}
+
+// newTupleKey returns the tupleKey of a Tuple.
+func newTupleKey(t Tuple) tupleKey {
+	return tupleKey{
+		src:      ipKey(t.IP.SourceAddress),
+		dst:      ipKey(t.IP.DestinationAddress),
+		proto:    t.Proto.Protocol,
+		sport:    t.Proto.SourcePort,
+		dport:    t.Proto.DestinationPort,
+		icmpID:   t.Proto.ICMPID,
+		icmpType: t.Proto.ICMPType,
+		icmpCode: t.Proto.ICMPCode,
+		zone:     t.Zone,
+	}
+}
+
+// ipKey returns the 16-byte representation of an IP address, used as a map key.
+func ipKey(ip net.IP) [16]byte {
+
+	var k [16]byte
+	copy(k[:], ip.To16())
+
+	return k
+}
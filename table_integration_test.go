@@ -0,0 +1,224 @@
+//+build integration
+
+package conntrack
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+)
+
+// waitTable polls the Table until fn returns true.
+func waitTable(t *testing.T, tbl *Table, fn func() bool) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for !fn() {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for Table, has %d Flows", tbl.Len())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	dc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	// Flows that exist before the Table is created are dumped.
+	for i := uint16(1); i <= 10; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, i, 120, uint32(i%2))
+		require.NoError(t, c.Create(f))
+	}
+
+	tbl, err := NewTable(lc, dc, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 10, tbl.Len())
+
+	// Read the Table while it's being updated.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				tbl.BySource(net.IPv4(1, 2, 3, 4))
+				tbl.Flows()
+			}
+		}
+	}()
+
+	f := NewFlow(17, 0, net.IPv4(10, 0, 0, 1), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 42)
+	f.Zone = 3
+	require.NoError(t, c.Create(f))
+
+	waitTable(t, tbl, func() bool { return tbl.Len() == 11 })
+
+	tf, ok := tbl.Lookup(f.TupleOrig)
+	require.True(t, ok)
+	assert.Equal(t, uint32(42), tf.Mark)
+	assert.Len(t, tbl.ByMark(42), 1)
+	assert.Len(t, tbl.ByMark(0), 5)
+	assert.Len(t, tbl.ByZone(3), 1)
+	assert.Len(t, tbl.BySource(net.IPv4(10, 0, 0, 1)), 1)
+	assert.Len(t, tbl.ByDestination(net.IPv4(5, 6, 7, 8)), 11)
+
+	got, ok := tbl.Get(tf.ID)
+	require.True(t, ok)
+	assert.Equal(t, tf.TupleOrig.Proto, got.TupleOrig.Proto)
+
+	// Update the mark, which moves the Flow to another index.
+	f.Mark = 43
+	require.NoError(t, c.Update(f))
+
+	waitTable(t, tbl, func() bool { return len(tbl.ByMark(43)) == 1 })
+	assert.Empty(t, tbl.ByMark(42))
+
+	require.NoError(t, c.Delete(f))
+	waitTable(t, tbl, func() bool { return tbl.Len() == 10 })
+
+	_, ok = tbl.Lookup(f.TupleOrig)
+	assert.False(t, ok)
+
+	require.NoError(t, tbl.Close())
+	assert.NoError(t, tbl.Err())
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, dc.Close())
+	assert.NoError(t, c.Close())
+}
+
+// Overflows the Table's socket buffer, after which it dumps the table again.
+func TestTableResync(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	dc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	// Use the smallest receive buffer the kernel allows.
+	require.NoError(t, lc.conn.SetReadBuffer(0))
+
+	tbl, err := NewTable(lc, dc, nil)
+	require.NoError(t, err)
+
+	numFlows := 500
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, uint16(i), 120, 0)
+		require.NoError(t, c.Create(f))
+	}
+
+	waitTable(t, tbl, func() bool { return tbl.Len() == numFlows })
+	assert.NotZero(t, tbl.Overruns())
+
+	flows, err := c.Dump()
+	require.NoError(t, err)
+
+	for _, f := range flows {
+		_, ok := tbl.Get(f.ID)
+		assert.True(t, ok, "Flow %d not in Table", f.ID)
+	}
+
+	require.NoError(t, tbl.Close())
+
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, dc.Close())
+	assert.NoError(t, c.Close())
+}
+
+// Creates Flows while the Table's initial dump runs. The events sent during the dump
+// are queued by the Table, and don't overrun the socket.
+func TestTableEventsDuringDump(t *testing.T) {
+
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	dc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	cc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+
+	// Make the dump take a while.
+	numDumped := 20000
+	for i := 1; i <= numDumped; i++ {
+		f := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), uint16(i), 80, 120, 0)
+		require.NoError(t, c.Create(f))
+	}
+
+	// Let the creating goroutine run alongside the dump on machines with few CPUs.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Create Flows until after the Table is created.
+	stop := make(chan struct{})
+	created := make(chan int, 1)
+	errs := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 65535; i++ {
+			select {
+			case <-stop:
+				created <- i - 1
+				return
+			default:
+			}
+
+			f := NewFlow(17, 0, net.IPv4(10, 0, 0, 1), net.IPv4(5, 6, 7, 8), uint16(i), 80, 120, 0)
+			if err := cc.Create(f); err != nil {
+				errs <- err
+				return
+			}
+
+			// A single Listener worker can't keep up with Flows created back to back.
+			time.Sleep(time.Millisecond)
+		}
+		errs <- errors.New("ran out of ports")
+	}()
+
+	// The buffer holds a few dozen events, less than are sent during the dump.
+	tbl, err := NewTable(lc, dc, &ListenerConfig{ReadBuffer: 32 * 1024})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+
+	var numCreated int
+	select {
+	case numCreated = <-created:
+	case err := <-errs:
+		t.Fatal(err)
+	}
+
+	waitTable(t, tbl, func() bool { return tbl.Len() == numDumped+numCreated })
+	assert.Zero(t, tbl.Overruns())
+
+	require.NoError(t, tbl.Close())
+
+	assert.NoError(t, cc.Close())
+	assert.NoError(t, lc.Close())
+	assert.NoError(t, dc.Close())
+	assert.NoError(t, c.Close())
+}
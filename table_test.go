@@ -0,0 +1,72 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableState(t *testing.T) {
+
+	s := newTableState()
+
+	f1 := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 120, 10)
+	f1.ID = 1
+	f1.Labels.Set(3)
+	f1.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+
+	f2 := NewFlow(17, 0, net.IPv4(1, 2, 3, 4), net.IPv4(9, 9, 9, 9), 1234, 53, 120, 10)
+	f2.ID = 2
+	f2.Zone = 5
+
+	s.insert(f1)
+	s.insert(f2)
+
+	assert.Len(t, s.flows, 2)
+	assert.Len(t, s.src[ipKey(net.IPv4(1, 2, 3, 4))], 2)
+	assert.Len(t, s.dst[ipKey(net.ParseIP("9.9.9.9"))], 1)
+	assert.Len(t, s.marks[10], 2)
+	assert.Len(t, s.zones[5], 1)
+	assert.Len(t, s.labels[3], 1)
+
+	// The reply tuple identifies the Flow.
+	assert.Equal(t, uint32(1), s.tuples[newTupleKey(f1.TupleReply)])
+
+	// Update events without labels and protoinfo keep the current ones.
+	u := NewFlow(6, 0, net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1234, 80, 60, 11)
+	u.ID = 1
+	s.update(u)
+
+	assert.Equal(t, uint32(60), s.flows[1].Timeout)
+	assert.Equal(t, f1.Labels, s.flows[1].Labels)
+	assert.Equal(t, f1.ProtoInfo, s.flows[1].ProtoInfo)
+	assert.Len(t, s.marks[10], 1)
+	assert.Len(t, s.marks[11], 1)
+
+	// A Flow with the same tuple and another ID evicts the old Flow.
+	f3 := f2
+	f3.ID = 3
+	s.insert(f3)
+
+	_, ok := s.flows[2]
+	assert.False(t, ok)
+	assert.Equal(t, uint32(3), s.tuples[newTupleKey(f2.TupleOrig)])
+
+	// Destroy events of evicted Flows are ignored.
+	s.destroy(f2)
+	assert.Len(t, s.flows, 2)
+
+	// Flows without ID are destroyed by tuple.
+	f3.ID = 0
+	s.destroy(f3)
+	s.destroy(f1)
+
+	assert.Empty(t, s.flows)
+	assert.Empty(t, s.tuples)
+	assert.Empty(t, s.src)
+	assert.Empty(t, s.dst)
+	assert.Empty(t, s.marks)
+	assert.Empty(t, s.zones)
+	assert.Empty(t, s.labels)
+}
@@ -0,0 +1,303 @@
+package conntrack
+
+import (
+	"bytes"
+
+	"github.com/mdlayher/netlink"
+
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// TimeoutPolicy is a named set of state timeouts for connections of a single Layer 3 and
+// Layer 4 protocol, managed by the kernel's cttimeout subsystem. Policies are attached to
+// Flows by nftables 'ct timeout' objects or the iptables CT target.
+//
+// Only the Timeout* field matching the policy's Protocol can be set. TCP, UDP (and UDP-Lite),
+// ICMP (and ICMPv6), SCTP, DCCP and GRE have their own timeouts, all other protocols use
+// Generic. All timeouts are in seconds. Timeouts that are zero are set to the kernel's
+// default timeouts when creating or updating a policy.
+type TimeoutPolicy struct {
+	Name     string
+	Family   netfilter.ProtoFamily
+	Protocol uint8
+
+	// Use is the kernel's reference count of the policy. It is ignored when
+	// creating or updating a policy.
+	Use uint32
+
+	TCP     *TimeoutTCP
+	UDP     *TimeoutUDP
+	ICMP    *TimeoutICMP
+	SCTP    *TimeoutSCTP
+	DCCP    *TimeoutDCCP
+	GRE     *TimeoutGRE
+	Generic *TimeoutGeneric
+}
+
+// TimeoutTCP holds the timeouts of the states of a TCP connection.
+type TimeoutTCP struct {
+	SynSent, SynRecv, Established, FinWait, CloseWait,
+	LastAck, TimeWait, Close, SynSent2, Retrans, Unacknowledged uint32
+}
+
+// values returns pointers to the fields of the TimeoutTCP in the order
+// of enum ctattr_timeout_tcp, starting at CTA_TIMEOUT_TCP_SYN_SENT.
+func (t *TimeoutTCP) values() []*uint32 {
+	return []*uint32{
+		&t.SynSent, &t.SynRecv, &t.Established, &t.FinWait, &t.CloseWait,
+		&t.LastAck, &t.TimeWait, &t.Close, &t.SynSent2, &t.Retrans, &t.Unacknowledged,
+	}
+}
+
+// TimeoutUDP holds the timeouts of a UDP or UDP-Lite connection. Replied is used
+// when packets were seen in both directions.
+type TimeoutUDP struct {
+	Unreplied, Replied uint32
+}
+
+// values returns pointers to the fields of the TimeoutUDP in the order
+// of enum ctattr_timeout_udp, starting at CTA_TIMEOUT_UDP_UNREPLIED.
+func (t *TimeoutUDP) values() []*uint32 {
+	return []*uint32{&t.Unreplied, &t.Replied}
+}
+
+// TimeoutICMP holds the timeout of an ICMP or ICMPv6 connection.
+type TimeoutICMP struct {
+	Timeout uint32
+}
+
+// values returns a pointer to the field of the TimeoutICMP, CTA_TIMEOUT_ICMP_TIMEOUT.
+func (t *TimeoutICMP) values() []*uint32 {
+	return []*uint32{&t.Timeout}
+}
+
+// TimeoutSCTP holds the timeouts of the states of an SCTP connection.
+// HeartbeatAcked is no longer used by recent kernels.
+type TimeoutSCTP struct {
+	Closed, CookieWait, CookieEchoed, Established, ShutdownSent,
+	ShutdownRecd, ShutdownAckSent, HeartbeatSent, HeartbeatAcked uint32
+}
+
+// values returns pointers to the fields of the TimeoutSCTP in the order
+// of enum ctattr_timeout_sctp, starting at CTA_TIMEOUT_SCTP_CLOSED.
+func (t *TimeoutSCTP) values() []*uint32 {
+	return []*uint32{
+		&t.Closed, &t.CookieWait, &t.CookieEchoed, &t.Established, &t.ShutdownSent,
+		&t.ShutdownRecd, &t.ShutdownAckSent, &t.HeartbeatSent, &t.HeartbeatAcked,
+	}
+}
+
+// TimeoutDCCP holds the timeouts of the states of a DCCP connection.
+type TimeoutDCCP struct {
+	Request, Respond, PartOpen, Open, CloseReq, Closing, TimeWait uint32
+}
+
+// values returns pointers to the fields of the TimeoutDCCP in the order
+// of enum ctattr_timeout_dccp, starting at CTA_TIMEOUT_DCCP_REQUEST.
+func (t *TimeoutDCCP) values() []*uint32 {
+	return []*uint32{&t.Request, &t.Respond, &t.PartOpen, &t.Open, &t.CloseReq, &t.Closing, &t.TimeWait}
+}
+
+// TimeoutGRE holds the timeouts of a GRE connection. Replied is used
+// when packets were seen in both directions.
+type TimeoutGRE struct {
+	Unreplied, Replied uint32
+}
+
+// values returns pointers to the fields of the TimeoutGRE in the order
+// of enum ctattr_timeout_gre, starting at CTA_TIMEOUT_GRE_UNREPLIED.
+func (t *TimeoutGRE) values() []*uint32 {
+	return []*uint32{&t.Unreplied, &t.Replied}
+}
+
+// TimeoutGeneric holds the timeout of a connection of any protocol
+// without its own timeouts.
+type TimeoutGeneric struct {
+	Timeout uint32
+}
+
+// values returns a pointer to the field of the TimeoutGeneric, CTA_TIMEOUT_GENERIC_TIMEOUT.
+func (t *TimeoutGeneric) values() []*uint32 {
+	return []*uint32{&t.Timeout}
+}
+
+// timeouts is implemented by the per-protocol timeouts of a TimeoutPolicy.
+type timeouts interface {
+	values() []*uint32
+}
+
+// timeouts returns the per-protocol timeouts of the TimeoutPolicy matching its Protocol,
+// allocating them if they are nil.
+func (tp *TimeoutPolicy) timeouts() timeouts {
+
+	switch tp.Protocol {
+	case unix.IPPROTO_TCP:
+		if tp.TCP == nil {
+			tp.TCP = &TimeoutTCP{}
+		}
+		return tp.TCP
+	case unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE:
+		if tp.UDP == nil {
+			tp.UDP = &TimeoutUDP{}
+		}
+		return tp.UDP
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		if tp.ICMP == nil {
+			tp.ICMP = &TimeoutICMP{}
+		}
+		return tp.ICMP
+	case unix.IPPROTO_SCTP:
+		if tp.SCTP == nil {
+			tp.SCTP = &TimeoutSCTP{}
+		}
+		return tp.SCTP
+	case unix.IPPROTO_DCCP:
+		if tp.DCCP == nil {
+			tp.DCCP = &TimeoutDCCP{}
+		}
+		return tp.DCCP
+	case unix.IPPROTO_GRE:
+		if tp.GRE == nil {
+			tp.GRE = &TimeoutGRE{}
+		}
+		return tp.GRE
+	default:
+		if tp.Generic == nil {
+			tp.Generic = &TimeoutGeneric{}
+		}
+		return tp.Generic
+	}
+}
+
+// numTimeouts returns the amount of per-protocol timeouts that are set.
+func (tp TimeoutPolicy) numTimeouts() int {
+
+	var n int
+	for _, set := range []bool{
+		tp.TCP != nil, tp.UDP != nil, tp.ICMP != nil, tp.SCTP != nil,
+		tp.DCCP != nil, tp.GRE != nil, tp.Generic != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+
+	return n
+}
+
+// marshal marshals a TimeoutPolicy into a list of netfilter.Attributes.
+// The policy's Name is omitted when it is empty.
+func (tp TimeoutPolicy) marshal() ([]netfilter.Attribute, error) {
+
+	// Allocates the timeouts in the local copy of tp if needed, after which
+	// any other per-protocol timeouts that are set don't match the Protocol.
+	t := tp.timeouts()
+	if tp.numTimeouts() != 1 {
+		return nil, errTimeoutProtocol
+	}
+
+	data := netfilter.Attribute{Type: uint16(ctaTimeoutData), Nested: true}
+	for i, v := range t.values() {
+		if *v != 0 {
+			data.Children = append(data.Children, netfilter.Attribute{Type: uint16(i + 1), Data: netfilter.Uint32Bytes(*v)})
+		}
+	}
+
+	attrs := make([]netfilter.Attribute, 0, 4)
+
+	if tp.Name != "" {
+		attrs = append(attrs, marshalTimeoutName(tp.Name))
+	}
+
+	attrs = append(attrs,
+		netfilter.Attribute{Type: uint16(ctaTimeoutL3Proto), Data: netfilter.Uint16Bytes(uint16(tp.Family))},
+		netfilter.Attribute{Type: uint16(ctaTimeoutL4Proto), Data: []byte{tp.Protocol}},
+		data,
+	)
+
+	return attrs, nil
+}
+
+// unmarshal unmarshals a list of netfilter.Attributes into a TimeoutPolicy.
+func (tp *TimeoutPolicy) unmarshal(attrs []netfilter.Attribute) error {
+
+	// The timeouts can only be decoded when the policy's protocol is known.
+	var data *netfilter.Attribute
+
+	for i, attr := range attrs {
+		switch at := timeoutType(attr.Type); at {
+		case ctaTimeoutName:
+			tp.Name = string(bytes.TrimRight(attr.Data, "\x00"))
+		case ctaTimeoutL3Proto:
+			tp.Family = netfilter.ProtoFamily(attr.Uint16())
+		case ctaTimeoutL4Proto:
+			if len(attr.Data) != 1 {
+				return errIncorrectSize
+			}
+			tp.Protocol = attr.Data[0]
+		case ctaTimeoutData:
+			if !attr.Nested {
+				return errNotNested
+			}
+			data = &attrs[i]
+		case ctaTimeoutUse:
+			tp.Use = attr.Uint32()
+		}
+	}
+
+	if data == nil {
+		return nil
+	}
+
+	// Skip timeouts of states unknown to this package, added by newer kernels.
+	values := tp.timeouts().values()
+	for _, attr := range data.Children {
+		if attr.Type == 0 || int(attr.Type) > len(values) {
+			continue
+		}
+		*values[attr.Type-1] = attr.Uint32()
+	}
+
+	return nil
+}
+
+// marshalTimeoutName returns a CTA_TIMEOUT_NAME attribute holding the given policy name.
+func marshalTimeoutName(name string) netfilter.Attribute {
+	return netfilter.Attribute{Type: uint16(ctaTimeoutName), Data: append([]byte(name), 0)}
+}
+
+// unmarshalTimeoutPolicy unmarshals a TimeoutPolicy from a Netlink message.
+func unmarshalTimeoutPolicy(nlm netlink.Message) (TimeoutPolicy, error) {
+
+	var tp TimeoutPolicy
+
+	_, nfa, err := netfilter.UnmarshalNetlink(nlm)
+	if err != nil {
+		return tp, err
+	}
+
+	err = tp.unmarshal(nfa)
+	if err != nil {
+		return tp, err
+	}
+
+	return tp, nil
+}
+
+// unmarshalTimeoutPolicies unmarshals a list of TimeoutPolicies from a list of Netlink messages.
+func unmarshalTimeoutPolicies(nlm []netlink.Message) ([]TimeoutPolicy, error) {
+
+	out := make([]TimeoutPolicy, 0, len(nlm))
+
+	for _, m := range nlm {
+		tp, err := unmarshalTimeoutPolicy(m)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, tp)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,120 @@
+//+build integration
+
+package conntrack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// Create, update, get, dump and delete timeout policies.
+func TestConnTimeoutPolicy(t *testing.T) {
+
+	if !findKsym("cttimeout_new_timeout") {
+		t.Skip("cttimeout not supported on this kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	tcp := TimeoutPolicy{
+		Name:     "tcp-short",
+		Family:   netfilter.ProtoIPv4,
+		Protocol: unix.IPPROTO_TCP,
+		TCP:      &TimeoutTCP{SynSent: 5, Established: 600},
+	}
+	require.NoError(t, c.CreateTimeoutPolicy(tcp))
+
+	// Creating a policy with the same name fails.
+	err = c.CreateTimeoutPolicy(tcp)
+	en, ok := errno(err)
+	require.True(t, ok)
+	assert.Equal(t, unix.EEXIST, en)
+
+	udp := TimeoutPolicy{
+		Name:     "udp",
+		Family:   netfilter.ProtoIPv6,
+		Protocol: unix.IPPROTO_UDP,
+		UDP:      &TimeoutUDP{Unreplied: 10, Replied: 20},
+	}
+	require.NoError(t, c.CreateTimeoutPolicy(udp))
+
+	// Unset timeouts take the kernel's defaults.
+	def, err := c.DefaultTimeouts(netfilter.ProtoIPv4, unix.IPPROTO_TCP)
+	require.NoError(t, err)
+
+	qtp, err := c.GetTimeoutPolicy("tcp-short")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp-short", qtp.Name)
+	assert.Equal(t, netfilter.ProtoIPv4, qtp.Family)
+	assert.Equal(t, uint8(unix.IPPROTO_TCP), qtp.Protocol)
+	require.NotNil(t, qtp.TCP)
+	assert.Equal(t, uint32(5), qtp.TCP.SynSent)
+	assert.Equal(t, uint32(600), qtp.TCP.Established)
+	assert.Equal(t, def.TCP.TimeWait, qtp.TCP.TimeWait)
+
+	udp.UDP.Replied = 60
+	require.NoError(t, c.UpdateTimeoutPolicy(udp))
+
+	tps, err := c.DumpTimeoutPolicies()
+	require.NoError(t, err)
+	require.Len(t, tps, 2)
+
+	for _, tp := range tps {
+		if tp.Name == "udp" {
+			assert.Equal(t, TimeoutUDP{Unreplied: 10, Replied: 60}, *tp.UDP)
+		}
+	}
+
+	require.NoError(t, c.DeleteTimeoutPolicy("tcp-short"))
+
+	_, err = c.GetTimeoutPolicy("tcp-short")
+	en, ok = errno(err)
+	require.True(t, ok)
+	assert.Equal(t, unix.ENOENT, en)
+
+	require.NoError(t, c.FlushTimeoutPolicies())
+
+	tps, err = c.DumpTimeoutPolicies()
+	require.NoError(t, err)
+	assert.Empty(t, tps)
+
+	assert.EqualError(t, c.DeleteTimeoutPolicy(""), errTimeoutNeedName.Error())
+}
+
+// Get and set the default timeouts of a namespace.
+func TestConnDefaultTimeouts(t *testing.T) {
+
+	if !findKsym("cttimeout_default_set") {
+		t.Skip("cttimeout defaults not supported on this kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	def, err := c.DefaultTimeouts(netfilter.ProtoIPv4, unix.IPPROTO_ICMP)
+	require.NoError(t, err)
+	require.NotNil(t, def.ICMP)
+	assert.NotZero(t, def.ICMP.Timeout)
+
+	def, err = c.DefaultTimeouts(netfilter.ProtoIPv4, unix.IPPROTO_TCP)
+	require.NoError(t, err)
+	require.NotNil(t, def.TCP)
+	established := def.TCP.Established
+
+	// Zero timeouts are left unchanged.
+	require.NoError(t, c.SetDefaultTimeouts(TimeoutPolicy{
+		Family:   netfilter.ProtoIPv4,
+		Protocol: unix.IPPROTO_TCP,
+		TCP:      &TimeoutTCP{SynSent: 7},
+	}))
+
+	def, err = c.DefaultTimeouts(netfilter.ProtoIPv4, unix.IPPROTO_TCP)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), def.TCP.SynSent)
+	assert.Equal(t, established, def.TCP.Established)
+}
@@ -0,0 +1,158 @@
+package conntrack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestTimeoutPolicyMarshal(t *testing.T) {
+
+	tp := TimeoutPolicy{
+		Name:     "tcp-short",
+		Family:   netfilter.ProtoIPv4,
+		Protocol: unix.IPPROTO_TCP,
+		TCP:      &TimeoutTCP{SynSent: 5, Established: 600, Unacknowledged: 30},
+	}
+
+	attrs, err := tp.marshal()
+	require.NoError(t, err)
+
+	want := []netfilter.Attribute{
+		{Type: uint16(ctaTimeoutName), Data: []byte("tcp-short\x00")},
+		{Type: uint16(ctaTimeoutL3Proto), Data: []byte{0, 2}},
+		{Type: uint16(ctaTimeoutL4Proto), Data: []byte{unix.IPPROTO_TCP}},
+		{
+			Type:   uint16(ctaTimeoutData),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{Type: 1, Data: []byte{0, 0, 0, 5}},
+				{Type: 3, Data: []byte{0, 0, 2, 0x58}},
+				{Type: 11, Data: []byte{0, 0, 0, 30}},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, attrs); diff != "" {
+		t.Fatalf("unexpected TimeoutPolicy attributes (-want +got):\n%s", diff)
+	}
+
+	// Marshaling does not allocate timeouts in the caller's policy.
+	tp.TCP = nil
+	_, err = tp.marshal()
+	require.NoError(t, err)
+	assert.Nil(t, tp.TCP)
+
+	// Timeouts not matching the policy's protocol.
+	tp.UDP = &TimeoutUDP{Replied: 30}
+	_, err = tp.marshal()
+	assert.EqualError(t, err, errTimeoutProtocol.Error())
+
+	tp.TCP = &TimeoutTCP{}
+	_, err = tp.marshal()
+	assert.EqualError(t, err, errTimeoutProtocol.Error())
+}
+
+func TestTimeoutPolicyUnmarshal(t *testing.T) {
+
+	data := func(children ...netfilter.Attribute) netfilter.Attribute {
+		return netfilter.Attribute{Type: uint16(ctaTimeoutData), Nested: true, Children: children}
+	}
+
+	tests := []struct {
+		name  string
+		attrs []netfilter.Attribute
+		tp    TimeoutPolicy
+		err   error
+	}{
+		{
+			name: "udp",
+			attrs: []netfilter.Attribute{
+				{Type: uint16(ctaTimeoutName), Data: []byte("udp\x00")},
+				{Type: uint16(ctaTimeoutL3Proto), Data: []byte{0, 10}},
+				{Type: uint16(ctaTimeoutL4Proto), Data: []byte{unix.IPPROTO_UDP}},
+				data(
+					netfilter.Attribute{Type: 1, Data: []byte{0, 0, 0, 30}},
+					netfilter.Attribute{Type: 2, Data: []byte{0, 0, 0, 120}},
+				),
+				{Type: uint16(ctaTimeoutUse), Data: []byte{0, 0, 0, 1}},
+			},
+			tp: TimeoutPolicy{
+				Name: "udp", Family: netfilter.ProtoIPv6, Protocol: unix.IPPROTO_UDP, Use: 1,
+				UDP: &TimeoutUDP{Unreplied: 30, Replied: 120},
+			},
+		},
+		{
+			name: "data before protocol, unknown state",
+			attrs: []netfilter.Attribute{
+				data(
+					netfilter.Attribute{Type: 1, Data: []byte{0, 0, 0, 30}},
+					netfilter.Attribute{Type: 3, Data: []byte{0, 0, 0, 60}},
+				),
+				{Type: uint16(ctaTimeoutL4Proto), Data: []byte{unix.IPPROTO_ICMP}},
+			},
+			tp: TimeoutPolicy{Protocol: unix.IPPROTO_ICMP, ICMP: &TimeoutICMP{Timeout: 30}},
+		},
+		{
+			name: "generic",
+			attrs: []netfilter.Attribute{
+				{Type: uint16(ctaTimeoutL4Proto), Data: []byte{unix.IPPROTO_ESP}},
+				data(netfilter.Attribute{Type: 1, Data: []byte{0, 0, 2, 0x58}}),
+			},
+			tp: TimeoutPolicy{Protocol: unix.IPPROTO_ESP, Generic: &TimeoutGeneric{Timeout: 600}},
+		},
+		{
+			name: "data not nested",
+			attrs: []netfilter.Attribute{
+				{Type: uint16(ctaTimeoutData)},
+			},
+			err: errNotNested,
+		},
+		{
+			name: "l4proto wrong size",
+			attrs: []netfilter.Attribute{
+				{Type: uint16(ctaTimeoutL4Proto), Data: []byte{0, 6}},
+			},
+			err: errIncorrectSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var tp TimeoutPolicy
+			err := tp.unmarshal(tt.attrs)
+			if tt.err != nil {
+				assert.EqualError(t, err, tt.err.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			if diff := cmp.Diff(tt.tp, tp); diff != "" {
+				t.Fatalf("unexpected unmarshal (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTimeoutPolicyValues(t *testing.T) {
+
+	// Every field of the per-protocol timeouts is marshaled to its own attribute.
+	for _, to := range []timeouts{
+		&TimeoutTCP{}, &TimeoutUDP{}, &TimeoutICMP{}, &TimeoutSCTP{},
+		&TimeoutDCCP{}, &TimeoutGRE{}, &TimeoutGeneric{},
+	} {
+		fields := reflect.TypeOf(to).Elem().NumField()
+
+		seen := make(map[*uint32]bool)
+		for _, v := range to.values() {
+			seen[v] = true
+		}
+		assert.Len(t, seen, fields, "%T", to)
+	}
+}